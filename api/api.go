@@ -2,23 +2,78 @@ package api
 
 import (
 	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"log"
 	"net/http"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/mullvad/message-queue/api/handler"
+	"github.com/mullvad/message-queue/filter"
 	"github.com/mullvad/message-queue/queue"
 	"nhooyr.io/websocket"
 )
 
-const subProtocol = "message-queue-v1"
+const (
+	// subProtocol sends the raw message payloads
+	subProtocol = "message-queue-v1"
+	// envelopeSubProtocol wraps every payload in a JSON envelope with the message metadata
+	envelopeSubProtocol = "message-queue-envelope-v1"
+	// ackSubProtocol sends envelopes, which the client must acknowledge for them not to be redelivered in its session
+	ackSubProtocol = "message-queue-ack-v1"
+)
+
+// gapStatus closes the connections of clients using the raw subprotocol when messages may have been lost, as it can't
+// be told in-band, for them to resync their state before subscribing again
+const gapStatus websocket.StatusCode = 4000
+
+// subProtocols are the supported subprotocols, in order of preference
+var subProtocols = []string{subProtocol, envelopeSubProtocol, ackSubProtocol}
 
 // API is a http API
 type API struct {
 	Queue        *queue.Queue
 	PingTimeout  time.Duration
 	PingInterval time.Duration
+	AckTimeout   time.Duration // How long clients have to acknowledge messages on work queue channels
+	// How long the sessions of clients are kept after they disconnect, with their unacknowledged messages and inbox
+	SessionRetention time.Duration
+	// How many messages, and payload bytes, are kept for clients with a session while they're disconnected
+	InboxMessages int
+	InboxBytes    int
+	// Publishes the messages clients send on channels they may publish on, see PublishSettings
+	Publisher Publisher
+
+	mutex    sync.RWMutex
+	creators []Creator
+	channels map[string]ChannelSettings
+}
+
+// ChannelSettings are the settings of an individual channel
+type ChannelSettings struct {
+	PingInterval time.Duration    // Overrides the default ping interval, if set
+	Tokens       []string         // Clients must present one of the tokens to subscribe, if set
+	Publish      *PublishSettings // Lets clients publish on their connections, if set
+}
+
+// ChannelCreator creates the channels it knows about on demand
+type ChannelCreator interface {
+	Matches(channel string) bool
+	// Create creates the channel if it doesn't exist, and may refuse to, such as when too many channels exist
+	Create(channel string) error
+}
+
+// Creator creates channels on demand, which are subscribed to with the settings
+type Creator struct {
+	ChannelCreator
+	Settings ChannelSettings
 }
 
 // New returns a new instance of the API with default settings
@@ -27,7 +82,48 @@ func New(q *queue.Queue) *API {
 		Queue:        q,
 		PingTimeout:  time.Second * 15,
 		PingInterval: time.Second * 25,
+		AckTimeout:   time.Second * 30,
+
+		SessionRetention: time.Minute * 5,
+		InboxMessages:    1000,
+		InboxBytes:       1024 * 1024,
+	}
+}
+
+// SetCreators sets what creates channels on demand when clients subscribe to them, such as routed channels without any
+// messages yet
+func (a *API) SetCreators(creators []Creator) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	a.creators = creators
+}
+
+// SetChannels sets the settings of individual channels, overriding the defaults
+// They may be changed while the API is serving, and apply to new connections
+func (a *API) SetChannels(channels map[string]ChannelSettings) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	a.channels = channels
+}
+
+// channelSettings returns the settings of the channel, or of the creator knowing about it
+func (a *API) channelSettings(channel string) ChannelSettings {
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+
+	if settings, ok := a.channels[channel]; ok {
+		return settings
 	}
+
+	for _, creator := range a.creators {
+		if creator.Matches(channel) {
+			return creator.Settings
+		}
+	}
+
+	return ChannelSettings{}
 }
 
 // Router returns a http router
@@ -40,6 +136,7 @@ func (a *API) Router() http.Handler {
 	router.StrictSlash(true)
 
 	router.Handle("/channel/{channel}", handler.Handler(a.handleChannel))
+	router.Handle("/channel/{channel}/messages", handler.Handler(a.handleMessages)).Methods(http.MethodGet)
 
 	return handler.Recovery(router)
 }
@@ -49,6 +146,21 @@ var notFoundError = &handler.Error{
 	Code:    http.StatusNotFound,
 }
 
+var channelUnavailableError = &handler.Error{
+	Message: "channel unavailable",
+	Code:    http.StatusServiceUnavailable,
+}
+
+var unauthorizedError = &handler.Error{
+	Message: "unauthorized",
+	Code:    http.StatusUnauthorized,
+}
+
+var tooManySubscribersError = &handler.Error{
+	Message: "too many subscribers",
+	Code:    http.StatusServiceUnavailable,
+}
+
 func (a *API) notFoundHandler(w http.ResponseWriter, r *http.Request) *handler.Error {
 	return notFoundError
 }
@@ -57,16 +169,101 @@ func (a *API) handleChannel(w http.ResponseWriter, r *http.Request) *handler.Err
 	vars := mux.Vars(r)
 	channel := vars["channel"]
 
+	settings := a.channelSettings(channel)
+	if !authorized(r, settings.Tokens) {
+		return unauthorizedError
+	}
+
+	pingInterval := a.PingInterval
+	if settings.PingInterval > 0 {
+		pingInterval = settings.PingInterval
+	}
+
+	// Only deliver the messages matching the filter expression, if any
+	var options []queue.SubscribeOption
+	if expression := r.URL.Query().Get("filter"); expression != "" {
+		f, err := filter.Parse(expression)
+		if err != nil {
+			return handler.BadRequest(err.Error())
+		}
+		options = append(options, queue.WithFilter(f))
+	}
+
+	// Clients may resume from the last message they received, getting any messages they missed first
+	if since := r.URL.Query().Get("since"); since != "" {
+		sequence, err := strconv.ParseUint(since, 10, 64)
+		if err != nil {
+			return handler.BadRequest("invalid sequence number")
+		}
+		options = append(options, queue.WithResume(sequence))
+	}
+
+	// Clients that don't speak any of the subprotocols are refused before subscribing, so that they can't take over any
+	// sessions either
+	protocol := negotiate(r)
+	if protocol == "" {
+		c, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			log.Println("error upgrading connection to websocket", err)
+			return handler.InternalServerError()
+		}
+
+		log.Println("refusing client connection: invalid subprotocol")
+		c.Close(websocket.StatusPolicyViolation, "client must speak the correct subprotocol")
+		return nil
+	}
+	envelope := protocol == envelopeSubProtocol || protocol == ackSubProtocol
+
+	// Clients on work queue channels may acknowledge messages, for them to be redelivered if they don't
+	var acks chan queue.Ack
+	if r.URL.Query().Get("ack") != "" || protocol == ackSubProtocol {
+		if !envelope {
+			return handler.BadRequest("acknowledgements require message envelopes")
+		}
+
+		acks = make(chan queue.Ack)
+		options = append(options, queue.WithAcks(acks, a.AckTimeout))
+	}
+
+	// Clients with a session resume it, getting any unacknowledged messages, and the messages published while they were
+	// disconnected, first
+	// Sessions belong to the token the client presents, if any, so that clients can only resume the sessions of their
+	// own token
+	session := r.URL.Query().Get("session")
+	if session == "" && protocol == ackSubProtocol {
+		return handler.BadRequest("the ack subprotocol requires a session")
+	}
+	if session != "" {
+		if token := presentedToken(r); token != "" {
+			sum := sha256.Sum256([]byte(token))
+			session = hex.EncodeToString(sum[:16]) + ":" + session
+		}
+		options = append(options, queue.WithSession(session, a.SessionRetention), queue.WithInbox(a.InboxMessages, a.InboxBytes))
+	}
+
 	ctx, cancel := context.WithCancel(r.Context())
 	defer cancel()
 
-	ch, err := a.Queue.Subscribe(ctx, channel)
+	ch, err := a.Queue.Subscribe(ctx, channel, options...)
+	if err != nil && !errors.Is(err, queue.ErrTooManySubscribers) {
+		created, createErr := a.create(channel)
+		if createErr != nil {
+			log.Printf("error creating channel %q: %s", channel, createErr)
+			return channelUnavailableError
+		}
+		if created {
+			ch, err = a.Queue.Subscribe(ctx, channel, options...)
+		}
+	}
+	if errors.Is(err, queue.ErrTooManySubscribers) {
+		return tooManySubscribersError
+	}
 	if err != nil {
 		return handler.BadRequest("invalid channel")
 	}
 
 	c, err := websocket.Accept(w, r, &websocket.AcceptOptions{
-		Subprotocols: []string{subProtocol},
+		Subprotocols: []string{protocol},
 	})
 
 	if err != nil {
@@ -76,16 +273,24 @@ func (a *API) handleChannel(w http.ResponseWriter, r *http.Request) *handler.Err
 
 	defer c.Close(websocket.StatusInternalError, "the sky is falling")
 
-	if c.Subprotocol() != subProtocol {
-		log.Println("refusing client connection: invalid subprotocol")
-		c.Close(websocket.StatusPolicyViolation, "client must speak the correct subprotocol")
-		return nil
+	// Only clients allowed to publish may send messages, other than acknowledgements
+	publish := settings.Publish
+	if publish != nil && !authorized(r, publish.Tokens) {
+		publish = nil
 	}
 
-	// Set up reader to handle pings, but terminate the connection if we receieve any messages
-	ctx = c.CloseRead(ctx)
+	if publish != nil {
+		// Set up reader to handle pings, published messages and acknowledgements
+		go a.readPublished(ctx, cancel, c, publish, envelope, acks)
+	} else if acks != nil {
+		// Set up reader to handle pings and acknowledgements
+		go a.readAcks(ctx, cancel, c, acks)
+	} else {
+		// Set up reader to handle pings, but terminate the connection if we receieve any messages
+		ctx = c.CloseRead(ctx)
+	}
 
-	pingTicker := time.NewTicker(a.PingInterval)
+	pingTicker := time.NewTicker(pingInterval)
 	defer pingTicker.Stop()
 
 	// Subscribe to the queue
@@ -111,10 +316,118 @@ func (a *API) handleChannel(w http.ResponseWriter, r *http.Request) *handler.Err
 				return nil
 			}
 
-			err := c.Write(ctx, websocket.MessageText, msg)
+			// Clients with envelopes get the gap in-band instead
+			if msg.Gap && !envelope {
+				c.Close(gapStatus, "messages may have been lost, resync")
+				return nil
+			}
+
+			data := msg.Payload
+			if envelope {
+				data, err = json.Marshal(msg)
+				if err != nil {
+					log.Println("error encoding message", err)
+					continue
+				}
+			}
+
+			err := c.Write(ctx, websocket.MessageText, data)
 			if err != nil {
 				log.Println("error sending message", err)
 			}
 		}
 	}
 }
+
+// authorized returns whether the client presents one of the tokens, as a bearer token or the token query parameter,
+// or if there are no tokens
+// Browsers can't set headers on websocket connections, which is why the query parameter is supported
+func authorized(r *http.Request, tokens []string) bool {
+	if len(tokens) == 0 {
+		return true
+	}
+
+	presented := presentedToken(r)
+	if presented == "" {
+		return false
+	}
+
+	for _, token := range tokens {
+		if subtle.ConstantTimeCompare([]byte(presented), []byte(token)) == 1 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// presentedToken returns the token the client presents, as a bearer token or the token query parameter, if any
+func presentedToken(r *http.Request) string {
+	if header := r.Header.Get("Authorization"); strings.HasPrefix(header, "Bearer ") {
+		return strings.TrimPrefix(header, "Bearer ")
+	}
+	return r.URL.Query().Get("token")
+}
+
+// create creates a channel on demand, and returns false if no creator knows about it
+func (a *API) create(channel string) (bool, error) {
+	a.mutex.RLock()
+	creators := a.creators
+	a.mutex.RUnlock()
+
+	for _, creator := range creators {
+		if creator.Matches(channel) {
+			return true, creator.Create(channel)
+		}
+	}
+	return false, nil
+}
+
+// negotiate returns the most preferred subprotocol offered by the client, or an empty string if there's none
+func negotiate(r *http.Request) string {
+	offered := make(map[string]bool)
+	for _, header := range r.Header.Values("Sec-WebSocket-Protocol") {
+		for _, protocol := range strings.Split(header, ",") {
+			offered[strings.TrimSpace(protocol)] = true
+		}
+	}
+
+	for _, protocol := range subProtocols {
+		if offered[protocol] {
+			return protocol
+		}
+	}
+
+	return ""
+}
+
+// ack is a message from the client acknowledging a message by its sequence number, or every message up to and
+// including it if cumulative
+type ack struct {
+	Ack        uint64 `json:"ack"`
+	Cumulative bool   `json:"cumulative"`
+}
+
+// readAcks reads acknowledgements from the client, and cancels the context when the connection is closed
+func (a *API) readAcks(ctx context.Context, cancel context.CancelFunc, c *websocket.Conn, acks chan<- queue.Ack) {
+	defer cancel()
+
+	for {
+		_, data, err := c.Read(ctx)
+		if err != nil {
+			return
+		}
+
+		var msg ack
+		if err := json.Unmarshal(data, &msg); err != nil || msg.Ack == 0 {
+			c.Close(websocket.StatusPolicyViolation, "invalid acknowledgement")
+			return
+		}
+
+		select {
+		case acks <- queue.Ack{Sequence: msg.Ack, Cumulative: msg.Cumulative}:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -2,38 +2,79 @@ package api_test
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io/ioutil"
+	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/mullvad/message-queue/message"
 	"github.com/mullvad/message-queue/queue"
+	"github.com/mullvad/message-queue/schema"
 
 	"github.com/mullvad/message-queue/api"
 	"nhooyr.io/websocket"
 )
 
 const (
-	subProtocol = "message-queue-v1"
-	testMessage = "foobar"
-	channel     = "test"
+	subProtocol         = "message-queue-v1"
+	envelopeSubProtocol = "message-queue-envelope-v1"
+	ackSubProtocol      = "message-queue-ack-v1"
+	testMessage         = "foobar"
+	channel             = "test"
+	workChannel         = "work"
+	historyChannel      = "history"
+	privateChannel      = "private"
+	token               = "secret"
 )
 
 func TestAPI(t *testing.T) {
 	queueCtx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	queue := queue.New(queueCtx, 100)
+	q := queue.New(queueCtx, 100)
 
-	ch, err := queue.CreateChannel(channel)
+	ch, err := q.CreateChannel(channel)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	a := api.New(queue)
+	work, err := q.CreateChannel(workChannel, queue.WithDispatch(queue.RoundRobin))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	history, err := q.CreateChannel(historyChannel, queue.WithHistory(queue.NewMemoryHistory(10)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The last message makes sure that the previous ones have been stored
+	for i := 1; i <= 4; i++ {
+		history <- message.New(historyChannel, []byte(fmt.Sprintf(`{"n":%d}`, i)))
+	}
+
+	if _, err := q.CreateChannel(privateChannel); err != nil {
+		t.Fatal(err)
+	}
+
+	a := api.New(q)
+	a.SetCreators([]api.Creator{
+		{ChannelCreator: onDemand{queue: q, prefix: "on-demand"}},
+		{ChannelCreator: onDemand{queue: q, prefix: "private-demand."}, Settings: api.ChannelSettings{Tokens: []string{token}}},
+		{ChannelCreator: onDemand{queue: q, prefix: "full.", err: errors.New("too many channels")}},
+	})
+	a.SetChannels(map[string]api.ChannelSettings{
+		privateChannel: {Tokens: []string{token}},
+	})
 	a.PingTimeout = time.Millisecond * 10
 	a.PingInterval = a.PingTimeout / 4
+	a.AckTimeout = time.Millisecond * 10
 
 	server := httptest.NewServer(a.Router())
 	defer server.Close()
@@ -58,7 +99,7 @@ func TestAPI(t *testing.T) {
 
 		defer c.Close(websocket.StatusNormalClosure, "")
 
-		ch <- []byte(testMessage)
+		ch <- message.New(channel, []byte(testMessage))
 
 		_, message, err := c.Read(ctx)
 		if err != nil {
@@ -70,6 +111,446 @@ func TestAPI(t *testing.T) {
 		}
 	})
 
+	t.Run("recieve message envelope", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		c, _, err := websocket.Dial(ctx, fmt.Sprintf("ws://%s/channel/%s", parsedURL.Host, channel), &websocket.DialOptions{
+			HTTPClient:   server.Client(),
+			Subprotocols: []string{envelopeSubProtocol},
+		})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer c.Close(websocket.StatusNormalClosure, "")
+
+		ch <- message.New("source", []byte(testMessage))
+
+		_, data, err := c.Read(ctx)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+
+		var msg message.Message
+		if err := json.Unmarshal(data, &msg); err != nil {
+			t.Fatal(err)
+		}
+
+		if string(msg.Payload) != testMessage || msg.Channel != "source" || msg.Sequence == 0 {
+			t.Errorf("wrong message: %s", data)
+		}
+	})
+
+	t.Run("recieve gap envelope", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		c, _, err := websocket.Dial(ctx, fmt.Sprintf("ws://%s/channel/%s", parsedURL.Host, channel), &websocket.DialOptions{
+			HTTPClient:   server.Client(),
+			Subprotocols: []string{envelopeSubProtocol},
+		})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer c.Close(websocket.StatusNormalClosure, "")
+
+		ch <- message.NewGap("source")
+
+		_, data, err := c.Read(ctx)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+
+		var msg message.Message
+		if err := json.Unmarshal(data, &msg); err != nil {
+			t.Fatal(err)
+		}
+
+		if !msg.Gap || msg.Channel != "source" {
+			t.Errorf("wrong message: %s", data)
+		}
+	})
+
+	t.Run("close on gap without envelopes", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		c, _, err := websocket.Dial(ctx, fmt.Sprintf("ws://%s/channel/%s", parsedURL.Host, channel), &websocket.DialOptions{
+			HTTPClient:   server.Client(),
+			Subprotocols: []string{subProtocol},
+		})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer c.Close(websocket.StatusNormalClosure, "")
+
+		ch <- message.NewGap(channel)
+
+		_, _, err = c.Read(ctx)
+		if status := websocket.CloseStatus(err); status != 4000 {
+			t.Errorf("wrong close status %d: %v", status, err)
+		}
+	})
+
+	t.Run("recieve filtered messages", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		c, _, err := websocket.Dial(ctx, fmt.Sprintf("ws://%s/channel/%s?filter=%s", parsedURL.Host, channel, url.QueryEscape(`id == 2`)), &websocket.DialOptions{
+			HTTPClient:   server.Client(),
+			Subprotocols: []string{subProtocol},
+		})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer c.Close(websocket.StatusNormalClosure, "")
+
+		ch <- message.New(channel, []byte(`{"id":1}`))
+		ch <- message.New(channel, []byte(`{"id":2}`))
+
+		_, data, err := c.Read(ctx)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+
+		if string(data) != `{"id":2}` {
+			t.Errorf("wrong message: %s", data)
+		}
+	})
+
+	t.Run("invalid filter", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		_, _, err := websocket.Dial(ctx, fmt.Sprintf("ws://%s/channel/%s?filter=%s", parsedURL.Host, channel, url.QueryEscape(`id ==`)), &websocket.DialOptions{
+			HTTPClient:   server.Client(),
+			Subprotocols: []string{subProtocol},
+		})
+
+		if err == nil {
+			t.Error("no error")
+		}
+	})
+
+	t.Run("acknowledge messages", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		c, _, err := websocket.Dial(ctx, fmt.Sprintf("ws://%s/channel/%s?ack=true", parsedURL.Host, workChannel), &websocket.DialOptions{
+			HTTPClient:   server.Client(),
+			Subprotocols: []string{envelopeSubProtocol},
+		})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer c.Close(websocket.StatusNormalClosure, "")
+
+		work <- message.New(workChannel, []byte(testMessage))
+
+		// The message should be redelivered until it's acknowledged
+		var msg message.Message
+		for i := 0; i < 2; i++ {
+			_, data, err := c.Read(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err := json.Unmarshal(data, &msg); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		err = c.Write(ctx, websocket.MessageText, []byte(fmt.Sprintf(`{"ack":%d}`, msg.Sequence)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("acknowledgements without envelope", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		_, _, err := websocket.Dial(ctx, fmt.Sprintf("ws://%s/channel/%s?ack=true", parsedURL.Host, workChannel), &websocket.DialOptions{
+			HTTPClient:   server.Client(),
+			Subprotocols: []string{subProtocol},
+		})
+
+		if err == nil {
+			t.Error("no error")
+		}
+	})
+
+	t.Run("resume session", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		sessionURL := fmt.Sprintf("ws://%s/channel/%s?session=resume", parsedURL.Host, channel)
+		options := &websocket.DialOptions{
+			HTTPClient:   server.Client(),
+			Subprotocols: []string{ackSubProtocol},
+		}
+
+		c, _, err := websocket.Dial(ctx, sessionURL, options)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ch <- message.New(channel, []byte(testMessage))
+
+		_, first, err := c.Read(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Disconnect without acknowledging the message, and expect it to be redelivered
+		c.Close(websocket.StatusNormalClosure, "")
+
+		c, _, err = websocket.Dial(ctx, sessionURL, options)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer c.Close(websocket.StatusNormalClosure, "")
+
+		_, second, err := c.Read(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(first) != string(second) {
+			t.Fatalf("wrong message redelivered: %s", second)
+		}
+
+		var msg message.Message
+		if err := json.Unmarshal(second, &msg); err != nil {
+			t.Fatal(err)
+		}
+
+		err = c.Write(ctx, websocket.MessageText, []byte(fmt.Sprintf(`{"ack":%d,"cumulative":true}`, msg.Sequence)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("offline inbox", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		sessionURL := fmt.Sprintf("ws://%s/channel/%s?session=inbox", parsedURL.Host, channel)
+		options := &websocket.DialOptions{
+			HTTPClient:   server.Client(),
+			Subprotocols: []string{subProtocol},
+		}
+
+		c, _, err := websocket.Dial(ctx, sessionURL, options)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Wait for the subscription to be set up before disconnecting
+		ch <- message.New(channel, []byte(testMessage))
+		if _, _, err := c.Read(ctx); err != nil {
+			t.Fatal(err)
+		}
+		c.Close(websocket.StatusNormalClosure, "")
+
+		// Wait for the server to notice that the client is gone, and expect the message to be kept for it
+		time.Sleep(time.Millisecond * 200)
+		ch <- message.New(channel, []byte("offline"))
+
+		c, _, err = websocket.Dial(ctx, sessionURL, options)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer c.Close(websocket.StatusNormalClosure, "")
+
+		_, data, err := c.Read(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(data) != "offline" {
+			t.Fatalf("wrong message: %s", data)
+		}
+	})
+
+	t.Run("sessions not taken over", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		sessionURL := fmt.Sprintf("ws://%s/channel/%s?session=owned", parsedURL.Host, channel)
+		options := &websocket.DialOptions{
+			HTTPClient:   server.Client(),
+			Subprotocols: []string{subProtocol},
+		}
+
+		c, _, err := websocket.Dial(ctx, sessionURL, options)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer c.Close(websocket.StatusNormalClosure, "")
+
+		// Wait for the subscription to be set up
+		ch <- message.New(channel, []byte(testMessage))
+		if _, _, err := c.Read(ctx); err != nil {
+			t.Fatal(err)
+		}
+
+		// Clients without a subprotocol are refused before subscribing
+		refused, _, err := websocket.Dial(ctx, sessionURL, &websocket.DialOptions{HTTPClient: server.Client()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := refused.Read(ctx); websocket.CloseStatus(err) != websocket.StatusPolicyViolation {
+			t.Fatalf("not refused: %v", err)
+		}
+
+		// Clients presenting another token get a session of their own
+		other, _, err := websocket.Dial(ctx, sessionURL+"&token=other", options)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer other.Close(websocket.StatusNormalClosure, "")
+
+		ch <- message.New(channel, []byte("still subscribed"))
+		for _, c := range []*websocket.Conn{c, other} {
+			if _, data, err := c.Read(ctx); err != nil || string(data) != "still subscribed" {
+				t.Fatalf("wrong message: %s: %v", data, err)
+			}
+		}
+	})
+
+	t.Run("session required", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		_, _, err := websocket.Dial(ctx, fmt.Sprintf("ws://%s/channel/%s", parsedURL.Host, channel), &websocket.DialOptions{
+			HTTPClient:   server.Client(),
+			Subprotocols: []string{ackSubProtocol},
+		})
+
+		if err == nil {
+			t.Error("no error")
+		}
+	})
+
+	t.Run("query messages", func(t *testing.T) {
+		res, err := server.Client().Get(fmt.Sprintf("%s/channel/%s/messages?since=1&limit=1", server.URL, historyChannel))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+
+		var messages []message.Message
+		if err := json.NewDecoder(res.Body).Decode(&messages); err != nil {
+			t.Fatal(err)
+		}
+
+		if len(messages) != 1 || messages[0].Sequence != 2 || string(messages[0].Payload) != `{"n":2}` {
+			t.Fatalf("wrong messages: %v", messages)
+		}
+	})
+
+	t.Run("query the latest messages", func(t *testing.T) {
+		res, err := server.Client().Get(fmt.Sprintf("%s/channel/%s/messages?limit=2", server.URL, historyChannel))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+
+		var messages []message.Message
+		if err := json.NewDecoder(res.Body).Decode(&messages); err != nil {
+			t.Fatal(err)
+		}
+
+		if len(messages) != 2 || messages[0].Sequence != 3 || messages[1].Sequence != 4 {
+			t.Fatalf("wrong messages: %v", messages)
+		}
+	})
+
+	t.Run("query messages as ndjson", func(t *testing.T) {
+		since := url.QueryEscape(time.Now().Add(-time.Minute).Format(time.RFC3339))
+		req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/channel/%s/messages?since=%s", server.URL, historyChannel, since), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Accept", "application/x-ndjson")
+
+		res, err := server.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+
+		decoder := json.NewDecoder(res.Body)
+		for i := uint64(1); i <= 3; i++ {
+			var msg message.Message
+			if err := decoder.Decode(&msg); err != nil {
+				t.Fatal(err)
+			}
+
+			if msg.Sequence != i {
+				t.Fatalf("wrong message: %d", msg.Sequence)
+			}
+		}
+	})
+
+	t.Run("negotiate the format of messages", func(t *testing.T) {
+		for _, test := range []struct {
+			accept      string
+			contentType string
+		}{
+			{"application/json;q=0.5, application/x-ndjson", "application/x-ndjson"},
+			{"Application/X-NDJSON; charset=utf-8", "application/x-ndjson"},
+			{"application/json, application/x-ndjson;q=0.5", "application/json"},
+			{"application/x-ndjson;q=0", "application/json"},
+			{"*/*", "application/json"},
+		} {
+			req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/channel/%s/messages", server.URL, historyChannel), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Accept", test.accept)
+
+			res, err := server.Client().Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ioutil.ReadAll(res.Body)
+			res.Body.Close()
+
+			if contentType := res.Header.Get("Content-Type"); contentType != test.contentType {
+				t.Errorf("%q: wrong content type %s", test.accept, contentType)
+			}
+		}
+	})
+
+	t.Run("query messages without history", func(t *testing.T) {
+		res, err := server.Client().Get(fmt.Sprintf("%s/channel/%s/messages", server.URL, channel))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		ioutil.ReadAll(res.Body)
+
+		if res.StatusCode != http.StatusBadRequest {
+			t.Fatalf("wrong status code: %d", res.StatusCode)
+		}
+	})
+
 	t.Run("ping timeout", func(t *testing.T) {
 		ctx, cancel := context.WithCancel(context.Background())
 		defer cancel()
@@ -115,13 +596,132 @@ func TestAPI(t *testing.T) {
 		}
 	})
 
+	t.Run("create channel on demand", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		c, _, err := websocket.Dial(ctx, fmt.Sprintf("ws://%s/channel/on-demand", parsedURL.Host), &websocket.DialOptions{
+			HTTPClient:   server.Client(),
+			Subprotocols: []string{subProtocol},
+		})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		c.Close(websocket.StatusNormalClosure, "")
+	})
+
+	t.Run("authorize channels created on demand", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		_, res, err := websocket.Dial(ctx, fmt.Sprintf("ws://%s/channel/private-demand.1", parsedURL.Host), &websocket.DialOptions{
+			HTTPClient:   server.Client(),
+			Subprotocols: []string{subProtocol},
+		})
+		if err == nil || res.StatusCode != http.StatusUnauthorized {
+			t.Fatal("not unauthorized")
+		}
+
+		if _, err := q.Subscribe(ctx, "private-demand.1"); err == nil {
+			t.Fatal("channel created without authorization")
+		}
+
+		c, _, err := websocket.Dial(ctx, fmt.Sprintf("ws://%s/channel/private-demand.1?token=%s", parsedURL.Host, token), &websocket.DialOptions{
+			HTTPClient:   server.Client(),
+			Subprotocols: []string{subProtocol},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.Close(websocket.StatusNormalClosure, "")
+	})
+
+	t.Run("channel creation refused", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		_, res, err := websocket.Dial(ctx, fmt.Sprintf("ws://%s/channel/full.1", parsedURL.Host), &websocket.DialOptions{
+			HTTPClient:   server.Client(),
+			Subprotocols: []string{subProtocol},
+		})
+		if err == nil || res.StatusCode != http.StatusServiceUnavailable {
+			t.Fatal("channel not unavailable")
+		}
+	})
+
+	t.Run("authorization required", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		_, res, err := websocket.Dial(ctx, fmt.Sprintf("ws://%s/channel/%s?token=invalid", parsedURL.Host, privateChannel), &websocket.DialOptions{
+			HTTPClient:   server.Client(),
+			Subprotocols: []string{subProtocol},
+		})
+
+		if err == nil || res.StatusCode != http.StatusUnauthorized {
+			t.Fatal("not unauthorized")
+		}
+	})
+
+	t.Run("authorized", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		header := http.Header{}
+		header.Set("Authorization", "Bearer "+token)
+
+		c, _, err := websocket.Dial(ctx, fmt.Sprintf("ws://%s/channel/%s", parsedURL.Host, privateChannel), &websocket.DialOptions{
+			HTTPClient:   server.Client(),
+			HTTPHeader:   header,
+			Subprotocols: []string{subProtocol},
+		})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		c.Close(websocket.StatusNormalClosure, "")
+	})
+
+	t.Run("rotated tokens", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		a.SetChannels(map[string]api.ChannelSettings{
+			privateChannel: {Tokens: []string{"rotated"}},
+		})
+		defer a.SetChannels(map[string]api.ChannelSettings{
+			privateChannel: {Tokens: []string{token}},
+		})
+
+		_, resp, err := websocket.Dial(ctx, fmt.Sprintf("ws://%s/channel/%s?token=%s", parsedURL.Host, privateChannel, token), &websocket.DialOptions{
+			HTTPClient:   server.Client(),
+			Subprotocols: []string{subProtocol},
+		})
+		if err == nil || resp.StatusCode != http.StatusUnauthorized {
+			t.Fatalf("old token accepted: %v", err)
+		}
+
+		c, _, err := websocket.Dial(ctx, fmt.Sprintf("ws://%s/channel/%s?token=rotated", parsedURL.Host, privateChannel), &websocket.DialOptions{
+			HTTPClient:   server.Client(),
+			Subprotocols: []string{subProtocol},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		c.Close(websocket.StatusNormalClosure, "")
+	})
+
 	t.Run("invalid channel", func(t *testing.T) {
 		ctx, cancel := context.WithCancel(context.Background())
 		defer cancel()
 
 		_, _, err := websocket.Dial(ctx, fmt.Sprintf("ws://%s/channel/invalid", parsedURL.Host), &websocket.DialOptions{
 			HTTPClient:   server.Client(),
-			Subprotocols: []string{"invalid"},
+			Subprotocols: []string{subProtocol},
 		})
 
 		if err == nil {
@@ -129,3 +729,197 @@ func TestAPI(t *testing.T) {
 		}
 	})
 }
+
+func TestPublish(t *testing.T) {
+	queueCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	q := queue.New(queueCtx, 100)
+
+	for _, name := range []string{"chat", "cursors", "limited"} {
+		if _, err := q.CreateChannel(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cursor, err := schema.Parse([]byte(`{"type":"object","required":["x","y"]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	published := make(chan publishedMessage, 10)
+
+	a := api.New(q)
+	a.Publisher = publisher(published)
+	a.SetChannels(map[string]api.ChannelSettings{
+		"chat":    {Publish: &api.PublishSettings{Channel: "chat-in", Tokens: []string{token}, MaxSize: 16}},
+		"cursors": {Publish: &api.PublishSettings{Channel: "cursors", Tokens: []string{token}, Schema: cursor}},
+		"limited": {Publish: &api.PublishSettings{Channel: "limited", Tokens: []string{token}, Rate: 0.01, Burst: 2}},
+	})
+
+	server := httptest.NewServer(a.Router())
+	defer server.Close()
+
+	parsedURL, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dial := func(ctx context.Context, t *testing.T, channel string, protocol string, token string) *websocket.Conn {
+		c, _, err := websocket.Dial(ctx, fmt.Sprintf("ws://%s/channel/%s?token=%s", parsedURL.Host, channel, token), &websocket.DialOptions{
+			HTTPClient:   server.Client(),
+			Subprotocols: []string{protocol},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+
+	assertPublished := func(t *testing.T, channel string, payload string) {
+		select {
+		case m := <-published:
+			if m.channel != channel || m.payload != payload {
+				t.Fatalf("wrong message published to %s: %s", m.channel, m.payload)
+			}
+		case <-time.After(time.Second * 5):
+			t.Fatal("nothing published")
+		}
+	}
+
+	assertClosed := func(ctx context.Context, t *testing.T, c *websocket.Conn, expected websocket.StatusCode) {
+		_, _, err := c.Read(ctx)
+		if status := websocket.CloseStatus(err); status != expected {
+			t.Fatalf("wrong close status %d: %v", status, err)
+		}
+	}
+
+	t.Run("publish message", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		c := dial(ctx, t, "chat", subProtocol, token)
+		defer c.Close(websocket.StatusNormalClosure, "")
+
+		if err := c.Write(ctx, websocket.MessageText, []byte(testMessage)); err != nil {
+			t.Fatal(err)
+		}
+		assertPublished(t, "chat-in", testMessage)
+	})
+
+	t.Run("publish message envelope", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		c := dial(ctx, t, "cursors", envelopeSubProtocol, token)
+		defer c.Close(websocket.StatusNormalClosure, "")
+
+		if err := c.Write(ctx, websocket.MessageText, []byte(`{"payload":{"x":1,"y":2}}`)); err != nil {
+			t.Fatal(err)
+		}
+		assertPublished(t, "cursors", `{"x":1,"y":2}`)
+	})
+
+	t.Run("message too big", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		for _, protocol := range []string{subProtocol, envelopeSubProtocol} {
+			c := dial(ctx, t, "chat", protocol, token)
+			defer c.Close(websocket.StatusNormalClosure, "")
+
+			data := []byte("a message that is too big")
+			if protocol == envelopeSubProtocol {
+				data = []byte(`{"text":"a message that is too big"}`)
+			}
+
+			if err := c.Write(ctx, websocket.MessageText, data); err != nil {
+				t.Fatal(err)
+			}
+			assertClosed(ctx, t, c, websocket.StatusMessageTooBig)
+		}
+	})
+
+	t.Run("schema violation", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		c := dial(ctx, t, "cursors", subProtocol, token)
+		defer c.Close(websocket.StatusNormalClosure, "")
+
+		if err := c.Write(ctx, websocket.MessageText, []byte(`{"x":1}`)); err != nil {
+			t.Fatal(err)
+		}
+		assertClosed(ctx, t, c, websocket.StatusPolicyViolation)
+	})
+
+	t.Run("rate limited", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		c := dial(ctx, t, "limited", subProtocol, token)
+		defer c.Close(websocket.StatusNormalClosure, "")
+
+		for i := 0; i < 3; i++ {
+			if err := c.Write(ctx, websocket.MessageText, []byte(testMessage)); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		assertPublished(t, "limited", testMessage)
+		assertPublished(t, "limited", testMessage)
+		assertClosed(ctx, t, c, websocket.StatusTryAgainLater)
+	})
+
+	t.Run("not allowed to publish", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		c := dial(ctx, t, "chat", subProtocol, "invalid")
+		defer c.Close(websocket.StatusNormalClosure, "")
+
+		if err := c.Write(ctx, websocket.MessageText, []byte(testMessage)); err != nil {
+			t.Fatal(err)
+		}
+		assertClosed(ctx, t, c, websocket.StatusPolicyViolation)
+
+		select {
+		case m := <-published:
+			t.Fatalf("unexpected message published: %s", m.payload)
+		default:
+		}
+	})
+}
+
+type publishedMessage struct {
+	channel string
+	payload string
+}
+
+// publisher passes on the published messages
+type publisher chan publishedMessage
+
+func (p publisher) Publish(channel string, payload []byte) error {
+	p <- publishedMessage{channel, string(payload)}
+	return nil
+}
+
+// onDemand creates the channels with the prefix when they're subscribed to, unless it fails with the error
+type onDemand struct {
+	queue  *queue.Queue
+	prefix string
+	err    error
+}
+
+func (o onDemand) Matches(channel string) bool {
+	return strings.HasPrefix(channel, o.prefix)
+}
+
+func (o onDemand) Create(channel string) error {
+	if o.err != nil {
+		return o.err
+	}
+
+	o.queue.CreateChannel(channel)
+	return nil
+}
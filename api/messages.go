@@ -0,0 +1,129 @@
+package api
+
+import (
+	"encoding/json"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/mullvad/message-queue/api/handler"
+	"github.com/mullvad/message-queue/message"
+)
+
+const (
+	// defaultLimit is the number of messages returned by the messages endpoint if the client doesn't ask for a limit
+	defaultLimit = 100
+	// maxLimit is the maximum number of messages returned by the messages endpoint
+	maxLimit = 10000
+
+	ndjsonMediaType = "application/x-ndjson"
+)
+
+// handleMessages returns the messages kept in the history of a channel, as a JSON array of envelopes, or as
+// newline-delimited JSON if the client accepts it
+// The since query parameter is either a sequence number, returning the messages after it, or a RFC 3339 time,
+// returning the messages from that time on, and the latest messages are returned without it
+func (a *API) handleMessages(w http.ResponseWriter, r *http.Request) *handler.Error {
+	vars := mux.Vars(r)
+	channel := vars["channel"]
+
+	if !authorized(r, a.channelSettings(channel).Tokens) {
+		return unauthorizedError
+	}
+
+	history, err := a.Queue.History(channel)
+	if err != nil {
+		return handler.BadRequest("invalid channel")
+	}
+
+	limit := defaultLimit
+	if l := r.URL.Query().Get("limit"); l != "" {
+		limit, err = strconv.Atoi(l)
+		if err != nil || limit <= 0 || limit > maxLimit {
+			return handler.BadRequest("invalid limit")
+		}
+	}
+
+	var messages []*message.Message
+	since := r.URL.Query().Get("since")
+	if since == "" {
+		// Without since, return the latest messages, as the messages of a channel are numbered consecutively
+		var sequence uint64
+		if last := history.LastSequence(); last > uint64(limit) {
+			sequence = last - uint64(limit)
+		}
+		messages, err = history.Since(sequence, limit)
+	} else if sequence, parseErr := strconv.ParseUint(since, 10, 64); parseErr == nil {
+		messages, err = history.Since(sequence, limit)
+	} else if t, parseErr := time.Parse(time.RFC3339Nano, since); parseErr == nil {
+		messages, err = history.SinceTime(t, limit)
+	} else {
+		return handler.BadRequest("invalid since, expected a sequence number or time")
+	}
+
+	if err != nil {
+		log.Println("error reading history", err)
+		return handler.InternalServerError()
+	}
+
+	if acceptsNDJSON(r) || r.URL.Query().Get("format") == "ndjson" {
+		w.Header().Set("Content-Type", ndjsonMediaType)
+
+		// Encode writes every message on its own line
+		encoder := json.NewEncoder(w)
+		for _, m := range messages {
+			if err := encoder.Encode(m); err != nil {
+				log.Println("error sending messages", err)
+				return nil
+			}
+		}
+
+		return nil
+	}
+
+	// Return an empty array rather than null
+	if messages == nil {
+		messages = []*message.Message{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(messages); err != nil {
+		log.Println("error sending messages", err)
+	}
+
+	return nil
+}
+
+// acceptsNDJSON returns whether the Accept header asks for newline-delimited JSON at least as much as a JSON array
+func acceptsNDJSON(r *http.Request) bool {
+	var ndjson, array float64
+	for _, header := range r.Header["Accept"] {
+		for _, entry := range strings.Split(header, ",") {
+			mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(entry))
+			if err != nil {
+				continue
+			}
+
+			quality := 1.0
+			if q, ok := params["q"]; ok {
+				quality, err = strconv.ParseFloat(q, 64)
+				if err != nil {
+					continue
+				}
+			}
+
+			switch mediaType {
+			case ndjsonMediaType:
+				ndjson = quality
+			case "application/json":
+				array = quality
+			}
+		}
+	}
+
+	return ndjson > 0 && ndjson >= array
+}
@@ -0,0 +1,168 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"math"
+	"time"
+
+	"github.com/mullvad/message-queue/message"
+	"github.com/mullvad/message-queue/queue"
+	"github.com/mullvad/message-queue/schema"
+	"nhooyr.io/websocket"
+)
+
+// defaultMaxPublishSize is the maximum size of published payloads if the channel doesn't set one
+const defaultMaxPublishSize = 64 * 1024
+
+// Publisher publishes messages to the source of a channel
+type Publisher interface {
+	Publish(channel string, payload []byte) error
+}
+
+// PublishSettings let clients publish messages on their websocket connections
+// Clients using the raw subprotocol send the payloads as they are, while clients using envelopes send envelopes, of
+// which only the payload is published
+type PublishSettings struct {
+	Channel string         // The redis channel published to
+	Tokens  []string       // Clients must present one of the tokens to publish
+	MaxSize int            // The maximum payload size in bytes, defaultMaxPublishSize if not set
+	Schema  *schema.Schema // The JSON schema the payloads must match, if set
+	// The number of messages per second each connection may publish, and how many it may publish at once, unlimited if
+	// the rate isn't set
+	Rate  float64
+	Burst int
+}
+
+// readPublished reads the messages published by the client, and any acknowledgements if acks is set, and cancels the
+// context when the connection is closed
+// Clients breaking the limits of the channel are disconnected
+func (a *API) readPublished(ctx context.Context, cancel context.CancelFunc, c *websocket.Conn, settings *PublishSettings, envelope bool, acks chan<- queue.Ack) {
+	defer cancel()
+
+	maxSize := settings.MaxSize
+	if maxSize <= 0 {
+		maxSize = defaultMaxPublishSize
+	}
+
+	// Envelopes are larger than their payloads, so their size is checked once they've been decoded
+	if envelope {
+		c.SetReadLimit(int64(maxSize)*2 + 1024)
+	} else {
+		c.SetReadLimit(int64(maxSize))
+	}
+
+	limiter := newLimiter(settings.Rate, settings.Burst)
+
+	for {
+		_, data, err := c.Read(ctx)
+		if err != nil {
+			return
+		}
+
+		payload := data
+		if envelope {
+			if acks != nil {
+				var msg ack
+				if err := json.Unmarshal(data, &msg); err == nil && msg.Ack != 0 {
+					select {
+					case acks <- queue.Ack{Sequence: msg.Ack, Cumulative: msg.Cumulative}:
+					case <-ctx.Done():
+						return
+					}
+					continue
+				}
+			}
+
+			var m message.Message
+			if err := json.Unmarshal(data, &m); err != nil || m.Gap {
+				c.Close(websocket.StatusPolicyViolation, "invalid message envelope")
+				return
+			}
+			payload = m.Payload
+
+			if len(payload) > maxSize {
+				c.Close(websocket.StatusMessageTooBig, "message too big")
+				return
+			}
+		}
+
+		if settings.Schema != nil {
+			if err := settings.Schema.ValidateJSON(payload); err != nil {
+				c.Close(websocket.StatusPolicyViolation, truncate(err.Error()))
+				return
+			}
+		}
+
+		if !limiter.allow(time.Now()) {
+			c.Close(websocket.StatusTryAgainLater, "publishing too fast")
+			return
+		}
+
+		if a.Publisher == nil {
+			c.Close(websocket.StatusInternalError, "publishing isn't available")
+			return
+		}
+
+		if err := a.Publisher.Publish(settings.Channel, payload); err != nil {
+			log.Printf("error publishing message to %q: %s", settings.Channel, err)
+			c.Close(websocket.StatusInternalError, "error publishing message")
+			return
+		}
+	}
+}
+
+// truncate shortens a close reason to what fits in a close frame
+func truncate(reason string) string {
+	const max = 123
+	if len(reason) > max {
+		return reason[:max]
+	}
+	return reason
+}
+
+// limiter is a token bucket, allowing a number of events per second on average and bursts of a number of events
+type limiter struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// newLimiter returns a limiter, or nil, which allows every event, if the rate isn't set
+// The burst is the rate rounded up, and at least 1, if not set
+func newLimiter(rate float64, burst int) *limiter {
+	if rate <= 0 {
+		return nil
+	}
+
+	if burst <= 0 {
+		burst = int(math.Max(1, math.Ceil(rate)))
+	}
+
+	return &limiter{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+	}
+}
+
+// allow returns whether an event may happen at the given time, and takes a token for it if so
+func (l *limiter) allow(now time.Time) bool {
+	if l == nil {
+		return true
+	}
+
+	if !l.last.IsZero() {
+		l.tokens = math.Min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	}
+	l.last = now
+
+	if l.tokens < 1 {
+		return false
+	}
+
+	l.tokens--
+	return true
+}
@@ -0,0 +1,244 @@
+package bench
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"nhooyr.io/websocket"
+)
+
+// Options configure a benchmark
+type Options struct {
+	Subscribers int           // The number of websocket subscribers, spread evenly across the channels
+	Channels    int           // The number of channels, named after the prefix and their index
+	Prefix      string        // The prefix of the channel names, "bench-" if not set
+	Rate        float64       // The number of messages published per second, across all channels
+	Duration    time.Duration // How long messages are published for
+	Size        int           // The size of the payloads in bytes, padded to it if larger than the timestamps
+	Drain       time.Duration // How long to wait for the last messages to be delivered, 5 seconds if not set
+	BufferSize  int           // The buffer size of the subscribers when benchmarking in-process, 100 if not set
+}
+
+// Publisher publishes a payload to a channel
+type Publisher func(channel string, payload []byte) error
+
+// Report is the outcome of a benchmark
+type Report struct {
+	Published   int // The number of messages published
+	Expected    int // The number of messages the subscribers should have received
+	Received    int
+	Dropped     int            // The number of messages the subscribers didn't receive
+	Errors      int            // The number of messages that failed to be published
+	Latencies   Latencies      // The delivery latency, from publishing to receiving
+	Disconnects map[string]int // The number of subscribers disconnected before the end, by reason
+}
+
+// Latencies are the percentiles of the delivery latency
+type Latencies struct {
+	P50, P90, P99, Max time.Duration
+}
+
+// payload is the JSON payload of the published messages, with the time they were published for measuring latency
+type payload struct {
+	Sent    int64  `json:"sent"` // Unix time in nanoseconds
+	Padding string `json:"padding,omitempty"`
+}
+
+// Run benchmarks a server, such as "ws://localhost:8080", by subscribing to its channels and publishing to them
+// The server and publisher must be on the same host, or have synchronized clocks, for the latencies to be meaningful
+func Run(ctx context.Context, server string, httpClient *http.Client, publish Publisher, o Options) (*Report, error) {
+	if o.Subscribers <= 0 || o.Channels <= 0 || o.Rate <= 0 {
+		return nil, fmt.Errorf("the number of subscribers and channels, and the rate, must be positive")
+	}
+	if o.Prefix == "" {
+		o.Prefix = "bench-"
+	}
+	if o.Drain <= 0 {
+		o.Drain = time.Second * 5
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// Every subscriber is connected before anything is published, for them all to expect the same messages
+	subscribers := make([]*subscriber, 0, o.Subscribers)
+	subscribed := make([]int, o.Channels)
+	for i := 0; i < o.Subscribers; i++ {
+		channel := i % o.Channels
+		s, err := subscribe(ctx, server, httpClient, o.Prefix+fmt.Sprint(channel))
+		if err != nil {
+			for _, s := range subscribers {
+				s.conn.Close(websocket.StatusNormalClosure, "")
+			}
+			return nil, fmt.Errorf("subscriber %d: %w", i, err)
+		}
+		subscribers = append(subscribers, s)
+		subscribed[channel]++
+	}
+
+	var wg sync.WaitGroup
+	for _, s := range subscribers {
+		wg.Add(1)
+		go func(s *subscriber) {
+			defer wg.Done()
+			s.receive(ctx)
+		}(s)
+	}
+
+	report := &Report{Disconnects: make(map[string]int)}
+
+	padding := ""
+	if size := o.Size - len(`{"sent":0000000000000000000,"padding":""}`); size > 0 {
+		padding = strings.Repeat("x", size)
+	}
+
+	// Publish at the rate, spreading the messages across the channels
+	interval := time.Duration(float64(time.Second) / o.Rate)
+	start := time.Now()
+	for i := 0; time.Since(start) < o.Duration; i++ {
+		if wait := time.Until(start.Add(interval * time.Duration(i))); wait > 0 {
+			select {
+			case <-time.After(wait):
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+
+		channel := i % o.Channels
+		data, err := json.Marshal(payload{Sent: time.Now().UnixNano(), Padding: padding})
+		if err != nil {
+			return nil, err
+		}
+
+		if err := publish(o.Prefix+fmt.Sprint(channel), data); err != nil {
+			report.Errors++
+			continue
+		}
+		report.Published++
+		report.Expected += subscribed[channel]
+	}
+
+	// Wait for the last messages to arrive, or for the subscribers to be disconnected
+	deadline := time.Now().Add(o.Drain)
+	for time.Now().Before(deadline) && received(subscribers) < report.Expected {
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	cancel()
+	wg.Wait()
+
+	var latencies []time.Duration
+	for _, s := range subscribers {
+		report.Received += s.received
+		latencies = append(latencies, s.latencies...)
+		if s.disconnect != "" {
+			report.Disconnects[s.disconnect]++
+		}
+	}
+
+	if report.Dropped = report.Expected - report.Received; report.Dropped < 0 {
+		report.Dropped = 0
+	}
+	report.Latencies = percentiles(latencies)
+
+	return report, nil
+}
+
+// subscriber is a websocket subscriber of a channel, keeping track of what it receives
+type subscriber struct {
+	conn *websocket.Conn
+
+	mutex      sync.Mutex
+	received   int
+	latencies  []time.Duration
+	disconnect string // Why the subscriber was disconnected, if it was before the end
+}
+
+func subscribe(ctx context.Context, server string, httpClient *http.Client, channel string) (*subscriber, error) {
+	conn, _, err := websocket.Dial(ctx, strings.TrimSuffix(server, "/")+"/channel/"+url.PathEscape(channel), &websocket.DialOptions{
+		HTTPClient:   httpClient,
+		Subprotocols: []string{"message-queue-v1"},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &subscriber{conn: conn}, nil
+}
+
+// receive reads messages until the context has ended or the connection is closed
+func (s *subscriber) receive(ctx context.Context) {
+	defer s.conn.Close(websocket.StatusNormalClosure, "")
+
+	for {
+		_, data, err := s.conn.Read(ctx)
+		if err != nil {
+			if ctx.Err() == nil {
+				s.mutex.Lock()
+				s.disconnect = reason(err)
+				s.mutex.Unlock()
+			}
+			return
+		}
+
+		var p payload
+		if err := json.Unmarshal(data, &p); err != nil {
+			continue
+		}
+
+		s.mutex.Lock()
+		s.received++
+		s.latencies = append(s.latencies, time.Since(time.Unix(0, p.Sent)))
+		s.mutex.Unlock()
+	}
+}
+
+// reason describes why a connection was closed
+func reason(err error) string {
+	var closeErr websocket.CloseError
+	if errors.As(err, &closeErr) {
+		return fmt.Sprintf("%d %s", closeErr.Code, closeErr.Reason)
+	}
+	return err.Error()
+}
+
+// received returns the number of messages received by all subscribers so far
+func received(subscribers []*subscriber) int {
+	total := 0
+	for _, s := range subscribers {
+		s.mutex.Lock()
+		total += s.received
+		s.mutex.Unlock()
+	}
+	return total
+}
+
+// percentiles returns the percentiles of the latencies
+func percentiles(latencies []time.Duration) Latencies {
+	if len(latencies) == 0 {
+		return Latencies{}
+	}
+
+	sort.Slice(latencies, func(i, j int) bool {
+		return latencies[i] < latencies[j]
+	})
+
+	at := func(p float64) time.Duration {
+		return latencies[int(p*float64(len(latencies)-1))]
+	}
+
+	return Latencies{
+		P50: at(0.5),
+		P90: at(0.9),
+		P99: at(0.99),
+		Max: latencies[len(latencies)-1],
+	}
+}
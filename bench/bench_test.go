@@ -0,0 +1,57 @@
+package bench_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/mullvad/message-queue/bench"
+)
+
+func TestInProcess(t *testing.T) {
+	report, err := bench.InProcess(context.Background(), bench.Options{
+		Subscribers: 10,
+		Channels:    3,
+		Rate:        500,
+		Duration:    time.Millisecond * 200,
+		Size:        256,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if report.Published == 0 || report.Errors != 0 {
+		t.Fatalf("wrong number of messages published: %+v", report)
+	}
+
+	if report.Received != report.Expected || report.Dropped != 0 || len(report.Disconnects) != 0 {
+		t.Fatalf("messages dropped: %+v", report)
+	}
+
+	if report.Latencies.P50 <= 0 || report.Latencies.P50 > report.Latencies.Max {
+		t.Fatalf("wrong latencies: %+v", report.Latencies)
+	}
+}
+
+func TestEscapeChannels(t *testing.T) {
+	report, err := bench.InProcess(context.Background(), bench.Options{
+		Subscribers: 2,
+		Channels:    2,
+		Rate:        100,
+		Duration:    time.Millisecond * 50,
+		Prefix:      "bench?#",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if report.Received == 0 || report.Received != report.Expected {
+		t.Fatalf("messages dropped: %+v", report)
+	}
+}
+
+func TestInvalidOptions(t *testing.T) {
+	if _, err := bench.InProcess(context.Background(), bench.Options{Channels: 1, Rate: 1}); err == nil {
+		t.Fatal("no error")
+	}
+}
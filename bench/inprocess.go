@@ -0,0 +1,118 @@
+package bench
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/mullvad/message-queue/api"
+	"github.com/mullvad/message-queue/message"
+	"github.com/mullvad/message-queue/queue"
+)
+
+// InProcess benchmarks a queue and its API within the process, connecting the subscribers through in-memory pipes
+// rather than the network, and publishing straight to the queue
+func InProcess(ctx context.Context, o Options) (*Report, error) {
+	if o.Prefix == "" {
+		o.Prefix = "bench-"
+	}
+	if o.BufferSize <= 0 {
+		o.BufferSize = 100
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	q := queue.New(ctx, o.BufferSize)
+
+	inputs := make(map[string]chan<- *message.Message)
+	for i := 0; i < o.Channels; i++ {
+		channel := o.Prefix + fmt.Sprint(i)
+
+		in, err := q.CreateChannel(channel)
+		if err != nil {
+			return nil, err
+		}
+		inputs[channel] = in
+	}
+
+	listener := newPipeListener()
+	server := &http.Server{Handler: api.New(q).Router()}
+	go server.Serve(listener)
+	defer server.Close()
+
+	httpClient := &http.Client{
+		Transport: &http.Transport{
+			DialContext: listener.dial,
+		},
+	}
+
+	publish := func(channel string, payload []byte) error {
+		select {
+		case inputs[channel] <- message.New(channel, payload):
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	return Run(ctx, "ws://in-process", httpClient, publish, o)
+}
+
+// pipeListener is a listener for connections dialed within the process
+type pipeListener struct {
+	conns     chan net.Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+var errListenerClosed = errors.New("listener closed")
+
+func newPipeListener() *pipeListener {
+	return &pipeListener{
+		conns:  make(chan net.Conn),
+		closed: make(chan struct{}),
+	}
+}
+
+// dial connects to the listener, ignoring the address
+func (l *pipeListener) dial(ctx context.Context, network, address string) (net.Conn, error) {
+	server, client := net.Pipe()
+
+	select {
+	case l.conns <- server:
+		return client, nil
+	case <-l.closed:
+		return nil, errListenerClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (l *pipeListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, errListenerClosed
+	}
+}
+
+func (l *pipeListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.closed)
+	})
+	return nil
+}
+
+func (l *pipeListener) Addr() net.Addr {
+	return pipeAddr{}
+}
+
+type pipeAddr struct{}
+
+func (pipeAddr) Network() string { return "pipe" }
+func (pipeAddr) String() string  { return "in-process" }
@@ -0,0 +1,291 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mullvad/message-queue/message"
+	"nhooyr.io/websocket"
+)
+
+// subProtocol is the subprotocol spoken with the server, using envelopes for the sequence numbers to resume from
+const subProtocol = "message-queue-envelope-v1"
+
+// StatusError is returned when the server refuses the connection with a HTTP status code
+type StatusError struct {
+	Code int
+	Err  error
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("server responded with %d %s: %s", e.Code, http.StatusText(e.Code), e.Err)
+}
+
+func (e *StatusError) Unwrap() error {
+	return e.Err
+}
+
+// permanent returns whether the server refused the connection for a reason that reconnecting won't change, such as
+// a missing token or an invalid filter
+func permanent(err error) bool {
+	var statusErr *StatusError
+	if !errors.As(err, &statusErr) {
+		return false
+	}
+
+	switch statusErr.Code {
+	case http.StatusBadRequest, http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound:
+		return true
+	default:
+		return false
+	}
+}
+
+// Subscribe connects to the channel on the server, such as "wss://example.com", and returns a channel for receiving
+// its messages until the context has ended
+// The client reconnects whenever the connection is lost, resuming from the last message received, and the channel is
+// only closed early if the server refuses to let it reconnect
+// Messages may have been lost when a message with Gap set is received, or when the channel has no history to resume
+// from and the client has no session
+func Subscribe(ctx context.Context, server string, channel string, opts ...Option) (<-chan *message.Message, error) {
+	s, err := newSubscriber(server, channel, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := s.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make(chan *message.Message, s.options.bufferSize)
+	go func() {
+		defer close(out)
+
+		s.run(ctx, conn, func(m *message.Message) bool {
+			select {
+			case out <- m:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		})
+	}()
+
+	return out, nil
+}
+
+// Handle connects to the channel on the server and calls the handler with every message until the context has ended,
+// reconnecting like Subscribe
+// It returns an error if the server refuses the connection, and nil once the context has ended
+func Handle(ctx context.Context, server string, channel string, handler func(*message.Message), opts ...Option) error {
+	s, err := newSubscriber(server, channel, opts)
+	if err != nil {
+		return err
+	}
+
+	conn, err := s.dial(ctx)
+	if err != nil {
+		return err
+	}
+
+	return s.run(ctx, conn, func(m *message.Message) bool {
+		handler(m)
+		return true
+	})
+}
+
+type subscriber struct {
+	url     *url.URL
+	options options
+	since   *uint64 // The sequence number of the last message received, if any
+}
+
+func newSubscriber(server string, channel string, opts []Option) (*subscriber, error) {
+	u, err := url.Parse(server)
+	if err != nil {
+		return nil, err
+	}
+
+	switch u.Scheme {
+	case "ws", "http":
+		u.Scheme = "ws"
+	case "wss", "https":
+		u.Scheme = "wss"
+	default:
+		return nil, fmt.Errorf("unexpected url scheme %q", u.Scheme)
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/channel/" + url.PathEscape(channel)
+
+	o := defaultOptions()
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	return &subscriber{
+		url:     u,
+		options: o,
+		since:   o.since,
+	}, nil
+}
+
+// dial connects to the server, resuming from the last message received
+func (s *subscriber) dial(ctx context.Context) (*websocket.Conn, error) {
+	query := url.Values{}
+	if s.options.filter != "" {
+		query.Set("filter", s.options.filter)
+	}
+	if s.options.session != "" {
+		query.Set("session", s.options.session)
+	}
+	if s.since != nil {
+		query.Set("since", strconv.FormatUint(*s.since, 10))
+	}
+
+	u := *s.url
+	u.RawQuery = query.Encode()
+
+	header := http.Header{}
+	if s.options.token != "" {
+		header.Set("Authorization", "Bearer "+s.options.token)
+	}
+
+	dialCtx, cancel := context.WithTimeout(ctx, s.options.timeout)
+	defer cancel()
+
+	conn, resp, err := websocket.Dial(dialCtx, u.String(), &websocket.DialOptions{
+		HTTPClient:   s.options.httpClient,
+		HTTPHeader:   header,
+		Subprotocols: []string{subProtocol},
+	})
+	if err != nil {
+		if resp != nil && resp.StatusCode != http.StatusSwitchingProtocols {
+			return nil, &StatusError{Code: resp.StatusCode, Err: err}
+		}
+		return nil, err
+	}
+
+	conn.SetReadLimit(s.options.readLimit)
+	return conn, nil
+}
+
+// run receives the messages from the connection, and reconnects whenever it's lost, until the context has ended or the
+// server refuses the connection
+func (s *subscriber) run(ctx context.Context, conn *websocket.Conn, deliver func(*message.Message) bool) error {
+	for {
+		err := s.receive(ctx, conn, deliver)
+		if ctx.Err() != nil {
+			return nil
+		}
+		s.disconnected(err)
+
+		for attempt := 0; ; attempt++ {
+			select {
+			case <-time.After(s.backoff(attempt)):
+			case <-ctx.Done():
+				return nil
+			}
+
+			conn, err = s.dial(ctx)
+			if err == nil {
+				break
+			}
+			if ctx.Err() != nil {
+				return nil
+			}
+
+			s.disconnected(err)
+			if permanent(err) {
+				return err
+			}
+		}
+	}
+}
+
+// receive passes on the messages from the connection until it's lost, and returns why
+func (s *subscriber) receive(ctx context.Context, conn *websocket.Conn, deliver func(*message.Message) bool) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	defer conn.Close(websocket.StatusNormalClosure, "")
+
+	pingFailed := make(chan error, 1)
+	go func() {
+		ticker := time.NewTicker(s.options.pingInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				pingCtx, pingCancel := context.WithTimeout(ctx, s.options.timeout)
+				err := conn.Ping(pingCtx)
+				pingCancel()
+
+				if err != nil && ctx.Err() == nil {
+					pingFailed <- err
+					cancel()
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	for {
+		_, data, err := conn.Read(ctx)
+		if err != nil {
+			select {
+			case pingErr := <-pingFailed:
+				return fmt.Errorf("ping failed: %w", pingErr)
+			default:
+				return err
+			}
+		}
+
+		m := &message.Message{}
+		if err := json.Unmarshal(data, m); err != nil {
+			return fmt.Errorf("invalid message envelope: %w", err)
+		}
+
+		if !deliver(m) {
+			return ctx.Err()
+		}
+
+		// Gaps aren't numbered
+		if m.Sequence > 0 {
+			sequence := m.Sequence
+			s.since = &sequence
+		}
+	}
+}
+
+func (s *subscriber) disconnected(err error) {
+	if s.options.disconnected != nil {
+		s.options.disconnected(err)
+	}
+}
+
+// backoff returns how long to wait before the attempt to reconnect, doubling for every attempt up to the maximum, and
+// picked at random from the upper half to spread out the clients reconnecting at the same time
+func (s *subscriber) backoff(attempt int) time.Duration {
+	d := s.options.minBackoff
+	for i := 0; i < attempt && d < s.options.maxBackoff; i++ {
+		d *= 2
+	}
+	if d > s.options.maxBackoff {
+		d = s.options.maxBackoff
+	}
+
+	if d <= 1 {
+		return d
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)))
+}
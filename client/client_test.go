@@ -0,0 +1,216 @@
+package client_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mullvad/message-queue/api"
+	"github.com/mullvad/message-queue/client"
+	"github.com/mullvad/message-queue/message"
+	"github.com/mullvad/message-queue/queue"
+)
+
+const (
+	channel        = "test"
+	privateChannel = "private"
+	token          = "secret"
+)
+
+func TestClient(t *testing.T) {
+	queueCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	q := queue.New(queueCtx, 100)
+
+	ch, err := q.CreateChannel(channel, queue.WithHistory(queue.NewMemoryHistory(100)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	private, err := q.CreateChannel(privateChannel)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := api.New(q)
+	a.SetChannels(map[string]api.ChannelSettings{
+		privateChannel: {Tokens: []string{token}},
+	})
+
+	server := httptest.NewServer(a.Router())
+	defer server.Close()
+
+	t.Run("receive and resume", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		conns := &connections{}
+
+		// Publish a message while the client is disconnected, which it should get from the history once it has resumed
+		var once sync.Once
+		received, err := client.Subscribe(ctx, server.URL, channel,
+			client.WithHTTPClient(conns.client()),
+			client.WithBackoff(time.Millisecond*10, time.Millisecond*50),
+			client.WithDisconnectHandler(func(err error) {
+				once.Do(func() {
+					ch <- message.New(channel, []byte(`{"n":2}`))
+				})
+			}),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ch <- message.New(channel, []byte(`{"n":1}`))
+		assertMessage(t, received, `{"n":1}`)
+
+		conns.closeAll()
+		assertMessage(t, received, `{"n":2}`)
+
+		ch <- message.New(channel, []byte(`{"n":3}`))
+		assertMessage(t, received, `{"n":3}`)
+
+		// The channel is closed once the context has ended
+		cancel()
+		for range received {
+		}
+	})
+
+	t.Run("resume from sequence", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		received, err := client.Subscribe(ctx, server.URL, channel, client.WithResume(1))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assertMessage(t, received, `{"n":2}`)
+		assertMessage(t, received, `{"n":3}`)
+	})
+
+	t.Run("receive gap", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		received, err := client.Subscribe(ctx, server.URL, channel, client.WithFilter("n==4"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ch <- message.NewGap(channel)
+
+		select {
+		case m := <-received:
+			if !m.Gap {
+				t.Fatalf("not a gap: %s", m.Payload)
+			}
+		case <-time.After(time.Second * 5):
+			t.Fatal("no gap")
+		}
+	})
+
+	t.Run("handle messages with token", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		handled := make(chan *message.Message)
+		done := make(chan error)
+		go func() {
+			done <- client.Handle(ctx, server.URL, privateChannel, func(m *message.Message) {
+				handled <- m
+			}, client.WithToken(token))
+		}()
+
+		// Wait for the subscription before publishing
+		for q.ChannelSubscriberCount(privateChannel) == 0 {
+			time.Sleep(time.Millisecond)
+		}
+
+		private <- message.New(privateChannel, []byte("private"))
+
+		select {
+		case m := <-handled:
+			if string(m.Payload) != "private" {
+				t.Fatalf("wrong message: %s", m.Payload)
+			}
+		case <-time.After(time.Second * 5):
+			t.Fatal("no message")
+		}
+
+		cancel()
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("unauthorized", func(t *testing.T) {
+		_, err := client.Subscribe(context.Background(), server.URL, privateChannel, client.WithToken("invalid"))
+
+		var statusErr *client.StatusError
+		if !errors.As(err, &statusErr) || statusErr.Code != http.StatusUnauthorized {
+			t.Fatalf("wrong error: %v", err)
+		}
+	})
+
+	t.Run("invalid url", func(t *testing.T) {
+		if _, err := client.Subscribe(context.Background(), "ftp://localhost", channel); err == nil {
+			t.Fatal("no error")
+		}
+	})
+}
+
+func assertMessage(t *testing.T, ch <-chan *message.Message, payload string) {
+	t.Helper()
+
+	select {
+	case m, open := <-ch:
+		if !open {
+			t.Fatal("channel closed")
+		}
+		if string(m.Payload) != payload {
+			t.Fatalf("wrong message: %s", m.Payload)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatalf("no message %s", payload)
+	}
+}
+
+// connections keeps track of the connections of a HTTP client, for breaking them
+type connections struct {
+	mutex sync.Mutex
+	conns []net.Conn
+}
+
+func (c *connections) client() *http.Client {
+	var dialer net.Dialer
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+				conn, err := dialer.DialContext(ctx, network, address)
+				if err == nil {
+					c.mutex.Lock()
+					c.conns = append(c.conns, conn)
+					c.mutex.Unlock()
+				}
+				return conn, err
+			},
+		},
+	}
+}
+
+func (c *connections) closeAll() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for _, conn := range c.conns {
+		conn.Close()
+	}
+	c.conns = nil
+}
@@ -0,0 +1,113 @@
+package client
+
+import (
+	"net/http"
+	"time"
+)
+
+// Option configures how the client connects to the server
+type Option func(o *options)
+
+type options struct {
+	httpClient   *http.Client
+	token        string  // Presented as a bearer token, if set
+	filter       string  // The filter expression of the subscription, if set
+	session      string  // The session of the client, if set
+	since        *uint64 // The sequence number to resume from on the first connection, if set
+	minBackoff   time.Duration
+	maxBackoff   time.Duration
+	pingInterval time.Duration
+	timeout      time.Duration // How long connecting and pings may take
+	bufferSize   int
+	readLimit    int64
+	disconnected func(error) // Called whenever the connection is lost or reconnecting fails
+}
+
+func defaultOptions() options {
+	return options{
+		httpClient:   http.DefaultClient,
+		minBackoff:   time.Millisecond * 100,
+		maxBackoff:   time.Second * 30,
+		pingInterval: time.Second * 25,
+		timeout:      time.Second * 15,
+		bufferSize:   100,
+		readLimit:    16 * 1024 * 1024,
+	}
+}
+
+// WithHTTPClient connects using the given HTTP client, such as one with a custom TLS configuration
+func WithHTTPClient(client *http.Client) Option {
+	return func(o *options) {
+		o.httpClient = client
+	}
+}
+
+// WithToken presents the token to the server, for channels requiring authorization
+func WithToken(token string) Option {
+	return func(o *options) {
+		o.token = token
+	}
+}
+
+// WithFilter only receives the messages with a JSON payload matching the filter expression, such as
+// "account.id=='1234'"
+func WithFilter(expression string) Option {
+	return func(o *options) {
+		o.filter = expression
+	}
+}
+
+// WithSession resumes the session with the given ID, which should be a stable ID of the client, for the server to keep
+// the messages published while the client is disconnected
+func WithSession(id string) Option {
+	return func(o *options) {
+		o.session = id
+	}
+}
+
+// WithResume gets the messages after the given sequence number from the history of the channel first, such as the
+// last message received by a previous run
+func WithResume(sequence uint64) Option {
+	return func(o *options) {
+		o.since = &sequence
+	}
+}
+
+// WithBackoff waits between min and max, growing exponentially with jitter, between attempts to reconnect
+func WithBackoff(min, max time.Duration) Option {
+	return func(o *options) {
+		o.minBackoff = min
+		o.maxBackoff = max
+	}
+}
+
+// WithPing pings the server at the interval, and reconnects if it doesn't answer within the timeout, which also limits
+// how long connecting may take
+func WithPing(interval, timeout time.Duration) Option {
+	return func(o *options) {
+		o.pingInterval = interval
+		o.timeout = timeout
+	}
+}
+
+// WithBufferSize sets how many messages are buffered for the receiver before reading from the server is held up
+func WithBufferSize(size int) Option {
+	return func(o *options) {
+		o.bufferSize = size
+	}
+}
+
+// WithReadLimit sets the maximum size of the messages, including their envelopes, 16 MiB by default
+func WithReadLimit(bytes int64) Option {
+	return func(o *options) {
+		o.readLimit = bytes
+	}
+}
+
+// WithDisconnectHandler calls the handler with the error whenever the connection is lost, and whenever reconnecting
+// fails
+func WithDisconnectHandler(handler func(error)) Option {
+	return func(o *options) {
+		o.disconnected = handler
+	}
+}
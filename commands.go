@@ -0,0 +1,420 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/mediocregopher/radix/v3"
+	"github.com/mullvad/message-queue/bench"
+	"github.com/mullvad/message-queue/client"
+	"github.com/mullvad/message-queue/message"
+	"github.com/mullvad/message-queue/record"
+	"nhooyr.io/websocket"
+)
+
+// commands are the subcommands for inspecting, feeding and benchmarking servers, by their names
+var commands = map[string]func(args []string) error{
+	"tail":    tail,
+	"publish": publish,
+	"stats":   printStats,
+	"bench":   runBench,
+	"record":  recordChannels,
+}
+
+// tail prints the messages of a channel as they arrive
+func tail(args []string) error {
+	flags := flag.NewFlagSet("tail", flag.ExitOnError)
+	flags.Usage = usage(flags, "tail [options] <channel>", "print the messages of a channel as they arrive, reconnecting whenever the connection is lost")
+	server := flags.String("server", "ws://localhost:8080", "the server to connect to")
+	token := flags.String("token", "", "the token presented to the server, for channels requiring authorization")
+	filter := flags.String("filter", "", "only print the messages with a JSON payload matching the filter expression, e.g. \"account.id=='1234'\"")
+	since := flags.String("since", "", "print the messages after the sequence number from the history of the channel first")
+	pretty := flags.Bool("pretty", false, "pretty-print JSON")
+	envelope := flags.Bool("envelope", false, "print the message envelopes, with the metadata of the messages, rather than their payloads")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	channel := flags.Arg(0)
+
+	options := []client.Option{
+		client.WithDisconnectHandler(func(err error) {
+			fmt.Fprintf(os.Stderr, "disconnected: %s\n", err)
+		}),
+	}
+	if *token != "" {
+		options = append(options, client.WithToken(*token))
+	}
+	if *filter != "" {
+		options = append(options, client.WithFilter(*filter))
+	}
+	if *since != "" {
+		sequence, err := strconv.ParseUint(*since, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid sequence number %q", *since)
+		}
+		options = append(options, client.WithResume(sequence))
+	}
+
+	ctx, cancel := interruptible()
+	defer cancel()
+
+	return client.Handle(ctx, *server, channel, func(m *message.Message) {
+		if m.Gap && !*envelope {
+			fmt.Fprintln(os.Stderr, "messages may have been lost")
+			return
+		}
+
+		if err := printMessage(os.Stdout, m, *envelope, *pretty); err != nil {
+			fmt.Fprintf(os.Stderr, "error printing message %d: %s\n", m.Sequence, err)
+		}
+	}, options...)
+}
+
+// printMessage prints the payload of the message, or its envelope, on a line of its own
+func printMessage(w io.Writer, m *message.Message, envelope bool, pretty bool) error {
+	data := m.Payload
+	if envelope {
+		var err error
+		if data, err = json.Marshal(m); err != nil {
+			return err
+		}
+	}
+
+	if pretty && json.Valid(data) {
+		var indented bytes.Buffer
+		if err := json.Indent(&indented, data, "", "  "); err != nil {
+			return err
+		}
+		data = indented.Bytes()
+	}
+
+	_, err := fmt.Fprintf(w, "%s\n", data)
+	return err
+}
+
+// recordChannels records the messages of channels to a file as they arrive, for replaying them later on
+func recordChannels(args []string) error {
+	flags := flag.NewFlagSet("record", flag.ExitOnError)
+	flags.Usage = usage(flags, "record [options] <channel>...", "record the messages of channels to a file as they arrive, for replaying them with '-replay-file'")
+	server := flags.String("server", "ws://localhost:8080", "the server to connect to")
+	token := flags.String("token", "", "the token presented to the server, for channels requiring authorization")
+	output := flags.String("output", "-", "the file to record to, or - for stdout")
+	formatName := flags.String("format", "ndjson", "the format of the recording, either 'ndjson' or 'binary'")
+	duration := flags.Duration("duration", 0, "how long to record for, or 0 to record until interrupted")
+	flags.Parse(args)
+
+	if flags.NArg() == 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	format, err := record.ParseFormat(*formatName)
+	if err != nil {
+		return err
+	}
+
+	out := os.Stdout
+	if *output != "-" {
+		if out, err = os.Create(*output); err != nil {
+			return err
+		}
+		defer out.Close()
+	}
+	w := record.NewWriter(out, format)
+
+	options := []client.Option{
+		client.WithDisconnectHandler(func(err error) {
+			fmt.Fprintf(os.Stderr, "disconnected: %s\n", err)
+		}),
+	}
+	if *token != "" {
+		options = append(options, client.WithToken(*token))
+	}
+
+	ctx, cancel := interruptible()
+	defer cancel()
+	if *duration > 0 {
+		ctx, cancel = context.WithTimeout(ctx, *duration)
+		defer cancel()
+	}
+
+	// Stop recording every channel as soon as one of them fails
+	errs := make(chan error, flags.NArg())
+	for _, channel := range flags.Args() {
+		go func(channel string) {
+			err := client.Handle(ctx, *server, channel, func(m *message.Message) {
+				if err := w.Write(record.Entry{Time: time.Now(), Message: m}); err != nil {
+					fmt.Fprintf(os.Stderr, "error recording message %d of %s: %s\n", m.Sequence, channel, err)
+				}
+			}, options...)
+			if err != nil {
+				err = fmt.Errorf("%s: %w", channel, err)
+				cancel()
+			}
+			errs <- err
+		}(channel)
+	}
+
+	var first error
+	for range flags.Args() {
+		if err := <-errs; err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// publish publishes a message, or every line read from stdin, to a redis channel directly or through a server
+func publish(args []string) error {
+	flags := flag.NewFlagSet("publish", flag.ExitOnError)
+	flags.Usage = usage(flags, "publish [options] <channel> [message]", "publish the message, or every line read from stdin, to a redis channel, or to a channel of a server allowing clients to publish")
+	server := flags.String("server", "", "the server to publish through, e.g. ws://localhost:8080, rather than redis")
+	token := flags.String("token", "", "the token presented to the server, which must allow publishing on the channel")
+	redisAddress := flags.String("redis-address", "127.0.0.1:6379", "the redis server to publish to")
+	redisUsername := flags.String("redis-username", "", "redis 6 ACL username, the default user if not set")
+	redisPassword := flags.String("redis-password", "", "redis password")
+	flags.Parse(args)
+
+	if flags.NArg() < 1 || flags.NArg() > 2 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	channel := flags.Arg(0)
+
+	var send func(payload []byte) error
+	if *server != "" {
+		ctx, cancel := interruptible()
+		defer cancel()
+
+		c, err := dialChannel(ctx, *server, channel, *token)
+		if err != nil {
+			return err
+		}
+		defer c.Close(websocket.StatusNormalClosure, "")
+
+		// Read to notice the server closing the connection, such as for breaking the limits of the channel
+		ctx = c.CloseRead(ctx)
+
+		send = func(payload []byte) error {
+			return c.Write(ctx, websocket.MessageText, payload)
+		}
+	} else {
+		conn, err := dialRedis(*redisAddress, *redisUsername, *redisPassword)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+
+		send = func(payload []byte) error {
+			return conn.Do(radix.FlatCmd(nil, "PUBLISH", channel, payload))
+		}
+	}
+
+	if flags.NArg() == 2 {
+		return send([]byte(flags.Arg(1)))
+	}
+
+	scanner := bufio.NewScanner(os.Stdin)
+	scanner.Buffer(nil, 16*1024*1024)
+	for scanner.Scan() {
+		if err := send(scanner.Bytes()); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// dialRedis connects to a redis server, and authenticates if a password is set, as the given user if set
+func dialRedis(address, username, password string) (radix.Conn, error) {
+	var options []radix.DialOpt
+	if username == "" && password != "" {
+		options = append(options, radix.DialAuthPass(password))
+	}
+
+	conn, err := radix.Dial("tcp", address, options...)
+	if err != nil {
+		return nil, err
+	}
+
+	if username != "" {
+		if err := conn.Do(radix.Cmd(nil, "AUTH", username, password)); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	return conn, nil
+}
+
+// runBench benchmarks a server, or the queue and API within the process, and prints the report
+func runBench(args []string) error {
+	flags := flag.NewFlagSet("bench", flag.ExitOnError)
+	flags.Usage = usage(flags, "bench [options]", "benchmark a server by subscribing to its channels and publishing to them through redis, or the queue and API within the process")
+	server := flags.String("server", "ws://localhost:8080", "the server to benchmark, which must have the channels")
+	inProcess := flags.Bool("in-process", false, "benchmark the queue and API within the process, without the network and redis")
+	redisAddress := flags.String("redis-address", "127.0.0.1:6379", "the redis server to publish to")
+	redisUsername := flags.String("redis-username", "", "redis 6 ACL username, the default user if not set")
+	redisPassword := flags.String("redis-password", "", "redis password")
+
+	var o bench.Options
+	flags.IntVar(&o.Subscribers, "subscribers", 100, "the number of subscribers, spread evenly across the channels")
+	flags.IntVar(&o.Channels, "channels", 10, "the number of channels")
+	flags.StringVar(&o.Prefix, "prefix", "bench-", "the prefix of the channel names, followed by their index")
+	flags.Float64Var(&o.Rate, "rate", 1000, "the number of messages published per second, across all channels")
+	flags.DurationVar(&o.Duration, "duration", time.Second*10, "how long messages are published for")
+	flags.IntVar(&o.Size, "size", 256, "the size of the payloads in bytes")
+	flags.DurationVar(&o.Drain, "drain", time.Second*5, "how long to wait for the last messages to be delivered")
+	flags.IntVar(&o.BufferSize, "buffer-size", 100, "the buffer size of the subscribers when benchmarking in-process")
+	flags.Parse(args)
+
+	ctx, cancel := interruptible()
+	defer cancel()
+
+	var report *bench.Report
+	var err error
+	if *inProcess {
+		report, err = bench.InProcess(ctx, o)
+	} else {
+		var conn radix.Conn
+		conn, err = dialRedis(*redisAddress, *redisUsername, *redisPassword)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+
+		report, err = bench.Run(ctx, *server, http.DefaultClient, func(channel string, payload []byte) error {
+			return conn.Do(radix.FlatCmd(nil, "PUBLISH", channel, payload))
+		}, o)
+	}
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "published\t%d\t(%d errors)\n", report.Published, report.Errors)
+	fmt.Fprintf(w, "delivered\t%d/%d\t(%d dropped)\n", report.Received, report.Expected, report.Dropped)
+	fmt.Fprintf(w, "latency\tp50 %s\tp90 %s\tp99 %s\tmax %s\n", report.Latencies.P50, report.Latencies.P90, report.Latencies.P99, report.Latencies.Max)
+
+	reasons := make([]string, 0, len(report.Disconnects))
+	for reason := range report.Disconnects {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+	for _, reason := range reasons {
+		fmt.Fprintf(w, "disconnected\t%d\t(%s)\n", report.Disconnects[reason], reason)
+	}
+
+	return w.Flush()
+}
+
+// dialChannel connects to a channel on a server, using the raw subprotocol
+func dialChannel(ctx context.Context, server string, channel string, token string) (*websocket.Conn, error) {
+	u, err := url.Parse(server)
+	if err != nil {
+		return nil, err
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/channel/" + url.PathEscape(channel)
+
+	header := http.Header{}
+	if token != "" {
+		header.Set("Authorization", "Bearer "+token)
+	}
+
+	c, resp, err := websocket.Dial(ctx, u.String(), &websocket.DialOptions{
+		HTTPHeader:   header,
+		Subprotocols: []string{"message-queue-v1"},
+	})
+	if err != nil && resp != nil && resp.StatusCode != http.StatusSwitchingProtocols {
+		return nil, fmt.Errorf("server responded with %s", resp.Status)
+	}
+	return c, err
+}
+
+// printStats prints the number of subscribers of every channel of a server
+func printStats(args []string) error {
+	flags := flag.NewFlagSet("stats", flag.ExitOnError)
+	flags.Usage = usage(flags, "stats [options]", "print the number of subscribers of every channel of a server")
+	admin := flags.String("admin", "http://localhost:9999", "the address the server exposes its metrics on")
+	asJSON := flags.Bool("json", false, "print the stats as JSON")
+	flags.Parse(args)
+
+	httpClient := &http.Client{Timeout: time.Second * 10}
+	resp, err := httpClient.Get(strings.TrimSuffix(*admin, "/") + "/stats")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("server responded with %s", resp.Status)
+	}
+
+	var s stats
+	if err := json.NewDecoder(resp.Body).Decode(&s); err != nil {
+		return fmt.Errorf("invalid stats: %s", err)
+	}
+
+	if *asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(s)
+	}
+
+	channels := make([]string, 0, len(s.Channels))
+	for channel := range s.Channels {
+		channels = append(channels, channel)
+	}
+	sort.Strings(channels)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "CHANNEL\tSUBSCRIBERS")
+	for _, channel := range channels {
+		fmt.Fprintf(w, "%s\t%d\n", channel, s.Channels[channel])
+	}
+	fmt.Fprintf(w, "total\t%d\n", s.Subscribers)
+	return w.Flush()
+}
+
+// usage returns a function printing the usage of a subcommand
+func usage(flags *flag.FlagSet, synopsis string, description string) func() {
+	return func() {
+		fmt.Fprintf(flags.Output(), "usage: %s %s\n\n%s\n\n", os.Args[0], synopsis, description)
+		flags.PrintDefaults()
+	}
+}
+
+// interruptible returns a context that's canceled on SIGINT or SIGTERM
+func interruptible() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		select {
+		case <-c:
+			cancel()
+		case <-ctx.Done():
+		}
+		signal.Stop(c)
+	}()
+
+	return ctx, cancel
+}
@@ -0,0 +1,687 @@
+package config
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/mullvad/message-queue/queue"
+	"github.com/mullvad/message-queue/schema"
+	"github.com/mullvad/message-queue/wal"
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the configuration of message-queue
+type Config struct {
+	Listen           string        `yaml:"listen"`
+	StatsdAddress    string        `yaml:"statsd_address"`
+	BufferSize       int           `yaml:"buffer_size"`   // The default message buffer size for each subscriber
+	PingInterval     time.Duration `yaml:"ping_interval"` // The default interval between pings to clients
+	PingTimeout      time.Duration `yaml:"ping_timeout"`
+	AckTimeout       time.Duration `yaml:"ack_timeout"`
+	SessionRetention time.Duration `yaml:"session_retention"`
+	InboxMessages    int           `yaml:"inbox_messages"`
+	InboxBytes       int           `yaml:"inbox_bytes"`
+	DedupWindow      time.Duration `yaml:"dedup_window"`
+	RouteIdleTimeout time.Duration `yaml:"route_idle_timeout"`
+
+	Redis    Redis     `yaml:"redis"`
+	Replay   *Replay   `yaml:"replay"` // Feeds the channels from a recording instead of redis, if set
+	History  History   `yaml:"history"`
+	Channels []Channel `yaml:"channels"`
+	Routes   []Route   `yaml:"routes"`
+
+	node *yaml.Node // The node the configuration was parsed from, for pointing out errors
+}
+
+// Redis configures the connection to redis, either directly, using redis sentinel or to a redis cluster
+type Redis struct {
+	ServerAddress     string   `yaml:"server_address"`
+	SentinelService   string   `yaml:"sentinel_service"`
+	SentinelAddresses []string `yaml:"sentinel_addresses"`
+	Replicas          bool     `yaml:"replicas"`          // Subscribes on a replica rather than the primary managed by sentinel
+	ClusterAddresses  []string `yaml:"cluster_addresses"` // Any nodes of the cluster, for discovering the others
+	Username          string   `yaml:"username"`          // The redis 6 ACL user, the default user if not set
+	Password          string   `yaml:"password"`
+	TLS               *TLS     `yaml:"tls"`
+	MirrorAddresses   []string `yaml:"mirror_addresses"` // Redundant redis servers publishing the same channels
+
+	// Authentication with the sentinels, instead of any details in their addresses if either is set
+	SentinelUsername string `yaml:"sentinel_username"`
+	SentinelPassword string `yaml:"sentinel_password"`
+	SentinelTLS      *TLS   `yaml:"sentinel_tls"`
+}
+
+// TLS configures connecting using TLS, verifying the servers using the system CAs unless a CA file is set
+type TLS struct {
+	CAFile     string `yaml:"ca_file"`
+	CertFile   string `yaml:"cert_file"` // The client certificate for mutual TLS, if set
+	KeyFile    string `yaml:"key_file"`
+	ServerName string `yaml:"server_name"` // Overrides the name the server certificates are verified against, if set
+}
+
+// Replay replays a recording made with the record command into the channels, at the original timing multiplied by
+// the speed
+type Replay struct {
+	File  string  `yaml:"file"`
+	Speed float64 `yaml:"speed"` // 1 if not set
+	Fast  bool    `yaml:"fast"`  // Replays the messages as fast as possible, ignoring the timing
+	Loop  bool    `yaml:"loop"`  // Starts over at the end of the recording
+}
+
+// History configures where the history of the channels is kept, and the default retention
+type History struct {
+	Dir         string        `yaml:"dir"` // Keeps the history on disk if set, otherwise in memory
+	SegmentSize int64         `yaml:"segment_size"`
+	Messages    int           `yaml:"messages"` // The number of messages kept in memory
+	MaxBytes    int64         `yaml:"max_bytes"`
+	MaxAge      time.Duration `yaml:"max_age"`
+	// Syncs the history on disk at this interval if set, rather than after every message, at the risk of losing the
+	// messages since the last sync if the machine crashes
+	SyncInterval time.Duration `yaml:"sync_interval"`
+}
+
+// Channel configures a queue channel
+type Channel struct {
+	Name    string   `yaml:"name"`
+	Sources []string `yaml:"sources"` // The redis channels feeding the channel, the name of the channel if not set
+	// Feeds the channel with keyspace notifications as well, or instead of the channel of the same name if there are no
+	// sources
+	Keyspace *Keyspace `yaml:"keyspace"`
+
+	BufferSize     int           `yaml:"buffer_size"`     // Overrides the default buffer size, if set
+	SlowConsumer   string        `yaml:"slow_consumer"`   // Either "disconnect", the default, or "conflate"
+	ConflateKey    string        `yaml:"conflate_key"`    // The key for conflating the messages of slow consumers
+	Dispatch       string        `yaml:"dispatch"`        // Either "broadcast", the default, "round-robin" or "least-loaded"
+	PingInterval   time.Duration `yaml:"ping_interval"`   // Overrides the default ping interval, if set
+	MaxSubscribers int           `yaml:"max_subscribers"` // Unlimited if not set
+
+	Snapshot  *Snapshot  `yaml:"snapshot"`
+	Dedup     *Dedup     `yaml:"dedup"`
+	Auth      *Auth      `yaml:"auth"`
+	Retention *Retention `yaml:"retention"`
+	Publish   *Publish   `yaml:"publish"`
+
+	node *yaml.Node // The node the channel was parsed from, for pointing out errors
+}
+
+// Snapshot makes new subscribers get the latest message, or the latest message per key, before any new messages
+type Snapshot struct {
+	Key  string `yaml:"key"`
+	Seed string `yaml:"seed"` // A redis hash, keyed by its fields, or a string to seed the snapshot with on startup
+}
+
+// Dedup drops messages with the same ID as a recent message, where the ID is the key, or the hash of the payload
+type Dedup struct {
+	Key string `yaml:"key"`
+}
+
+// Keyspace feeds a channel with the keyspace notifications of the keys matching a pattern
+type Keyspace struct {
+	Database int      `yaml:"database"`
+	Pattern  string   `yaml:"pattern"` // The glob-style pattern of the keys, such as "session:*"
+	Events   []string `yaml:"events"`  // The events passed on, such as "expired" or "set", all of them if not set
+	Fetch    bool     `yaml:"fetch"`   // Includes the current value of the key in every message
+	// The notify-keyspace-events flags to add on the redis servers, such as "Kx" for expired keys, if set
+	Enable string `yaml:"enable"`
+}
+
+// Auth requires clients to present one of the tokens
+type Auth struct {
+	Tokens []string `yaml:"tokens"`
+}
+
+// Publish lets clients presenting one of the tokens publish messages to a redis channel by sending them on their
+// websocket connections
+type Publish struct {
+	Channel string   `yaml:"channel"` // The redis channel published to, the first source of the channel if not set
+	Tokens  []string `yaml:"tokens"`
+	MaxSize int      `yaml:"max_size"` // The maximum payload size in bytes, the API default if not set
+	Schema  string   `yaml:"schema"`   // The path to a JSON schema the payloads must match, if set
+	// The number of messages per second each connection may publish, and how many it may publish at once, unlimited if
+	// not set
+	Rate  float64 `yaml:"rate"`
+	Burst int     `yaml:"burst"`
+}
+
+// Retention overrides the default history retention of a channel
+type Retention struct {
+	Messages int           `yaml:"messages"`
+	MaxBytes int64         `yaml:"max_bytes"`
+	MaxAge   time.Duration `yaml:"max_age"`
+}
+
+// Route routes the messages of a redis channel into channels named after a key of every message
+type Route struct {
+	Source      string `yaml:"source"`
+	Channel     string `yaml:"channel"`      // The name of the routed channels, such as "orders.{customer.id}"
+	MaxChannels int    `yaml:"max_channels"` // The maximum number of routed channels open at once, the router default if not set
+	Auth        *Auth  `yaml:"auth"`         // Required to subscribe to the routed channels, if set
+
+	node *yaml.Node
+}
+
+// Default returns the default configuration
+func Default() *Config {
+	return &Config{
+		Listen:           ":8080",
+		StatsdAddress:    "127.0.0.1:8125",
+		BufferSize:       100,
+		PingInterval:     time.Second * 25,
+		PingTimeout:      time.Second * 15,
+		AckTimeout:       time.Second * 30,
+		SessionRetention: time.Minute * 5,
+		InboxMessages:    1000,
+		InboxBytes:       1024 * 1024,
+		DedupWindow:      time.Minute,
+		RouteIdleTimeout: time.Minute * 10,
+		History: History{
+			SegmentSize: wal.DefaultOptions.SegmentSize,
+		},
+	}
+}
+
+// Load reads and validates the configuration file
+func Load(path string) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+
+	return c, nil
+}
+
+// Parse parses and validates a configuration, using the defaults for any settings that aren't set
+func Parse(data []byte) (*Config, error) {
+	c := Default()
+
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(c); err != nil {
+		return nil, err
+	}
+
+	// Keep the nodes of the configuration, channels and routes, to point out the lines of any errors
+	var nodes struct {
+		Channels []yaml.Node `yaml:"channels"`
+		Routes   []yaml.Node `yaml:"routes"`
+	}
+	if err := yaml.Unmarshal(data, &nodes); err != nil {
+		return nil, err
+	}
+
+	var root yaml.Node
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		return nil, err
+	}
+	if len(root.Content) > 0 {
+		c.node = root.Content[0]
+	}
+
+	for i := range c.Channels {
+		c.Channels[i].node = &nodes.Channels[i]
+	}
+	for i := range c.Routes {
+		c.Routes[i].node = &nodes.Routes[i]
+	}
+
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// Validate checks that the configuration is complete and consistent
+func (c *Config) Validate() error {
+	modes := 0
+	for _, set := range []bool{c.Redis.ServerAddress != "", len(c.Redis.SentinelAddresses) > 0, len(c.Redis.ClusterAddresses) > 0} {
+		if set {
+			modes++
+		}
+	}
+
+	if c.Replay != nil {
+		if err := c.Replay.validate(); err != nil {
+			return errorf(c.node, "replay", fmt.Sprintf("replay: %s", err))
+		}
+
+		if modes > 0 {
+			return errorf(c.node, "redis", "redis: incompatible with replaying a recording")
+		}
+	} else if modes == 0 {
+		return errorf(c.node, "redis", "redis: either a server address, sentinel addresses or cluster addresses are required")
+	}
+
+	if modes > 1 {
+		return errorf(c.node, "redis", "redis: a server address, sentinel addresses and cluster addresses are incompatible")
+	}
+
+	if len(c.Redis.SentinelAddresses) > 0 && c.Redis.SentinelService == "" {
+		return errorf(c.node, "redis", "redis: a sentinel service is required when using redis sentinel")
+	}
+
+	if c.Redis.Replicas && len(c.Redis.SentinelAddresses) == 0 {
+		return errorf(c.node, "redis", "redis: subscribing on replicas requires redis sentinel")
+	}
+
+	if err := c.Redis.TLS.validate(); err != nil {
+		return errorf(c.node, "redis", fmt.Sprintf("redis: tls: %s", err))
+	}
+
+	if err := c.Redis.SentinelTLS.validate(); err != nil {
+		return errorf(c.node, "redis", fmt.Sprintf("redis: sentinel_tls: %s", err))
+	}
+
+	if c.BufferSize < 0 {
+		return errorf(c.node, "buffer_size", "buffer_size: negative buffer size")
+	}
+
+	// The intervals are used for tickers, which can't tick at intervals that aren't positive, and nothing would be
+	// deduplicated within a window that isn't
+	for _, setting := range []struct {
+		name  string
+		value time.Duration
+	}{
+		{"ping_interval", c.PingInterval},
+		{"ping_timeout", c.PingTimeout},
+		{"ack_timeout", c.AckTimeout},
+		{"route_idle_timeout", c.RouteIdleTimeout},
+		{"dedup_window", c.DedupWindow},
+	} {
+		if setting.value <= 0 {
+			return errorf(c.node, setting.name, fmt.Sprintf("%s: must be positive", setting.name))
+		}
+	}
+
+	if c.History.SyncInterval < 0 {
+		return errorf(c.node, "history", "history: negative sync interval")
+	}
+
+	if len(c.Channels) == 0 && len(c.Routes) == 0 {
+		return fmt.Errorf("no channels configured")
+	}
+
+	names := make(map[string]bool)
+	for i := range c.Channels {
+		channel := &c.Channels[i]
+		if err := channel.validate(); err != nil {
+			return err
+		}
+
+		if names[channel.Name] {
+			return channel.errorf("name", "duplicate channel")
+		}
+
+		if c.Replay != nil && channel.Keyspace != nil {
+			return channel.errorf("keyspace", "keyspace notifications require redis, which isn't used when replaying a recording")
+		}
+
+		if c.Replay != nil && channel.Snapshot != nil && channel.Snapshot.Seed != "" {
+			return channel.errorf("snapshot", "seeds are read from redis, which isn't used when replaying a recording")
+		}
+		names[channel.Name] = true
+	}
+
+	for i := range c.Routes {
+		if err := c.Routes[i].validate(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (c *Channel) validate() error {
+	if c.Name == "" {
+		return c.errorf("name", "a name is required")
+	}
+
+	for _, source := range c.Sources {
+		if source == "" {
+			return c.errorf("sources", "empty source")
+		}
+	}
+
+	if c.Keyspace != nil {
+		if err := c.Keyspace.validate(); err != nil {
+			return c.errorf("keyspace", "%s", err)
+		}
+	}
+
+	if c.BufferSize < 0 {
+		return c.errorf("buffer_size", "negative buffer size")
+	}
+
+	if c.MaxSubscribers < 0 {
+		return c.errorf("max_subscribers", "negative max subscribers")
+	}
+
+	if c.PingInterval < 0 {
+		return c.errorf("ping_interval", "negative ping interval")
+	}
+
+	switch c.SlowConsumer {
+	case "", "disconnect":
+	case "conflate":
+		if _, err := ParseKey(c.ConflateKey); err != nil || c.ConflateKey == "" {
+			return c.errorf("slow_consumer", "a valid conflate key is required to conflate")
+		}
+	default:
+		return c.errorf("slow_consumer", "unknown slow consumer policy %q", c.SlowConsumer)
+	}
+
+	dispatch, err := c.DispatchMode()
+	if err != nil {
+		return c.errorf("dispatch", "%s", err)
+	}
+
+	// Subscribers of work queue channels are skipped rather than disconnected when they fall behind
+	if c.SlowConsumer == "conflate" && dispatch != queue.Broadcast {
+		return c.errorf("slow_consumer", "work queue channels can't be conflated")
+	}
+
+	if c.Snapshot != nil && c.Snapshot.Key != "" {
+		if _, err := ParseKey(c.Snapshot.Key); err != nil {
+			return c.errorf("snapshot", "invalid key: %s", err)
+		}
+	}
+
+	if c.Dedup != nil && c.Dedup.Key != "" {
+		if _, err := ParseKey(c.Dedup.Key); err != nil {
+			return c.errorf("dedup", "invalid key: %s", err)
+		}
+	}
+
+	if err := c.Auth.validate(); err != nil {
+		return c.errorf("auth", "%s", err)
+	}
+
+	if c.Retention != nil && (c.Retention.Messages < 0 || c.Retention.MaxBytes < 0 || c.Retention.MaxAge < 0) {
+		return c.errorf("retention", "negative retention")
+	}
+
+	if c.Publish != nil {
+		if err := c.Publish.validate(); err != nil {
+			return c.errorf("publish", "%s", err)
+		}
+
+		if c.PublishChannel() == "" {
+			return c.errorf("publish", "a channel is required for channels without sources")
+		}
+	}
+
+	return nil
+}
+
+func (r *Replay) validate() error {
+	if r.File == "" {
+		return fmt.Errorf("a file is required")
+	}
+
+	if r.Speed < 0 {
+		return fmt.Errorf("the speed must not be negative")
+	}
+
+	return nil
+}
+
+// Multiplier returns the multiplier of the original timing, or zero for replaying as fast as possible
+func (r *Replay) Multiplier() float64 {
+	switch {
+	case r.Fast:
+		return 0
+	case r.Speed == 0:
+		return 1
+	default:
+		return r.Speed
+	}
+}
+
+func (k *Keyspace) validate() error {
+	if k.Pattern == "" {
+		return fmt.Errorf("a key pattern is required")
+	}
+
+	if k.Database < 0 {
+		return fmt.Errorf("negative database")
+	}
+
+	if k.Enable != "" {
+		if strings.Trim(k.Enable, "KEg$lshzxetdmnA") != "" {
+			return fmt.Errorf("invalid keyspace event flags %q", k.Enable)
+		}
+
+		// The notifications are received on the keyspace channels
+		if !strings.Contains(k.Enable, "K") {
+			return fmt.Errorf("the keyspace event flags must include K")
+		}
+	}
+
+	return nil
+}
+
+func (a *Auth) validate() error {
+	if a == nil {
+		return nil
+	}
+
+	if len(a.Tokens) == 0 {
+		return fmt.Errorf("no tokens")
+	}
+
+	for _, token := range a.Tokens {
+		if token == "" {
+			return fmt.Errorf("empty token")
+		}
+	}
+
+	return nil
+}
+
+func (p *Publish) validate() error {
+	if len(p.Tokens) == 0 {
+		return fmt.Errorf("no tokens")
+	}
+
+	for _, token := range p.Tokens {
+		if token == "" {
+			return fmt.Errorf("empty token")
+		}
+	}
+
+	if p.MaxSize < 0 || p.Rate < 0 || p.Burst < 0 {
+		return fmt.Errorf("negative limit")
+	}
+
+	return nil
+}
+
+// LoadSchema loads the JSON schema the published payloads must match, or returns nil if there's none
+func (p *Publish) LoadSchema() (*schema.Schema, error) {
+	if p == nil || p.Schema == "" {
+		return nil, nil
+	}
+
+	data, err := ioutil.ReadFile(p.Schema)
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := schema.Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", p.Schema, err)
+	}
+
+	return s, nil
+}
+
+func (t *TLS) validate() error {
+	if t == nil {
+		return nil
+	}
+
+	if (t.CertFile == "") != (t.KeyFile == "") {
+		return fmt.Errorf("a client certificate requires both a cert file and a key file")
+	}
+
+	return nil
+}
+
+// Config loads the CA and client certificate, and returns the TLS configuration, or nil if TLS isn't configured
+func (t *TLS) Config() (*tls.Config, error) {
+	if t == nil {
+		return nil, nil
+	}
+
+	config := &tls.Config{
+		ServerName: t.ServerName,
+	}
+
+	if t.CAFile != "" {
+		data, err := ioutil.ReadFile(t.CAFile)
+		if err != nil {
+			return nil, err
+		}
+
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("%s: no certificates found", t.CAFile)
+		}
+	}
+
+	if t.CertFile != "" {
+		certificate, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{certificate}
+	}
+
+	return config, nil
+}
+
+// SourceChannels returns the redis channels feeding the channel
+func (c *Channel) SourceChannels() []string {
+	if len(c.Sources) == 0 && c.Keyspace == nil {
+		return []string{c.Name}
+	}
+	return c.Sources
+}
+
+// PublishChannel returns the redis channel clients publish to, or an empty string if there's none
+func (c *Channel) PublishChannel() string {
+	if c.Publish == nil {
+		return ""
+	}
+
+	if c.Publish.Channel != "" {
+		return c.Publish.Channel
+	}
+
+	if sources := c.SourceChannels(); len(sources) > 0 {
+		return sources[0]
+	}
+	return ""
+}
+
+// DispatchMode returns how the messages of the channel are distributed among its subscribers
+func (c *Channel) DispatchMode() (queue.Dispatch, error) {
+	switch c.Dispatch {
+	case "", "broadcast":
+		return queue.Broadcast, nil
+	case "round-robin":
+		return queue.RoundRobin, nil
+	case "least-loaded":
+		return queue.LeastLoaded, nil
+	default:
+		return 0, fmt.Errorf("unknown dispatch %q", c.Dispatch)
+	}
+}
+
+// errorf returns an error pointing out the line of the field of the channel, if it was parsed from a file
+func (c *Channel) errorf(field string, format string, args ...interface{}) error {
+	return errorf(c.node, field, fmt.Sprintf("channel %q: %s", c.Name, fmt.Sprintf(format, args...)))
+}
+
+func (r *Route) validate() error {
+	if r.Source == "" {
+		return errorf(r.node, "source", "route: a source is required")
+	}
+
+	if _, _, err := r.Rule(); err != nil {
+		return errorf(r.node, "channel", fmt.Sprintf("route %q: %s", r.Source, err))
+	}
+
+	if r.MaxChannels < 0 {
+		return errorf(r.node, "max_channels", fmt.Sprintf("route %q: negative max channels", r.Source))
+	}
+
+	if err := r.Auth.validate(); err != nil {
+		return errorf(r.node, "auth", fmt.Sprintf("route %q: %s", r.Source, err))
+	}
+
+	return nil
+}
+
+// Rule returns the prefix of the routed channels, and the key of every message appended to it
+func (r *Route) Rule() (string, queue.KeyFunc, error) {
+	start, end := strings.Index(r.Channel, "{"), strings.LastIndex(r.Channel, "}")
+	if start < 0 || end != len(r.Channel)-1 || end-start < 2 {
+		return "", nil, fmt.Errorf("%q: expected prefix{key}", r.Channel)
+	}
+
+	key, err := ParseKey(r.Channel[start+1 : end])
+	if err != nil {
+		return "", nil, err
+	}
+
+	return r.Channel[:start], key, nil
+}
+
+// errorf returns an error prefixed with the line of the field in the mapping node, or of the node itself if the field
+// isn't set
+func errorf(node *yaml.Node, field string, message string) error {
+	if node == nil {
+		return fmt.Errorf("%s", message)
+	}
+
+	line := node.Line
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == field {
+			line = node.Content[i].Line
+			break
+		}
+	}
+
+	return fmt.Errorf("line %d: %s", line, message)
+}
+
+// ParseKey parses a key specification, which is either 'prefix:<separator>', 'header:<name>', 'regex:<expression>' or
+// a path to a JSON field
+func ParseKey(key string) (queue.KeyFunc, error) {
+	switch {
+	case strings.HasPrefix(key, "prefix:"):
+		return queue.PrefixKey(strings.TrimPrefix(key, "prefix:")), nil
+	case strings.HasPrefix(key, "header:"):
+		return queue.HeaderKey(strings.TrimPrefix(key, "header:")), nil
+	case strings.HasPrefix(key, "regex:"):
+		re, err := regexp.Compile(strings.TrimPrefix(key, "regex:"))
+		if err != nil {
+			return nil, err
+		}
+		return queue.RegexKey(re), nil
+	default:
+		return queue.FieldKey(key), nil
+	}
+}
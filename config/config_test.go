@@ -0,0 +1,246 @@
+package config_test
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mullvad/message-queue/config"
+	"github.com/mullvad/message-queue/queue"
+)
+
+const example = `
+listen: ":9090"
+redis:
+  server_address: "127.0.0.1:6379"
+channels:
+  - name: prices
+    buffer_size: 10
+    slow_consumer: conflate
+    conflate_key: "prefix:|"
+    snapshot:
+      key: "prefix:|"
+  - name: all-alerts
+    sources: [alerts.eu, alerts.us]
+    auth:
+      tokens: [secret]
+    publish:
+      tokens: [writer]
+      rate: 10
+  - name: jobs
+    dispatch: round-robin
+    ping_interval: 5s
+    max_subscribers: 10
+    retention:
+      messages: 1000
+  - name: sessions
+    keyspace:
+      pattern: "session:*"
+      events: [expired]
+      enable: Kx
+routes:
+  - source: orders
+    channel: "orders.{customer.id}"
+`
+
+func TestParse(t *testing.T) {
+	t.Run("parse configuration", func(t *testing.T) {
+		c, err := config.Parse([]byte(example))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if c.Listen != ":9090" || c.BufferSize != 100 || c.AckTimeout != time.Second*30 {
+			t.Fatalf("wrong settings: %+v", c)
+		}
+
+		if len(c.Channels) != 4 || c.Channels[0].BufferSize != 10 || c.Channels[1].Auth.Tokens[0] != "secret" {
+			t.Fatalf("wrong channels: %+v", c.Channels)
+		}
+
+		if sources := c.Channels[0].SourceChannels(); len(sources) != 1 || sources[0] != "prices" {
+			t.Fatalf("wrong sources: %s", sources)
+		}
+
+		if sources := c.Channels[1].SourceChannels(); len(sources) != 2 || sources[1] != "alerts.us" {
+			t.Fatalf("wrong sources: %s", sources)
+		}
+
+		if channel := c.Channels[1].PublishChannel(); channel != "alerts.eu" || c.Channels[1].Publish.Rate != 10 {
+			t.Fatalf("wrong publish channel: %s", channel)
+		}
+
+		if channel := c.Channels[0].PublishChannel(); channel != "" {
+			t.Fatalf("unexpected publish channel: %s", channel)
+		}
+
+		if dispatch, err := c.Channels[2].DispatchMode(); err != nil || dispatch != queue.RoundRobin {
+			t.Fatalf("wrong dispatch: %d", dispatch)
+		}
+
+		if c.Channels[2].PingInterval != time.Second*5 || c.Channels[2].Retention.Messages != 1000 {
+			t.Fatalf("wrong channel: %+v", c.Channels[2])
+		}
+
+		if sources := c.Channels[3].SourceChannels(); len(sources) != 0 || c.Channels[3].Keyspace.Pattern != "session:*" {
+			t.Fatalf("wrong keyspace channel: %+v", c.Channels[3])
+		}
+
+		prefix, _, err := c.Routes[0].Rule()
+		if err != nil || prefix != "orders." {
+			t.Fatalf("wrong route: %s", prefix)
+		}
+	})
+
+	t.Run("parse replay", func(t *testing.T) {
+		c, err := config.Parse([]byte("replay:\n  file: capture.ndjson\n  loop: true\nchannels:\n  - name: a\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if c.Replay.File != "capture.ndjson" || !c.Replay.Loop || c.Replay.Multiplier() != 1 {
+			t.Fatalf("wrong replay: %+v", c.Replay)
+		}
+
+		c.Replay.Speed = 2
+		if c.Replay.Multiplier() != 2 {
+			t.Fatalf("wrong multiplier: %v", c.Replay.Multiplier())
+		}
+
+		c.Replay.Fast = true
+		if c.Replay.Multiplier() != 0 {
+			t.Fatalf("wrong multiplier: %v", c.Replay.Multiplier())
+		}
+	})
+
+	tests := []struct {
+		name  string
+		data  string
+		error string
+	}{
+		{"unknown field", "redis:\n  server_address: a\nchannels:\n  - name: a\n    bufer_size: 1\n", "line 5"},
+		{"invalid dispatch", "redis:\n  server_address: a\nchannels:\n  - name: a\n  - name: b\n    dispatch: random\n", "line 6: channel \"b\": unknown dispatch"},
+		{"duplicate channel", "redis:\n  server_address: a\nchannels:\n  - name: a\n  - name: a\n", "line 5: channel \"a\": duplicate channel"},
+		{"conflate without key", "redis:\n  server_address: a\nchannels:\n  - name: a\n    slow_consumer: conflate\n", "line 5"},
+		{"conflated work queue", "redis:\n  server_address: a\nchannels:\n  - name: a\n    dispatch: round-robin\n    slow_consumer: conflate\n    conflate_key: id\n", "line 6: channel \"a\": work queue channels can't be conflated"},
+		{"invalid route", "redis:\n  server_address: a\nroutes:\n  - source: a\n    channel: orders\n", "line 5"},
+		{"negative history sync interval", "redis:\n  server_address: a\nhistory:\n  sync_interval: -1s\nchannels:\n  - name: a\n", "line 3: history: negative sync interval"},
+		{"negative route max channels", "redis:\n  server_address: a\nroutes:\n  - source: a\n    channel: a.{id}\n    max_channels: -1\n", "line 6: route \"a\": negative max channels"},
+		{"route auth without tokens", "redis:\n  server_address: a\nroutes:\n  - source: a\n    channel: a.{id}\n    auth: {}\n", "line 6: route \"a\": no tokens"},
+		{"no redis", "channels:\n  - name: a\n", "redis"},
+		{"several redis modes", "redis:\n  server_address: a\n  cluster_addresses: [b]\nchannels:\n  - name: a\n", "line 1: redis: a server address, sentinel addresses and cluster addresses are incompatible"},
+		{"replicas without sentinel", "channels:\n  - name: a\nredis:\n  server_address: a\n  replicas: true\n", "line 3: redis: subscribing on replicas"},
+		{"keyspace without pattern", "redis:\n  server_address: a\nchannels:\n  - name: a\n    keyspace:\n      events: [set]\n", "line 5"},
+		{"invalid keyspace flags", "redis:\n  server_address: a\nchannels:\n  - name: a\n    keyspace:\n      pattern: a\n      enable: Ex\n", "must include K"},
+		{"publish without tokens", "redis:\n  server_address: a\nchannels:\n  - name: a\n    publish:\n      max_size: 10\n", "line 5: channel \"a\": no tokens"},
+		{"publish without channel", "redis:\n  server_address: a\nchannels:\n  - name: a\n    keyspace:\n      pattern: a\n    publish:\n      tokens: [a]\n", "a channel is required"},
+		{"negative publish rate", "redis:\n  server_address: a\nchannels:\n  - name: a\n    publish:\n      tokens: [a]\n      rate: -1\n", "negative limit"},
+		{"no channels", "redis:\n  server_address: a\n", "no channels"},
+		{"replay without file", "replay:\n  loop: true\nchannels:\n  - name: a\n", "line 1: replay: a file is required"},
+		{"replay with redis", "redis:\n  server_address: a\nreplay:\n  file: a\nchannels:\n  - name: a\n", "line 1: redis: incompatible with replaying"},
+		{"replay with keyspace", "replay:\n  file: a\nchannels:\n  - name: a\n    keyspace:\n      pattern: a\n", "line 5: channel \"a\": keyspace notifications require redis"},
+		{"zero ping interval", "ping_interval: 0s\nredis:\n  server_address: a\nchannels:\n  - name: a\n", "line 1: ping_interval: must be positive"},
+		{"negative ping timeout", "redis:\n  server_address: a\nping_timeout: -1s\nchannels:\n  - name: a\n", "line 3: ping_timeout: must be positive"},
+		{"zero ack timeout", "redis:\n  server_address: a\nack_timeout: 0s\nchannels:\n  - name: a\n", "line 3: ack_timeout"},
+		{"zero route idle timeout", "redis:\n  server_address: a\nroute_idle_timeout: 0s\nroutes:\n  - source: a\n    channel: a.{id}\n", "line 3: route_idle_timeout"},
+		{"negative channel ping interval", "redis:\n  server_address: a\nchannels:\n  - name: a\n    ping_interval: -1s\n", "line 5: channel \"a\": negative ping interval"},
+		{"client certificate without key", "redis:\n  server_address: a\n  tls:\n    cert_file: a.pem\nchannels:\n  - name: a\n", "line 1: redis: tls"},
+		{"negative buffer size", "redis:\n  server_address: a\nbuffer_size: -1\nchannels:\n  - name: a\n", "line 3: buffer_size: negative buffer size"},
+		{"zero dedup window", "redis:\n  server_address: a\ndedup_window: 0s\nchannels:\n  - name: a\n", "line 3: dedup_window: must be positive"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := config.Parse([]byte(test.data))
+			if err == nil || !strings.Contains(err.Error(), test.error) {
+				t.Fatalf("wrong error: %v", err)
+			}
+		})
+	}
+}
+
+func TestTLS(t *testing.T) {
+	t.Run("not configured", func(t *testing.T) {
+		var c *config.TLS
+		if tlsConfig, err := c.Config(); tlsConfig != nil || err != nil {
+			t.Fatalf("unexpected configuration: %v", err)
+		}
+	})
+
+	t.Run("system CAs", func(t *testing.T) {
+		c := &config.TLS{ServerName: "redis.example.com"}
+		tlsConfig, err := c.Config()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if tlsConfig.RootCAs != nil || tlsConfig.ServerName != "redis.example.com" {
+			t.Fatalf("wrong configuration: %+v", tlsConfig)
+		}
+	})
+
+	t.Run("missing CA file", func(t *testing.T) {
+		c := &config.TLS{CAFile: "nonexistent.pem"}
+		if _, err := c.Config(); err == nil {
+			t.Fatal("no error")
+		}
+	})
+
+	t.Run("CA file without certificates", func(t *testing.T) {
+		c := &config.TLS{CAFile: "../config.example.yaml"}
+		if _, err := c.Config(); err == nil {
+			t.Fatal("no error")
+		}
+	})
+}
+
+func TestPublishSchema(t *testing.T) {
+	t.Run("no schema", func(t *testing.T) {
+		var p *config.Publish
+		if s, err := p.LoadSchema(); s != nil || err != nil {
+			t.Fatalf("unexpected schema: %v", err)
+		}
+	})
+
+	t.Run("load schema", func(t *testing.T) {
+		f, err := ioutil.TempFile("", "schema")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.Remove(f.Name())
+
+		if _, err := f.WriteString(`{"type":"object","required":["x"]}`); err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+
+		p := &config.Publish{Schema: f.Name()}
+		s, err := p.LoadSchema()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := s.ValidateJSON([]byte(`{"y":1}`)); err == nil {
+			t.Fatal("no validation error")
+		}
+	})
+
+	t.Run("invalid schema", func(t *testing.T) {
+		p := &config.Publish{Schema: "../config.example.yaml"}
+		if _, err := p.LoadSchema(); err == nil {
+			t.Fatal("no error")
+		}
+	})
+}
+
+func TestLoad(t *testing.T) {
+	if _, err := config.Load("../config.example.yaml"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := config.Load("nonexistent.yaml"); err == nil {
+		t.Fatal("no error")
+	}
+}
@@ -0,0 +1,321 @@
+package filter
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"unicode"
+
+	"github.com/mullvad/message-queue/message"
+)
+
+// Filter is a parsed filter expression that can be matched against JSON message payloads
+//
+// An expression compares fields in the payload, referenced by dot-delimited paths, against JSON literals:
+//
+//	account.id == "1234" && (amount >= 100 || flagged == true)
+//
+// The supported operators are ==, !=, <, <=, >, >=, && and ||, a ! for negation, and parentheses for grouping
+// A path on its own matches if the field exists, strings may also be single-quoted to simplify use in URLs
+type Filter struct {
+	expression string
+	root       node
+}
+
+// Parse parses a filter expression
+func Parse(expression string) (*Filter, error) {
+	p := parser{input: expression}
+
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+
+	p.skipSpace()
+	if p.pos < len(p.input) {
+		return nil, p.errorf("unexpected %q", p.input[p.pos:])
+	}
+
+	return &Filter{
+		expression: expression,
+		root:       root,
+	}, nil
+}
+
+// Match returns whether the message matches the filter
+// Messages without a JSON payload never match comparisons
+func (f *Filter) Match(m *message.Message) bool {
+	return f.root.eval(m)
+}
+
+func (f *Filter) String() string {
+	return f.expression
+}
+
+type node interface {
+	eval(m *message.Message) bool
+}
+
+type and struct {
+	left, right node
+}
+
+func (n and) eval(m *message.Message) bool {
+	return n.left.eval(m) && n.right.eval(m)
+}
+
+type or struct {
+	left, right node
+}
+
+func (n or) eval(m *message.Message) bool {
+	return n.left.eval(m) || n.right.eval(m)
+}
+
+type not struct {
+	node node
+}
+
+func (n not) eval(m *message.Message) bool {
+	return !n.node.eval(m)
+}
+
+type exists struct {
+	path string
+}
+
+func (n exists) eval(m *message.Message) bool {
+	_, ok := m.Field(n.path)
+	return ok
+}
+
+type comparison struct {
+	path     string
+	operator string
+	value    interface{}
+}
+
+func (n comparison) eval(m *message.Message) bool {
+	field, ok := m.Field(n.path)
+	if !ok {
+		return false
+	}
+
+	switch n.operator {
+	case "==":
+		return equal(field, n.value)
+	case "!=":
+		return !equal(field, n.value)
+	}
+
+	c, ok := compare(field, n.value)
+	if !ok {
+		return false
+	}
+
+	switch n.operator {
+	case "<":
+		return c < 0
+	case "<=":
+		return c <= 0
+	case ">":
+		return c > 0
+	case ">=":
+		return c >= 0
+	}
+
+	return false
+}
+
+// equal compares scalar JSON values, objects and arrays are never equal to anything
+func equal(a, b interface{}) bool {
+	switch a.(type) {
+	case map[string]interface{}, []interface{}:
+		return false
+	}
+
+	return a == b
+}
+
+// compare orders two numbers or two strings
+func compare(a, b interface{}) (int, bool) {
+	switch a := a.(type) {
+	case float64:
+		b, ok := b.(float64)
+		switch {
+		case !ok:
+			return 0, false
+		case a < b:
+			return -1, true
+		case a > b:
+			return 1, true
+		}
+		return 0, true
+	case string:
+		b, ok := b.(string)
+		if !ok {
+			return 0, false
+		}
+		return strings.Compare(a, b), true
+	}
+
+	return 0, false
+}
+
+type parser struct {
+	input string
+	pos   int
+}
+
+func (p *parser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("filter: at position %d: %s", p.pos, fmt.Sprintf(format, args...))
+}
+
+func (p *parser) skipSpace() {
+	for p.pos < len(p.input) && unicode.IsSpace(rune(p.input[p.pos])) {
+		p.pos++
+	}
+}
+
+// consume skips whitespace, and consumes the given token if it's next in the input
+func (p *parser) consume(token string) bool {
+	p.skipSpace()
+	if strings.HasPrefix(p.input[p.pos:], token) {
+		p.pos += len(token)
+		return true
+	}
+	return false
+}
+
+func (p *parser) parseOr() (node, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.consume("||") {
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = or{left, right}
+	}
+
+	return left, nil
+}
+
+func (p *parser) parseAnd() (node, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.consume("&&") {
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = and{left, right}
+	}
+
+	return left, nil
+}
+
+func (p *parser) parseUnary() (node, error) {
+	if p.consume("!") {
+		n, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return not{n}, nil
+	}
+
+	if p.consume("(") {
+		n, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if !p.consume(")") {
+			return nil, p.errorf("missing closing parenthesis")
+		}
+		return n, nil
+	}
+
+	return p.parseComparison()
+}
+
+var operators = []string{"==", "!=", "<=", ">=", "<", ">"}
+
+func (p *parser) parseComparison() (node, error) {
+	path, err := p.parsePath()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, operator := range operators {
+		if p.consume(operator) {
+			value, err := p.parseLiteral()
+			if err != nil {
+				return nil, err
+			}
+			return comparison{path, operator, value}, nil
+		}
+	}
+
+	return exists{path}, nil
+}
+
+func (p *parser) parsePath() (string, error) {
+	p.skipSpace()
+
+	start := p.pos
+	for p.pos < len(p.input) && isPathChar(rune(p.input[p.pos])) {
+		p.pos++
+	}
+
+	path := p.input[start:p.pos]
+	if path == "" || strings.HasPrefix(path, ".") || strings.HasSuffix(path, ".") || strings.Contains(path, "..") {
+		return "", p.errorf("invalid path %q", path)
+	}
+
+	return path, nil
+}
+
+func isPathChar(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' || r == '-' || r == '.'
+}
+
+func (p *parser) parseLiteral() (interface{}, error) {
+	p.skipSpace()
+
+	if p.pos >= len(p.input) {
+		return nil, p.errorf("missing value")
+	}
+
+	// Single-quoted strings are converted to JSON strings
+	if p.input[p.pos] == '\'' {
+		end := strings.IndexByte(p.input[p.pos+1:], '\'')
+		if end < 0 {
+			return nil, p.errorf("unterminated string")
+		}
+		value := p.input[p.pos+1 : p.pos+1+end]
+		p.pos += end + 2
+		return value, nil
+	}
+
+	// Otherwise let the JSON decoder read a single scalar value
+	decoder := json.NewDecoder(strings.NewReader(p.input[p.pos:]))
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return nil, p.errorf("invalid value: %s", err)
+	}
+
+	switch value.(type) {
+	case map[string]interface{}, []interface{}:
+		return nil, p.errorf("only strings, numbers, booleans and null can be compared")
+	}
+
+	p.pos += int(decoder.InputOffset())
+
+	return value, nil
+}
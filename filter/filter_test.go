@@ -0,0 +1,82 @@
+package filter_test
+
+import (
+	"testing"
+
+	"github.com/mullvad/message-queue/filter"
+	"github.com/mullvad/message-queue/message"
+)
+
+const payload = `{"account":{"id":"1234"},"amount":150,"flagged":false,"tags":["a","b"],"note":null}`
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		Expression string
+		Expected   bool
+	}{
+		{`account.id == "1234"`, true},
+		{`account.id == '1234'`, true},
+		{`account.id=="4321"`, false},
+		{`account.id != "4321"`, true},
+		{`amount >= 100`, true},
+		{`amount < 100`, false},
+		{`amount > 100&&flagged==false`, true},
+		{`amount > 1000 || flagged == true`, false},
+		{`(amount > 1000 || flagged == false) && account.id == '1234'`, true},
+		{`!flagged == true`, true},
+		{`tags.1 == "b"`, true},
+		{`note == null`, true},
+		{`account`, true},
+		{`missing`, false},
+		{`!missing`, true},
+		{`missing != "foo"`, false},
+		{`account == "1234"`, false},
+		{`amount > "100"`, false},
+	}
+
+	m := message.New("test", []byte(payload))
+
+	for _, test := range tests {
+		f, err := filter.Parse(test.Expression)
+		if err != nil {
+			t.Errorf("%s: %s", test.Expression, err)
+			continue
+		}
+
+		if f.Match(m) != test.Expected {
+			t.Errorf("%s: expected %v", test.Expression, test.Expected)
+		}
+	}
+
+	t.Run("non-json payload", func(t *testing.T) {
+		f, err := filter.Parse(`account.id == "1234"`)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if f.Match(message.New("test", []byte("foobar"))) {
+			t.Error("matched non-json payload")
+		}
+	})
+}
+
+func TestParse(t *testing.T) {
+	invalid := []string{
+		``,
+		`account.id ==`,
+		`account.id == "1234`,
+		`account.id == '1234`,
+		`account.id == {"foo":"bar"}`,
+		`(account.id == "1234"`,
+		`account.id == "1234" &&`,
+		`account..id`,
+		`.account`,
+		`account.id == "1234" foo`,
+	}
+
+	for _, expression := range invalid {
+		if _, err := filter.Parse(expression); err == nil {
+			t.Errorf("%s: no error", expression)
+		}
+	}
+}
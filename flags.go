@@ -0,0 +1,263 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/mullvad/message-queue/config"
+)
+
+// channelFlags are the commandline flags configuring the channels, which are comma-delimited lists
+type channelFlags struct {
+	channels        string
+	virtual         string
+	conflate        string
+	snapshot        string
+	snapshotKeys    string
+	work            string
+	dedup           string
+	routes          string
+	keyspace        string
+	keyspaceEnable  string
+	sentinelAddrs   string
+	clusterAddrs    string
+	mirrorAddresses string
+
+	tls           bool
+	tlsCAFile     string
+	tlsCertFile   string
+	tlsKeyFile    string
+	tlsServerName string
+	sentinelTLS   bool
+
+	replayFile  string
+	replaySpeed float64
+	replayLoop  bool
+}
+
+// registerFlags sets up the commandline flags, where the settings are stored in the configuration directly
+func registerFlags(c *config.Config) *channelFlags {
+	f := &channelFlags{}
+
+	flag.StringVar(&c.Listen, "listen", c.Listen, "listen address")
+	flag.IntVar(&c.BufferSize, "buffer-size", c.BufferSize, "client buffer size")
+	flag.StringVar(&c.Redis.SentinelService, "redis-sentinel-service", "", "redis sentinel service name")
+	flag.StringVar(&f.sentinelAddrs, "redis-sentinel-addresses", "", "comma-delimited list of redis sentinel addresses, may contain authentication details")
+	flag.StringVar(&f.clusterAddrs, "redis-cluster-addresses", "", "comma-delimited list of addresses of redis cluster nodes, to connect to a redis cluster using sharded pubsub, or classic pubsub if not supported")
+	flag.StringVar(&c.Redis.ServerAddress, "redis-server-address", "", "address for the redis server to connect to redis directly (without redis sentinel)")
+	flag.StringVar(&c.Redis.Password, "redis-server-password", "", "password for the redis servers managed by redis sentinel")
+	flag.StringVar(&c.Redis.Username, "redis-server-username", "", "redis 6 ACL username for the redis servers, the default user if not set")
+	flag.BoolVar(&f.tls, "redis-tls", false, "connect to the redis servers using TLS, which is implied by the other TLS options")
+	flag.StringVar(&f.tlsCAFile, "redis-tls-ca-file", "", "PEM file with the CA certificates to verify the redis servers with, instead of the system CAs")
+	flag.StringVar(&f.tlsCertFile, "redis-tls-cert-file", "", "PEM file with the client certificate for mutual TLS")
+	flag.StringVar(&f.tlsKeyFile, "redis-tls-key-file", "", "PEM file with the key of the client certificate for mutual TLS")
+	flag.StringVar(&f.tlsServerName, "redis-tls-server-name", "", "name to verify the certificates of the redis servers against, instead of their addresses")
+	flag.BoolVar(&c.Redis.Replicas, "redis-sentinel-replicas", false, "subscribe on a replica rather than the primary managed by redis sentinel, if any are available")
+	flag.StringVar(&c.Redis.SentinelUsername, "redis-sentinel-username", "", "redis 6 ACL username for the redis sentinels, used instead of any authentication details in the sentinel addresses")
+	flag.StringVar(&c.Redis.SentinelPassword, "redis-sentinel-password", "", "password for the redis sentinels, used instead of any authentication details in the sentinel addresses")
+	flag.BoolVar(&f.sentinelTLS, "redis-sentinel-tls", false, "connect to the redis sentinels using TLS, with the same TLS options as the redis servers")
+	flag.StringVar(&f.virtual, "virtual-channels", "", "comma-delimited list of channel=source+source pairs, of channels combining the messages of several redis channels")
+	flag.StringVar(&f.routes, "route-channels", "", "comma-delimited list of source=prefix{key} pairs, routing the messages of a redis channel into channels named after the prefix and the key of every message, e.g. 'orders=orders.{customer.id}'. The key is either a path to a JSON field, 'prefix:<separator>', 'header:<name>' or 'regex:<expression>' using the first submatch")
+	flag.DurationVar(&c.RouteIdleTimeout, "route-idle-timeout", c.RouteIdleTimeout, "how long routed channels without messages or subscribers are kept")
+	flag.StringVar(&f.mirrorAddresses, "redis-mirror-addresses", "", "comma-delimited list of addresses of redundant redis servers publishing the same channels, which are subscribed to as well")
+	flag.StringVar(&f.keyspace, "keyspace-channels", "", "comma-delimited list of channel=pattern pairs, of channels fed by the keyspace notifications of the keys matching the glob-style pattern, e.g. 'sessions=session:*'")
+	flag.StringVar(&f.keyspaceEnable, "keyspace-events", "", "notify-keyspace-events flags to add on the redis servers for the channels configured with '-keyspace-channels', e.g. 'Kx' for expired keys")
+	flag.StringVar(&f.channels, "channels", "", "comma-delimited list of channels to listen and broadcast to")
+	flag.StringVar(&f.conflate, "conflate-channels", "", "comma-delimited list of channel=key pairs, where slow subscribers only get the latest message per key. The key is either a path to a JSON field, 'prefix:<separator>' for payloads prefixed with their key, or 'header:<name>'")
+	flag.StringVar(&f.snapshot, "snapshot-channels", "", "comma-delimited list of channels, or channel=key pairs, where new subscribers get the latest message, or the latest message per key, before any new messages")
+	flag.StringVar(&f.work, "work-channels", "", "comma-delimited list of channel=dispatch pairs, where every message is delivered to exactly one subscriber. The dispatch is either 'round-robin' or 'least-loaded'")
+	flag.StringVar(&f.dedup, "dedup-channels", "", "comma-delimited list of channels, or channel=key pairs, where messages with the same ID as a recent message are dropped. The ID is the key, or the hash of the payload if not set, and the key is either a path to a JSON field, 'prefix:<separator>' or 'header:<name>'")
+	flag.DurationVar(&c.DedupWindow, "dedup-window", c.DedupWindow, "how long message IDs are remembered on channels configured with '-dedup-channels'")
+	flag.DurationVar(&c.AckTimeout, "ack-timeout", c.AckTimeout, "how long clients have to acknowledge messages on work channels before they're redelivered")
+	flag.DurationVar(&c.SessionRetention, "session-retention", c.SessionRetention, "how long the sessions of disconnected clients are kept, with their unacknowledged messages and inbox, for them to resume")
+	flag.IntVar(&c.InboxMessages, "inbox-messages", c.InboxMessages, "how many messages are kept for disconnected clients with a session, or 0 to disable the inbox")
+	flag.IntVar(&c.InboxBytes, "inbox-bytes", c.InboxBytes, "how many payload bytes are kept for disconnected clients with a session, or 0 for no limit")
+	flag.StringVar(&f.snapshotKeys, "snapshot-keys", "", "comma-delimited list of channel=key pairs, of redis hashes or strings to seed the snapshots of channels with on startup")
+	flag.StringVar(&c.History.Dir, "history-dir", "", "directory to keep a log of the messages of every channel in, for clients to resume from across restarts")
+	flag.IntVar(&c.History.Messages, "history-size", 0, "number of messages of every channel to keep in memory when '-history-dir' isn't set, for clients to resume from or query")
+	flag.Int64Var(&c.History.SegmentSize, "history-segment-size", c.History.SegmentSize, "size in bytes of the history log segments")
+	flag.Int64Var(&c.History.MaxBytes, "history-max-bytes", 0, "size in bytes of the history kept per channel, or 0 for no limit")
+	flag.DurationVar(&c.History.MaxAge, "history-max-age", 0, "how long history is kept, or 0 for no limit")
+	flag.DurationVar(&c.History.SyncInterval, "history-sync-interval", 0, "how often the history on disk is synced, or 0 to sync after every message")
+	flag.StringVar(&f.replayFile, "replay-file", "", "recording made with the record command to replay into the channels, instead of connecting to redis")
+	flag.Float64Var(&f.replaySpeed, "replay-speed", 1, "multiplier of the original timing of the recording, e.g. 2 for twice as fast, or 0 to replay it as fast as possible")
+	flag.BoolVar(&f.replayLoop, "replay-loop", false, "start over at the end of the recording")
+	flag.StringVar(&c.StatsdAddress, "statsd-address", c.StatsdAddress, "statsd address to send metrics to")
+
+	return f
+}
+
+// apply adds the channels, routes and redis addresses from the commandline flags to the configuration
+func (f *channelFlags) apply(c *config.Config) error {
+	if f.sentinelAddrs != "" {
+		c.Redis.SentinelAddresses = strings.Split(f.sentinelAddrs, ",")
+	}
+
+	if f.clusterAddrs != "" {
+		c.Redis.ClusterAddresses = strings.Split(f.clusterAddrs, ",")
+	}
+
+	if f.mirrorAddresses != "" {
+		c.Redis.MirrorAddresses = strings.Split(f.mirrorAddresses, ",")
+	}
+
+	if f.tls || f.tlsCAFile != "" || f.tlsCertFile != "" || f.tlsKeyFile != "" || f.tlsServerName != "" {
+		c.Redis.TLS = &config.TLS{
+			CAFile:     f.tlsCAFile,
+			CertFile:   f.tlsCertFile,
+			KeyFile:    f.tlsKeyFile,
+			ServerName: f.tlsServerName,
+		}
+	}
+
+	if f.replayFile != "" {
+		c.Replay = &config.Replay{
+			File:  f.replayFile,
+			Speed: f.replaySpeed,
+			Fast:  f.replaySpeed == 0,
+			Loop:  f.replayLoop,
+		}
+	}
+
+	if f.sentinelTLS {
+		c.Redis.SentinelTLS = &config.TLS{
+			CAFile:   f.tlsCAFile,
+			CertFile: f.tlsCertFile,
+			KeyFile:  f.tlsKeyFile,
+		}
+	}
+
+	pairs := make(map[string]map[string]string)
+	for _, list := range []struct {
+		name          string
+		value         string
+		valueRequired bool
+	}{
+		{"virtual-channels", f.virtual, true},
+		{"conflate-channels", f.conflate, true},
+		{"snapshot-channels", f.snapshot, false},
+		{"snapshot-keys", f.snapshotKeys, true},
+		{"work-channels", f.work, true},
+		{"dedup-channels", f.dedup, false},
+		{"route-channels", f.routes, true},
+		{"keyspace-channels", f.keyspace, true},
+	} {
+		parsed, err := parseChannelPairs(list.value, list.valueRequired)
+		if err != nil {
+			return fmt.Errorf("invalid '-%s': %s", list.name, err)
+		}
+		pairs[list.name] = parsed
+	}
+
+	channels := make(map[string]*config.Channel)
+	var names []string
+	add := func(name string, sources []string) {
+		channels[name] = &config.Channel{Name: name, Sources: sources}
+		names = append(names, name)
+	}
+
+	if f.channels != "" {
+		for _, name := range strings.Split(f.channels, ",") {
+			add(name, nil)
+		}
+	}
+
+	for _, name := range sortedKeys(pairs["virtual-channels"]) {
+		add(name, strings.Split(pairs["virtual-channels"][name], "+"))
+	}
+
+	for _, name := range sortedKeys(pairs["keyspace-channels"]) {
+		add(name, nil)
+		channels[name].Keyspace = &config.Keyspace{Pattern: pairs["keyspace-channels"][name], Enable: f.keyspaceEnable}
+	}
+
+	// lookup returns the channel configured by one of the flags
+	lookup := func(flagName, name string) (*config.Channel, error) {
+		channel, ok := channels[name]
+		if !ok {
+			return nil, fmt.Errorf("invalid '-%s': unknown channel %q", flagName, name)
+		}
+		return channel, nil
+	}
+
+	for flagName, values := range pairs {
+		for name, value := range values {
+			if flagName == "virtual-channels" || flagName == "route-channels" || flagName == "keyspace-channels" {
+				continue
+			}
+
+			channel, err := lookup(flagName, name)
+			if err != nil {
+				return err
+			}
+
+			switch flagName {
+			case "conflate-channels":
+				channel.SlowConsumer = "conflate"
+				channel.ConflateKey = value
+			case "snapshot-channels":
+				if channel.Snapshot == nil {
+					channel.Snapshot = &config.Snapshot{}
+				}
+				channel.Snapshot.Key = value
+			case "snapshot-keys":
+				if _, ok := pairs["snapshot-channels"][name]; !ok {
+					return fmt.Errorf("%q: snapshot key configured for channel without snapshot", name)
+				}
+				if channel.Snapshot == nil {
+					channel.Snapshot = &config.Snapshot{}
+				}
+				channel.Snapshot.Seed = value
+			case "work-channels":
+				channel.Dispatch = value
+			case "dedup-channels":
+				channel.Dedup = &config.Dedup{Key: value}
+			}
+		}
+	}
+
+	for _, name := range names {
+		c.Channels = append(c.Channels, *channels[name])
+	}
+
+	for _, source := range sortedKeys(pairs["route-channels"]) {
+		c.Routes = append(c.Routes, config.Route{Source: source, Channel: pairs["route-channels"][source]})
+	}
+
+	return nil
+}
+
+// parseChannelPairs parses a comma-delimited list of channel=value pairs
+// If the value isn't required, the channel may be given on its own, resulting in an empty value
+func parseChannelPairs(list string, valueRequired bool) (map[string]string, error) {
+	pairs := make(map[string]string)
+	if list == "" {
+		return pairs, nil
+	}
+
+	for _, pair := range strings.Split(list, ",") {
+		parts := strings.SplitN(pair, "=", 2)
+		if parts[0] == "" || (valueRequired && (len(parts) != 2 || parts[1] == "")) {
+			return nil, fmt.Errorf("%q: expected channel=value", pair)
+		}
+
+		if len(parts) == 2 {
+			pairs[parts[0]] = parts[1]
+		} else {
+			pairs[parts[0]] = ""
+		}
+	}
+
+	return pairs, nil
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
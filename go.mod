@@ -10,5 +10,6 @@ require (
 	github.com/prometheus/client_golang v1.12.1
 	github.com/spf13/cobra v0.0.5 // indirect
 	github.com/spf13/pflag v1.0.5 // indirect
+	gopkg.in/yaml.v3 v3.0.1
 	nhooyr.io/websocket v1.7.2
 )
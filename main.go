@@ -2,21 +2,27 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"runtime"
-	"strings"
 	"syscall"
 	"time"
 
 	"github.com/infosum/statsd"
+	"github.com/mullvad/message-queue/config"
+	"github.com/mullvad/message-queue/message"
 	"github.com/mullvad/message-queue/pubsub"
 	"github.com/mullvad/message-queue/queue"
+	"github.com/mullvad/message-queue/record"
+	"github.com/mullvad/message-queue/wal"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
@@ -57,15 +63,22 @@ var (
 )
 
 func main() {
+	// Run the tools for inspecting and benchmarking servers, rather than the server, if asked to
+	if len(os.Args) > 1 {
+		if command, ok := commands[os.Args[1]]; ok {
+			if err := command(os.Args[2:]); err != nil {
+				fmt.Fprintf(os.Stderr, "%s: %s\n", os.Args[1], err)
+				os.Exit(1)
+			}
+			return
+		}
+	}
+
 	// Set up commandline flags
-	listen := flag.String("listen", ":8080", "listen address")
-	bufferSize := flag.Int("buffer-size", 100, "client buffer size")
-	redisSentinelService := flag.String("redis-sentinel-service", "", "redis sentinel service name")
-	redisSentinelAddrs := flag.String("redis-sentinel-addresses", "", "comma-delimited list of redis sentinel addresses, may contain authentication details")
-	redisServerAddress := flag.String("redis-server-address", "", "address for the redis server to connect to redis directly (without redis sentinel)")
-	redisPassword := flag.String("redis-server-password", "", "password for the redis servers managed by redis sentinel")
-	channels := flag.String("channels", "", "comma-delimited list of channels to listen and broadcast to")
-	statsdAddress := flag.String("statsd-address", "127.0.0.1:8125", "statsd address to send metrics to")
+	configPath := flag.String("config", "", "path to a YAML configuration file, used instead of the other options. It's reloaded on SIGHUP")
+	watchInterval := flag.Duration("config-watch-interval", time.Second*10, "how often the configuration file is checked for changes to reload, or 0 to only reload it on SIGHUP")
+	cfg := config.Default()
+	channelFlags := registerFlags(cfg)
 
 	// Parse environment variables
 	envy.Parse("MQ")
@@ -73,31 +86,23 @@ func main() {
 	// Parse commandline flags
 	flag.Parse()
 
-	if *redisSentinelAddrs == "" && *redisServerAddress == "" {
-		log.Fatalf("either '-redis-sentinel-addresses' or '-redis-server-address' is required")
-	}
-
-	if *redisSentinelAddrs != "" && *redisServerAddress != "" {
-		log.Fatalf("'-redis-sentinel-addresses' and '-redis-server-address' are incompatible")
-	}
-
-	if *redisSentinelAddrs != "" && *redisSentinelService == "" {
-		log.Fatalf("'-redis-sentinel-service' is required when using redis sentinel")
+	var err error
+	if *configPath != "" {
+		cfg, err = config.Load(*configPath)
+	} else {
+		err = channelFlags.apply(cfg)
+		if err == nil {
+			err = cfg.Validate()
+		}
 	}
-
-	redisSentinelAddrList := strings.Split(*redisSentinelAddrs, ",")
-
-	if *channels == "" {
-		log.Fatalf("no channels configured")
+	if err != nil {
+		log.Fatalf("invalid configuration: %s", err)
 	}
 
-	channelList := strings.Split(*channels, ",")
-
 	log.Printf("starting message-queue")
 
 	// Initialize metrics
-	var err error
-	metrics, err = statsd.New(statsd.TagsFormat(statsd.Datadog), statsd.Prefix("mq"), statsd.Address(*statsdAddress))
+	metrics, err = statsd.New(statsd.TagsFormat(statsd.Datadog), statsd.Prefix("mq"), statsd.Address(cfg.StatsdAddress))
 	if err != nil {
 		log.Fatal("Error initializing metrics: ", err)
 	}
@@ -107,25 +112,50 @@ func main() {
 	shutdownCtx, shutdown := context.WithCancel(context.Background())
 	defer shutdown()
 
-	// Set up the pubsub listener
-	if *redisSentinelService != "" {
-		p, err = pubsub.NewWithSentinel(*redisSentinelService, redisSentinelAddrList, *redisPassword)
+	// Set up the pubsub listeners, or the recording replayed instead
+	var mirrors []*pubsub.PubSub
+	var replay *record.Source
+	var recording *os.File
+	if cfg.Replay != nil {
+		recording, err = os.Open(cfg.Replay.File)
+		if err != nil {
+			log.Fatal("error opening recording: ", err)
+		}
+		replay = record.NewSource()
 	} else {
-		p, err = pubsub.New(*redisServerAddress, *redisPassword)
-	}
-	if err != nil {
-		log.Fatal("error initializing pubsub: ", err)
+		p, mirrors = connectRedis(cfg)
 	}
 
 	// Set up the queue
-	q = queue.New(shutdownCtx, *bufferSize)
+	q = queue.New(shutdownCtx, cfg.BufferSize)
 
-	// Set up the message passing from redis pubsub to the queue
-	err = setupChannels(shutdownCtx, channelList)
-	if err != nil {
+	api := api.New(q)
+	api.PingInterval = cfg.PingInterval
+	api.PingTimeout = cfg.PingTimeout
+	api.AckTimeout = cfg.AckTimeout
+	api.SessionRetention = cfg.SessionRetention
+	api.InboxMessages = cfg.InboxMessages
+	api.InboxBytes = cfg.InboxBytes
+	var pubsubs []*pubsub.PubSub
+	if replay != nil {
+		api.Publisher = replay
+	} else {
+		api.Publisher = p
+		pubsubs = append([]*pubsub.PubSub{p}, mirrors...)
+	}
+
+	// Set up the message passing from redis pubsub to the queue, and the routing to dynamically created channels
+	s := newState(shutdownCtx, pubsubs, replay, api)
+	defer s.close()
+
+	if err := s.apply(cfg); err != nil {
 		log.Fatal("error initializing queue: ", err)
 	}
 
+	if replay != nil {
+		go playRecording(shutdownCtx, replay, recording, *cfg.Replay)
+	}
+
 	// Create a ticker for metrics
 	ticker := time.NewTicker(time.Minute)
 	go func() {
@@ -140,19 +170,18 @@ func main() {
 		}
 	}()
 
-	// Expose prometheus metrics
+	// Expose prometheus metrics, and the stats queried by the stats command
 	go func() {
 		log.Printf("Exposing metrics on port 9999")
 		server := http.NewServeMux()
 		server.Handle("/metrics", promhttp.Handler())
+		server.HandleFunc("/stats", handleStats)
 		log.Fatal(http.ListenAndServe(":9999", server))
 	}()
 
 	// Start and listen on http
-	api := api.New(q)
-
 	server := &http.Server{
-		Addr:    *listen,
+		Addr:    cfg.Listen,
 		Handler: api.Router(),
 	}
 
@@ -163,10 +192,24 @@ func main() {
 		}
 	}()
 
-	log.Printf("http server listening on %s", *listen)
+	log.Printf("http server listening on %s", cfg.Listen)
+
+	// Reload the configuration file when it changes
+	var changes <-chan struct{}
+	if *configPath != "" && *watchInterval > 0 {
+		changes = watchFile(shutdownCtx, *configPath, *watchInterval)
+	}
 
-	// Wait for shutdown or error
-	err = waitForInterrupt(shutdownCtx)
+	reload := func() {
+		if *configPath == "" {
+			log.Println("not reloading, no configuration file")
+			return
+		}
+		s.reload(*configPath)
+	}
+
+	// Wait for shutdown or error, reloading the configuration on SIGHUP
+	err = waitForInterrupt(shutdownCtx, changes, reload)
 	log.Println("shutting down", err)
 
 	// Shut down http server
@@ -177,25 +220,230 @@ func main() {
 	}
 }
 
-func setupChannels(ctx context.Context, channels []string) error {
-	for _, channel := range channels {
-		in, err := p.Subscribe(channel)
+// connectRedis sets up the pubsub listener for the redis servers, and for the redundant ones
+func connectRedis(cfg *config.Config) (*pubsub.PubSub, []*pubsub.PubSub) {
+	redisOptions, err := setupRedisOptions(cfg.Redis)
+	if err != nil {
+		log.Fatal("error initializing pubsub: ", err)
+	}
+
+	var primary *pubsub.PubSub
+	if len(cfg.Redis.ClusterAddresses) > 0 {
+		primary, err = pubsub.NewWithCluster(cfg.Redis.ClusterAddresses, cfg.Redis.Password, redisOptions...)
+	} else if cfg.Redis.SentinelService != "" {
+		sentinelOptions := append([]pubsub.Option{pubsub.WithFailoverHandler(failoverMetrics)}, redisOptions...)
+		if cfg.Redis.Replicas {
+			sentinelOptions = append(sentinelOptions, pubsub.WithReplicas())
+		}
+		primary, err = pubsub.NewWithSentinel(cfg.Redis.SentinelService, cfg.Redis.SentinelAddresses, cfg.Redis.Password, sentinelOptions...)
+	} else {
+		primary, err = pubsub.New(cfg.Redis.ServerAddress, cfg.Redis.Password, redisOptions...)
+	}
+	if err != nil {
+		log.Fatal("error initializing pubsub: ", err)
+	}
+
+	// Set up the pubsub listeners for the redundant redis servers
+	var mirrors []*pubsub.PubSub
+	for _, address := range cfg.Redis.MirrorAddresses {
+		mirror, err := pubsub.New(address, cfg.Redis.Password, redisOptions...)
+		if err != nil {
+			log.Fatal("error initializing pubsub: ", err)
+		}
+		mirrors = append(mirrors, mirror)
+	}
+
+	return primary, mirrors
+}
+
+// playRecording replays the recording into the channels, starting over at the end if configured to, until the
+// context has ended
+func playRecording(ctx context.Context, replay *record.Source, recording *os.File, cfg config.Replay) {
+	for {
+		err := replay.Play(ctx, record.NewReader(recording), cfg.Multiplier())
+		recording.Close()
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			log.Printf("error replaying %s: %s", cfg.File, err)
+			return
+		}
+
+		if !cfg.Loop {
+			log.Printf("finished replaying %s", cfg.File)
+			return
+		}
+
+		if recording, err = os.Open(cfg.File); err != nil {
+			log.Printf("error opening recording: %s", err)
+			return
+		}
+	}
+}
+
+// setupRedisOptions creates the options for authenticating with redis, and connecting to it using TLS
+func setupRedisOptions(redis config.Redis) ([]pubsub.Option, error) {
+	var options []pubsub.Option
+
+	if redis.Username != "" {
+		options = append(options, pubsub.WithUsername(redis.Username))
+	}
+
+	tlsConfig, err := redis.TLS.Config()
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig != nil {
+		options = append(options, pubsub.WithTLS(tlsConfig))
+	}
+
+	if redis.SentinelUsername != "" || redis.SentinelPassword != "" {
+		options = append(options, pubsub.WithSentinelAuth(redis.SentinelUsername, redis.SentinelPassword))
+	}
+
+	sentinelTLSConfig, err := redis.SentinelTLS.Config()
+	if err != nil {
+		return nil, err
+	}
+	if sentinelTLSConfig != nil {
+		options = append(options, pubsub.WithSentinelTLS(sentinelTLSConfig))
+	}
+
+	return options, nil
+}
+
+// failoverMetrics counts the failovers of the primary managed by redis sentinel, and times them
+func failoverMetrics(f pubsub.Failover) {
+	metrics.Increment("redis.failovers")
+	metrics.Timing("redis.failover_duration", int(f.Duration()/time.Millisecond))
+}
+
+// setupChannelOptions creates the queue options for a channel, seeding its snapshot from redis, and opens the log of
+// its history if it's kept on disk
+func setupChannelOptions(cfg *config.Config, channel config.Channel) ([]queue.ChannelOption, *wal.Log, error) {
+	var options []queue.ChannelOption
+
+	if channel.BufferSize > 0 {
+		options = append(options, queue.WithBufferSize(channel.BufferSize))
+	}
+
+	if channel.MaxSubscribers > 0 {
+		options = append(options, queue.WithMaxSubscribers(channel.MaxSubscribers))
+	}
+
+	if channel.Dedup != nil {
+		var keyFunc queue.KeyFunc
+		if channel.Dedup.Key != "" {
+			var err error
+			keyFunc, err = config.ParseKey(channel.Dedup.Key)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+
+		options = append(options, queue.WithDeduplication(keyFunc, cfg.DedupWindow))
+	}
+
+	dispatch, err := channel.DispatchMode()
+	if err != nil {
+		return nil, nil, err
+	}
+	options = append(options, queue.WithDispatch(dispatch))
+
+	if channel.SlowConsumer == "conflate" {
+		keyFunc, err := config.ParseKey(channel.ConflateKey)
 		if err != nil {
-			return err
+			return nil, nil, err
 		}
 
-		out, err := q.CreateChannel(channel)
+		options = append(options, queue.WithConflation(keyFunc))
+	}
+
+	if channel.Snapshot != nil {
+		var initial []*message.Message
+		if channel.Snapshot.Seed != "" {
+			initial, err = p.Snapshot(channel.Name, channel.Snapshot.Seed)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+
+		var keyFunc queue.KeyFunc
+		if channel.Snapshot.Key != "" {
+			keyFunc, err = config.ParseKey(channel.Snapshot.Key)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+
+		options = append(options, queue.WithSnapshot(keyFunc, initial...))
+	}
+
+	// Keep the history on disk if configured, and otherwise in memory
+	retention := config.Retention{
+		Messages: cfg.History.Messages,
+		MaxBytes: cfg.History.MaxBytes,
+		MaxAge:   cfg.History.MaxAge,
+	}
+	if channel.Retention != nil {
+		retention = *channel.Retention
+	}
+
+	if cfg.History.Dir != "" {
+		l, err := wal.Open(filepath.Join(cfg.History.Dir, url.PathEscape(channel.Name)), wal.Options{
+			SegmentSize:  cfg.History.SegmentSize,
+			MaxBytes:     retention.MaxBytes,
+			MaxAge:       retention.MaxAge,
+			SyncInterval: cfg.History.SyncInterval,
+		})
 		if err != nil {
-			return err
+			return nil, nil, err
 		}
 
-		go channelWorker(ctx, in, out)
+		return append(options, queue.WithHistory(l)), l, nil
 	}
 
-	return nil
+	if retention.Messages > 0 {
+		options = append(options, queue.WithHistory(queue.NewMemoryHistory(retention.Messages)))
+	}
+
+	return options, nil, nil
+}
+
+// channelSettings returns the settings of the running channels for the API
+func channelSettings(channels map[string]*channelState) map[string]api.ChannelSettings {
+	settings := make(map[string]api.ChannelSettings)
+	for _, c := range channels {
+		channel := c.config
+
+		var tokens []string
+		if channel.Auth != nil {
+			tokens = channel.Auth.Tokens
+		}
+
+		var publish *api.PublishSettings
+		if channel.Publish != nil {
+			publish = &api.PublishSettings{
+				Channel: channel.PublishChannel(),
+				Tokens:  channel.Publish.Tokens,
+				MaxSize: channel.Publish.MaxSize,
+				Schema:  c.schema,
+				Rate:    channel.Publish.Rate,
+				Burst:   channel.Publish.Burst,
+			}
+		}
+
+		settings[channel.Name] = api.ChannelSettings{
+			PingInterval: channel.PingInterval,
+			Tokens:       tokens,
+			Publish:      publish,
+		}
+	}
+	return settings
 }
 
-func channelWorker(ctx context.Context, in <-chan []byte, out chan<- []byte) {
+func channelWorker(ctx context.Context, in <-chan *message.Message, out chan<- *message.Message) {
 	defer func() {
 		close(out)
 	}()
@@ -218,13 +466,44 @@ func collectMetrics() {
 	metrics.Gauge("subscribers", q.SubscriberCount())
 }
 
-func waitForInterrupt(ctx context.Context) error {
+// stats are the current numbers of subscribers, in total and on every channel
+type stats struct {
+	Subscribers int            `json:"subscribers"`
+	Channels    map[string]int `json:"channels"`
+}
+
+// handleStats returns the stats as JSON
+func handleStats(w http.ResponseWriter, r *http.Request) {
+	s := stats{
+		Subscribers: q.SubscriberCount(),
+		Channels:    make(map[string]int),
+	}
+	for _, channel := range q.Channels() {
+		s.Channels[channel] = q.ChannelSubscriberCount(channel)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(s); err != nil {
+		log.Println("error sending stats", err)
+	}
+}
+
+// waitForInterrupt waits for a signal to shut down or the context to end, and reloads on SIGHUP or changes
+func waitForInterrupt(ctx context.Context, changes <-chan struct{}, reload func()) error {
 	c := make(chan os.Signal, 1)
-	signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
-	select {
-	case sig := <-c:
-		return fmt.Errorf("received signal %s", sig)
-	case <-ctx.Done():
-		return errors.New("canceled")
+	signal.Notify(c, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	for {
+		select {
+		case sig := <-c:
+			if sig == syscall.SIGHUP {
+				reload()
+				continue
+			}
+			return fmt.Errorf("received signal %s", sig)
+		case <-changes:
+			reload()
+		case <-ctx.Done():
+			return errors.New("canceled")
+		}
 	}
 }
@@ -0,0 +1,176 @@
+package message
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Message is a message passed from a source, through the queue, to the subscribers of a channel
+type Message struct {
+	Sequence    uint64            // Assigned by the queue, increasing for every message on a queue channel
+	Time        time.Time         // The time the message was received from its source
+	Channel     string            // The source channel the message was received on
+	ContentType string            // The content type of the payload, if known
+	Headers     map[string]string // Optional metadata about the message
+	Payload     []byte            // Must not be modified once the message has been passed on
+	// Gap marks a control message without a payload, telling that messages may have been lost before it, such as while
+	// reconnecting to the source, and that subscribers should resync their state
+	Gap bool
+
+	decoded *decoded // The lazily decoded JSON payload, shared between copies of the message
+}
+
+type decoded struct {
+	once  sync.Once
+	value interface{}
+	err   error
+}
+
+// New creates a new message received on the given source channel
+func New(channel string, payload []byte) *Message {
+	return &Message{
+		Time:    time.Now(),
+		Channel: channel,
+		Payload: payload,
+		decoded: &decoded{},
+	}
+}
+
+// NewGap creates a control message telling that messages may have been lost on the given source channel
+func NewGap(channel string) *Message {
+	return &Message{
+		Time:    time.Now(),
+		Channel: channel,
+		Gap:     true,
+		decoded: &decoded{},
+	}
+}
+
+// JSON returns the payload decoded as JSON
+// The payload is only decoded once for messages created with New, no matter how many times it's called
+func (m *Message) JSON() (interface{}, error) {
+	if m.decoded == nil {
+		return decodeJSON(m.Payload)
+	}
+
+	m.decoded.once.Do(func() {
+		m.decoded.value, m.decoded.err = decodeJSON(m.Payload)
+	})
+
+	return m.decoded.value, m.decoded.err
+}
+
+func decodeJSON(payload []byte) (value interface{}, err error) {
+	err = json.Unmarshal(payload, &value)
+	return
+}
+
+// Field looks up a field in the JSON payload by a dot-delimited path, such as "account.id" or "items.0.name"
+// Returns false if the payload isn't JSON, or the field doesn't exist
+func (m *Message) Field(path string) (interface{}, bool) {
+	value, err := m.JSON()
+	if err != nil {
+		return nil, false
+	}
+
+	if path == "" {
+		return value, true
+	}
+
+	for _, key := range strings.Split(path, ".") {
+		switch v := value.(type) {
+		case map[string]interface{}:
+			field, ok := v[key]
+			if !ok {
+				return nil, false
+			}
+			value = field
+		case []interface{}:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(v) {
+				return nil, false
+			}
+			value = v[i]
+		default:
+			return nil, false
+		}
+	}
+
+	return value, true
+}
+
+// envelope is the JSON representation of a message
+// The payload is embedded as JSON if it's valid JSON, as a string if it's valid UTF-8, and base64 encoded otherwise
+type envelope struct {
+	Sequence    uint64            `json:"seq"`
+	Time        time.Time         `json:"time"`
+	Channel     string            `json:"channel,omitempty"`
+	ContentType string            `json:"content_type,omitempty"`
+	Headers     map[string]string `json:"headers,omitempty"`
+	Gap         bool              `json:"gap,omitempty"`
+	Payload     json.RawMessage   `json:"payload,omitempty"`
+	Text        *string           `json:"text,omitempty"`
+	Data        []byte            `json:"data,omitempty"`
+}
+
+// MarshalJSON encodes the message and its metadata as a JSON envelope
+func (m *Message) MarshalJSON() ([]byte, error) {
+	e := envelope{
+		Sequence:    m.Sequence,
+		Time:        m.Time,
+		Channel:     m.Channel,
+		ContentType: m.ContentType,
+		Headers:     m.Headers,
+		Gap:         m.Gap,
+	}
+
+	switch {
+	case m.Gap:
+		// Gaps have no payload
+	case json.Valid(m.Payload):
+		e.Payload = m.Payload
+	case utf8.Valid(m.Payload):
+		text := string(m.Payload)
+		e.Text = &text
+	default:
+		e.Data = m.Payload
+	}
+
+	return json.Marshal(e)
+}
+
+// UnmarshalJSON decodes a JSON envelope created by MarshalJSON
+func (m *Message) UnmarshalJSON(data []byte) error {
+	var e envelope
+	if err := json.Unmarshal(data, &e); err != nil {
+		return err
+	}
+
+	*m = Message{
+		Sequence:    e.Sequence,
+		Time:        e.Time,
+		Channel:     e.Channel,
+		ContentType: e.ContentType,
+		Headers:     e.Headers,
+		Gap:         e.Gap,
+	}
+
+	switch {
+	case e.Gap:
+	case e.Payload != nil:
+		m.Payload = []byte(e.Payload)
+	case e.Text != nil:
+		m.Payload = []byte(*e.Text)
+	case e.Data != nil:
+		m.Payload = e.Data
+	default:
+		return errors.New("message envelope has no payload")
+	}
+
+	return nil
+}
@@ -0,0 +1,109 @@
+package message_test
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mullvad/message-queue/message"
+)
+
+func TestEnvelope(t *testing.T) {
+	tests := []struct {
+		Name     string
+		Payload  []byte
+		Expected string
+	}{
+		{"json payload", []byte(`{"foo":"bar"}`), `"payload":{"foo":"bar"}`},
+		{"text payload", []byte("foobar"), `"text":"foobar"`},
+		{"binary payload", []byte{0xff, 0x00}, `"data":"/wA="`},
+		{"empty payload", []byte{}, `"text":""`},
+	}
+
+	for _, test := range tests {
+		m := &message.Message{
+			Sequence: 1,
+			Time:     time.Unix(0, 0).UTC(),
+			Channel:  "test",
+			Headers:  map[string]string{"foo": "bar"},
+			Payload:  test.Payload,
+		}
+
+		data, err := json.Marshal(m)
+		if err != nil {
+			t.Errorf("%s: %s", test.Name, err)
+			continue
+		}
+
+		if !strings.Contains(string(data), test.Expected) {
+			t.Errorf("%s: wrong envelope %s", test.Name, data)
+			continue
+		}
+
+		var decoded message.Message
+		if err := json.Unmarshal(data, &decoded); err != nil {
+			t.Errorf("%s: %s", test.Name, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(m, &decoded) {
+			t.Errorf("%s: wrong decoded message %#v", test.Name, decoded)
+		}
+	}
+}
+
+func TestGapEnvelope(t *testing.T) {
+	m := &message.Message{
+		Time:    time.Unix(0, 0).UTC(),
+		Channel: "test",
+		Gap:     true,
+	}
+
+	data, err := json.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if expected := `{"seq":0,"time":"1970-01-01T00:00:00Z","channel":"test","gap":true}`; string(data) != expected {
+		t.Fatalf("wrong envelope %s", data)
+	}
+
+	var decoded message.Message
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(m, &decoded) {
+		t.Fatalf("wrong decoded message %#v", decoded)
+	}
+}
+
+func TestField(t *testing.T) {
+	m := message.New("test", []byte(`{"account":{"id":"1234","active":true},"items":[{"price":10}]}`))
+
+	tests := []struct {
+		Path     string
+		Expected interface{}
+		Found    bool
+	}{
+		{"account.id", "1234", true},
+		{"account.active", true, true},
+		{"items.0.price", float64(10), true},
+		{"items.1.price", nil, false},
+		{"account.id.foo", nil, false},
+		{"missing", nil, false},
+	}
+
+	for _, test := range tests {
+		value, ok := m.Field(test.Path)
+		if ok != test.Found || !reflect.DeepEqual(value, test.Expected) {
+			t.Errorf("%s: wrong value %#v", test.Path, value)
+		}
+	}
+
+	if _, ok := message.New("test", []byte("foobar")).Field("foo"); ok {
+		t.Error("found field in non-JSON payload")
+	}
+}
@@ -0,0 +1,421 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mediocregopher/radix/v3"
+	"github.com/mediocregopher/radix/v3/resp/resp2"
+)
+
+const (
+	// clusterRetryInterval is how often channels waiting to be subscribed to are retried
+	clusterRetryInterval = time.Second
+	// clusterPingInterval is how often the connections to the nodes are checked
+	clusterPingInterval = time.Second * 5
+)
+
+// NewWithCluster creates a new PubSub client for a redis cluster, which subscribes to every channel on the primary
+// owning its slot using sharded pubsub, or classic pubsub if the cluster doesn't support it
+// Channels are resubscribed to automatically when their slot moves to another node, or the connection to it is lost
+func NewWithCluster(clusterAddrs []string, password string, opts ...Option) (*PubSub, error) {
+	p := newPubSub(password, opts)
+
+	poolFunc := radix.ClusterPoolFunc(func(network, address string) (radix.Client, error) {
+		return radix.NewPool(network, address, 1, radix.PoolConnFunc(p.dial))
+	})
+
+	cluster, err := radix.NewCluster(clusterAddrs, poolFunc)
+	if err != nil {
+		return nil, err
+	}
+
+	p.conn = newShardedConn(cluster, p.dial, p.signalGap)
+	p.client = cluster
+	p.ctx, p.cancel = context.WithCancel(context.Background())
+	return p, nil
+}
+
+// shardedConn subscribes to channels on the nodes of a redis cluster owning their slots
+type shardedConn struct {
+	cluster *radix.Cluster
+	dial    radix.ConnFunc
+	gap     func(channels ...string) // Called when messages may have been lost on channels
+
+	subsL sync.RWMutex
+	subs  map[string]map[chan<- radix.PubSubMessage]bool // The receivers of the messages of every channel
+
+	mutex    sync.Mutex
+	nodes    map[string]*clusterNode // The connections to the nodes, by address
+	channels map[string]*clusterNode // The node every channel is subscribed on, or nil while waiting to be
+	sharded  bool                    // Whether to use sharded pubsub, until a node turns out not to support it
+	retry    chan struct{}
+	done     chan struct{}
+}
+
+type clusterNode struct {
+	addr string
+	conn radix.Conn
+}
+
+func newShardedConn(cluster *radix.Cluster, dial radix.ConnFunc, gap func(channels ...string)) *shardedConn {
+	s := &shardedConn{
+		cluster:  cluster,
+		dial:     dial,
+		gap:      gap,
+		subs:     make(map[string]map[chan<- radix.PubSubMessage]bool),
+		nodes:    make(map[string]*clusterNode),
+		channels: make(map[string]*clusterNode),
+		sharded:  true,
+		retry:    make(chan struct{}, 1),
+		done:     make(chan struct{}),
+	}
+
+	go s.worker()
+
+	return s
+}
+
+// Subscribe passes the messages of the channels to msgCh
+// Channels that can't be subscribed to right away are retried in the background
+func (s *shardedConn) Subscribe(msgCh chan<- radix.PubSubMessage, channels ...string) error {
+	var added []string
+
+	s.subsL.Lock()
+	for _, channel := range channels {
+		if s.subs[channel] == nil {
+			s.subs[channel] = make(map[chan<- radix.PubSubMessage]bool)
+			added = append(added, channel)
+		}
+		s.subs[channel][msgCh] = true
+	}
+	s.subsL.Unlock()
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, channel := range added {
+		if err := s.subscribe(channel); err != nil {
+			log.Printf("error subscribing to %q on redis cluster, retrying: %s", channel, err)
+		}
+	}
+
+	return nil
+}
+
+// Unsubscribe stops passing the messages of the channels to msgCh
+func (s *shardedConn) Unsubscribe(msgCh chan<- radix.PubSubMessage, channels ...string) error {
+	var removed []string
+
+	s.subsL.Lock()
+	for _, channel := range channels {
+		delete(s.subs[channel], msgCh)
+		if len(s.subs[channel]) == 0 {
+			delete(s.subs, channel)
+			removed = append(removed, channel)
+		}
+	}
+	s.subsL.Unlock()
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, channel := range removed {
+		if n := s.channels[channel]; n != nil {
+			if err := n.conn.Encode(radix.Cmd(nil, s.command("UNSUBSCRIBE"), channel)); err != nil {
+				n.conn.Close()
+			}
+		}
+		delete(s.channels, channel)
+	}
+
+	return nil
+}
+
+// PSubscribe isn't supported, as the nodes only publish to pattern subscriptions on themselves
+func (s *shardedConn) PSubscribe(msgCh chan<- radix.PubSubMessage, patterns ...string) error {
+	return errors.New("pattern subscriptions aren't supported with redis cluster")
+}
+
+// PUnsubscribe isn't supported, as PSubscribe isn't
+func (s *shardedConn) PUnsubscribe(msgCh chan<- radix.PubSubMessage, patterns ...string) error {
+	return errors.New("pattern subscriptions aren't supported with redis cluster")
+}
+
+// Close closes the connections to the nodes
+func (s *shardedConn) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	close(s.done)
+	for _, n := range s.nodes {
+		n.conn.Close()
+	}
+
+	return nil
+}
+
+// command returns the sharded variant of the pubsub command, if sharded pubsub is used
+// NOTE mutex must be held
+func (s *shardedConn) command(command string) string {
+	if s.sharded {
+		return "S" + command
+	}
+	return command
+}
+
+// publishCommand returns the command for publishing to the subscriptions
+func (s *shardedConn) publishCommand() string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.command("PUBLISH")
+}
+
+// subscribe subscribes to the channel on the node owning its slot, or marks it as waiting to be subscribed to
+// NOTE mutex must be held
+func (s *shardedConn) subscribe(channel string) error {
+	s.channels[channel] = nil
+
+	addr, err := s.owner(channel)
+	if err != nil {
+		return err
+	}
+
+	n, err := s.node(addr)
+	if err != nil {
+		return err
+	}
+
+	if err := n.conn.Encode(radix.Cmd(nil, s.command("SUBSCRIBE"), channel)); err != nil {
+		// The reader notices the connection being closed, and has the channels on it retried
+		n.conn.Close()
+		return err
+	}
+
+	s.channels[channel] = n
+	return nil
+}
+
+// owner returns the address of the primary owning the slot of the channel
+func (s *shardedConn) owner(channel string) (string, error) {
+	slot := radix.ClusterSlot([]byte(channel))
+	for _, node := range s.cluster.Topo().Primaries() {
+		for _, slots := range node.Slots {
+			if slot >= slots[0] && slot < slots[1] {
+				return node.Addr, nil
+			}
+		}
+	}
+
+	return "", fmt.Errorf("no node owns slot %d", slot)
+}
+
+// node returns the connection to the node, connecting to it if needed
+// NOTE mutex must be held
+func (s *shardedConn) node(addr string) (*clusterNode, error) {
+	if n, ok := s.nodes[addr]; ok {
+		return n, nil
+	}
+
+	conn, err := s.dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	n := &clusterNode{addr: addr, conn: conn}
+	s.nodes[addr] = n
+
+	go s.reader(n)
+
+	return n, nil
+}
+
+// reader passes on the messages from a node, and handles the channels being moved away from it
+func (s *shardedConn) reader(n *clusterNode) {
+	for {
+		var parts [][]byte
+		err := n.conn.Decode(&resp2.Any{I: &parts})
+
+		var respErr resp2.Error
+		if errors.As(err, &respErr) {
+			s.handleError(n, respErr)
+			continue
+		} else if err != nil {
+			s.disconnected(n, err)
+			return
+		}
+
+		if len(parts) < 2 {
+			continue
+		}
+
+		switch kind, channel := strings.ToLower(string(parts[0])), string(parts[1]); kind {
+		case "smessage", "message":
+			if len(parts) == 3 {
+				s.publish(radix.PubSubMessage{Type: "message", Channel: channel, Message: parts[2]})
+			}
+		case "sunsubscribe", "unsubscribe":
+			// Unless requested, the slot of the channel has moved to another node
+			s.mutex.Lock()
+			if current, ok := s.channels[channel]; ok && current == n {
+				s.channels[channel] = nil
+				s.scheduleRetry()
+			}
+			s.mutex.Unlock()
+		}
+	}
+}
+
+// publish passes a message on to the receivers of its channel
+func (s *shardedConn) publish(m radix.PubSubMessage) {
+	s.subsL.RLock()
+	defer s.subsL.RUnlock()
+
+	for ch := range s.subs[m.Channel] {
+		ch <- m
+	}
+}
+
+// handleError handles an error reply from a node, which are either redirections of channels to other nodes, or
+// sharded pubsub not being supported
+func (s *shardedConn) handleError(n *clusterNode, err resp2.Error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	message := err.Error()
+	fields := strings.Fields(message)
+
+	switch {
+	case len(fields) == 3 && (fields[0] == "MOVED" || fields[0] == "ASK"):
+		slot, _ := strconv.Atoi(fields[1])
+		for channel, current := range s.channels {
+			if current == n && int(radix.ClusterSlot([]byte(channel))) == slot {
+				s.channels[channel] = nil
+			}
+		}
+	case s.sharded && strings.HasPrefix(message, "ERR unknown command"):
+		log.Println("redis cluster doesn't support sharded pubsub, falling back to classic pubsub")
+		s.sharded = false
+		for channel := range s.channels {
+			s.channels[channel] = nil
+		}
+	default:
+		log.Printf("error from redis cluster node %s: %s", n.addr, message)
+		return
+	}
+
+	s.scheduleRetry()
+}
+
+// disconnected forgets about a node after losing the connection to it, and has its channels subscribed to again
+func (s *shardedConn) disconnected(n *clusterNode, err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	select {
+	case <-s.done:
+		return
+	default:
+	}
+
+	log.Printf("lost connection to redis cluster node %s: %s", n.addr, err)
+
+	n.conn.Close()
+	if s.nodes[n.addr] == n {
+		delete(s.nodes, n.addr)
+	}
+
+	for channel, current := range s.channels {
+		if current == n {
+			s.channels[channel] = nil
+		}
+	}
+
+	s.scheduleRetry()
+}
+
+// scheduleRetry has the worker subscribe to the waiting channels right away
+// NOTE mutex must be held
+func (s *shardedConn) scheduleRetry() {
+	select {
+	case s.retry <- struct{}{}:
+	default:
+	}
+}
+
+// worker subscribes to the channels waiting to be subscribed to, and pings the nodes to notice lost connections
+func (s *shardedConn) worker() {
+	retryTicker := time.NewTicker(clusterRetryInterval)
+	defer retryTicker.Stop()
+
+	pingTicker := time.NewTicker(clusterPingInterval)
+	defer pingTicker.Stop()
+
+	for {
+		select {
+		case <-s.retry:
+			s.resubscribe()
+		case <-retryTicker.C:
+			s.resubscribe()
+		case <-pingTicker.C:
+			s.mutex.Lock()
+			for _, n := range s.nodes {
+				if err := n.conn.Encode(radix.Cmd(nil, "PING")); err != nil {
+					n.conn.Close()
+				}
+			}
+			s.mutex.Unlock()
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// resubscribe updates the cluster topology, and subscribes to the channels waiting to be subscribed to on the nodes
+// now owning their slots
+func (s *shardedConn) resubscribe() {
+	s.mutex.Lock()
+	var waiting []string
+	for channel, n := range s.channels {
+		if n == nil {
+			waiting = append(waiting, channel)
+		}
+	}
+	s.mutex.Unlock()
+
+	if len(waiting) == 0 {
+		return
+	}
+
+	if err := s.cluster.Sync(); err != nil {
+		log.Println("error updating redis cluster topology:", err)
+	}
+
+	s.mutex.Lock()
+	var resubscribed []string
+	for _, channel := range waiting {
+		// Skip channels unsubscribed from, or subscribed to, in the meantime
+		if n, ok := s.channels[channel]; !ok || n != nil {
+			continue
+		}
+
+		if err := s.subscribe(channel); err != nil {
+			log.Printf("error subscribing to %q on redis cluster, retrying: %s", channel, err)
+			continue
+		}
+		resubscribed = append(resubscribed, channel)
+	}
+	s.mutex.Unlock()
+
+	// The messages published while waiting have been lost
+	if len(resubscribed) > 0 {
+		s.gap(resubscribed...)
+	}
+}
@@ -0,0 +1,401 @@
+package pubsub_test
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mediocregopher/radix/v3"
+	"github.com/mullvad/message-queue/message"
+	"github.com/mullvad/message-queue/pubsub"
+	"github.com/mullvad/message-queue/test/redistest"
+)
+
+func TestCluster(t *testing.T) {
+	t.Run("sharded pubsub", func(t *testing.T) {
+		c := newFakeCluster(t, true)
+		defer c.close()
+
+		p, err := pubsub.NewWithCluster([]string{c.addr(0)}, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer p.Shutdown()
+
+		// Subscribe to channels on both nodes
+		first, second := channelOnNode(0), channelOnNode(1)
+		for _, channel := range []string{first, second} {
+			ch, err := p.Subscribe(channel)
+			if err != nil {
+				t.Fatal(err)
+			}
+			assertClusterMessage(t, c, ch, channel, "sharded")
+		}
+
+		if kinds := c.subscriptions(first); len(kinds) != 1 || kinds[0] != "0:sharded" {
+			t.Fatalf("wrong subscriptions: %s", kinds)
+		}
+	})
+
+	t.Run("follow slot migration", func(t *testing.T) {
+		c := newFakeCluster(t, true)
+		defer c.close()
+
+		p, err := pubsub.NewWithCluster([]string{c.addr(0)}, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer p.Shutdown()
+
+		channel := channelOnNode(0)
+		ch, err := p.Subscribe(channel)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertClusterMessage(t, c, ch, channel, "before")
+
+		// The node unsubscribes the client from the channel, which should then subscribe on the new owner
+		c.migrate(channel, 1, true)
+		assertGap(t, ch, channel)
+		assertClusterMessage(t, c, ch, channel, "after")
+
+		if kinds := c.subscriptions(channel); len(kinds) != 1 || kinds[0] != "1:sharded" {
+			t.Fatalf("wrong subscriptions: %s", kinds)
+		}
+	})
+
+	t.Run("follow MOVED", func(t *testing.T) {
+		c := newFakeCluster(t, true)
+		defer c.close()
+
+		p, err := pubsub.NewWithCluster([]string{c.addr(0)}, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer p.Shutdown()
+
+		// The client doesn't know about the migration until being redirected
+		channel := channelOnNode(0)
+		c.migrate(channel, 1, false)
+
+		ch, err := p.Subscribe(channel)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertClusterMessage(t, c, ch, channel, "moved")
+	})
+
+	t.Run("unsubscribe", func(t *testing.T) {
+		c := newFakeCluster(t, true)
+		defer c.close()
+
+		p, err := pubsub.NewWithCluster([]string{c.addr(0)}, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer p.Shutdown()
+
+		channel := channelOnNode(1)
+		ctx, cancel := context.WithCancel(context.Background())
+		ch, err := p.SubscribeContext(ctx, channel)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertClusterMessage(t, c, ch, channel, "subscribed")
+
+		// Keep publishing while unsubscribing
+		c.publish(channel, "unsubscribing")
+		cancel()
+		for range ch {
+		}
+
+		// The unsubscription is asynchronous
+		deadline := time.Now().Add(time.Second * 5)
+		for len(c.subscriptions(channel)) > 0 {
+			if time.Now().After(deadline) {
+				t.Fatalf("still subscribed: %s", c.subscriptions(channel))
+			}
+			time.Sleep(time.Millisecond * 10)
+		}
+	})
+
+	t.Run("fall back to classic pubsub", func(t *testing.T) {
+		c := newFakeCluster(t, false)
+		defer c.close()
+
+		p, err := pubsub.NewWithCluster([]string{c.addr(0)}, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer p.Shutdown()
+
+		channel := channelOnNode(1)
+		ch, err := p.Subscribe(channel)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertClusterMessage(t, c, ch, channel, "classic")
+
+		if kinds := c.subscriptions(channel); len(kinds) != 1 || kinds[0] != "1:classic" {
+			t.Fatalf("wrong subscriptions: %s", kinds)
+		}
+	})
+}
+
+// assertClusterMessage keeps publishing the payload on the channel until it's received, as subscribing is asynchronous
+func assertClusterMessage(t *testing.T, c *fakeCluster, ch <-chan *message.Message, channel string, payload string) {
+	t.Helper()
+
+	ticker := time.NewTicker(time.Millisecond * 10)
+	defer ticker.Stop()
+
+	timeout := time.After(time.Second * 5)
+	for {
+		select {
+		case m := <-ch:
+			if m.Channel != channel {
+				t.Fatalf("wrong channel: %s", m.Channel)
+			}
+			if string(m.Payload) == payload {
+				return
+			}
+		case <-ticker.C:
+			c.publish(channel, payload)
+		case <-timeout:
+			t.Fatalf("%q not received on %q", payload, channel)
+		}
+	}
+}
+
+// channelOnNode returns a channel with its slot in the half of the slots initially owned by the node
+func channelOnNode(node int) string {
+	for i := 0; ; i++ {
+		channel := fmt.Sprintf("channel-%d", i)
+		if int(radix.ClusterSlot([]byte(channel))/8192) == node {
+			return channel
+		}
+	}
+}
+
+// fakeCluster is a stand-in for a redis cluster with two primaries, owning half of the slots each
+type fakeCluster struct {
+	listeners []net.Listener
+	sharded   bool // Whether sharded pubsub is supported
+
+	mutex  sync.Mutex
+	owners map[uint16]int // Slots that have been migrated, and their new owner
+	conns  map[*fakeClusterConn]bool
+}
+
+type fakeClusterConn struct {
+	node    int
+	conn    net.Conn
+	sharded map[string]bool // Channels subscribed to using sharded pubsub
+	classic map[string]bool
+}
+
+func newFakeCluster(t *testing.T, sharded bool) *fakeCluster {
+	c := &fakeCluster{
+		sharded: sharded,
+		owners:  make(map[uint16]int),
+		conns:   make(map[*fakeClusterConn]bool),
+	}
+
+	for node := 0; node < 2; node++ {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.listeners = append(c.listeners, listener)
+
+		go func(node int) {
+			for {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				go c.serve(&fakeClusterConn{node: node, conn: conn, sharded: make(map[string]bool), classic: make(map[string]bool)})
+			}
+		}(node)
+	}
+
+	return c
+}
+
+func (c *fakeCluster) addr(node int) string {
+	return c.listeners[node].Addr().String()
+}
+
+func (c *fakeCluster) close() {
+	for _, listener := range c.listeners {
+		listener.Close()
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for conn := range c.conns {
+		conn.conn.Close()
+	}
+}
+
+// owner returns the node owning the slot
+// NOTE mutex must be held
+func (c *fakeCluster) owner(slot uint16) int {
+	if node, ok := c.owners[slot]; ok {
+		return node
+	}
+	return int(slot / 8192)
+}
+
+// migrate moves the slot of the channel to the node, and optionally unsubscribes the clients of the channel from the
+// old owner like redis does
+func (c *fakeCluster) migrate(channel string, node int, unsubscribe bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	slot := radix.ClusterSlot([]byte(channel))
+	old := c.owner(slot)
+	c.owners[slot] = node
+
+	for conn := range c.conns {
+		if conn.node == old && conn.sharded[channel] {
+			delete(conn.sharded, channel)
+			if unsubscribe {
+				fmt.Fprintf(conn.conn, "*3\r\n%s%s:%d\r\n", redistest.BulkString("sunsubscribe"), redistest.BulkString(channel), len(conn.sharded))
+			}
+		}
+	}
+}
+
+// publish sends a message to the subscribers of the channel, where sharded subscribers only get it from the owner
+func (c *fakeCluster) publish(channel string, payload string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	owner := c.owner(radix.ClusterSlot([]byte(channel)))
+	for conn := range c.conns {
+		if conn.sharded[channel] && conn.node == owner {
+			fmt.Fprintf(conn.conn, "*3\r\n%s%s%s", redistest.BulkString("smessage"), redistest.BulkString(channel), redistest.BulkString(payload))
+		}
+		if conn.classic[channel] {
+			fmt.Fprintf(conn.conn, "*3\r\n%s%s%s", redistest.BulkString("message"), redistest.BulkString(channel), redistest.BulkString(payload))
+		}
+	}
+}
+
+// subscriptions returns the subscriptions to the channel as node:kind
+func (c *fakeCluster) subscriptions(channel string) []string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	var kinds []string
+	for conn := range c.conns {
+		if conn.sharded[channel] {
+			kinds = append(kinds, fmt.Sprintf("%d:sharded", conn.node))
+		}
+		if conn.classic[channel] {
+			kinds = append(kinds, fmt.Sprintf("%d:classic", conn.node))
+		}
+	}
+	return kinds
+}
+
+func (c *fakeCluster) serve(conn *fakeClusterConn) {
+	c.mutex.Lock()
+	c.conns[conn] = true
+	c.mutex.Unlock()
+
+	defer func() {
+		c.mutex.Lock()
+		delete(c.conns, conn)
+		c.mutex.Unlock()
+		conn.conn.Close()
+	}()
+
+	r := bufio.NewReader(conn.conn)
+	for {
+		args, err := redistest.ReadCommand(r)
+		if err != nil {
+			return
+		}
+
+		c.mutex.Lock()
+		reply := c.reply(conn, args)
+		_, err = io.WriteString(conn.conn, reply)
+		c.mutex.Unlock()
+
+		if err != nil {
+			return
+		}
+	}
+}
+
+// reply executes a command
+// NOTE mutex must be held
+func (c *fakeCluster) reply(conn *fakeClusterConn, args []string) string {
+	subscribed := len(conn.sharded) + len(conn.classic)
+
+	switch command := strings.ToUpper(args[0]); {
+	case command == "PING" && subscribed > 0:
+		return fmt.Sprintf("*2\r\n%s%s", redistest.BulkString("pong"), redistest.BulkString(""))
+	case command == "PING":
+		return "+PONG\r\n"
+	case command == "CLUSTER" && len(args) == 2 && strings.ToUpper(args[1]) == "SLOTS":
+		return c.slots()
+	case command == "SSUBSCRIBE" && !c.sharded:
+		return fmt.Sprintf("-ERR unknown command '%s', with args beginning with: \r\n", args[0])
+	case command == "SSUBSCRIBE" || command == "SUBSCRIBE":
+		var reply string
+		for _, channel := range args[1:] {
+			if command == "SSUBSCRIBE" {
+				slot := radix.ClusterSlot([]byte(channel))
+				if owner := c.owner(slot); owner != conn.node {
+					return fmt.Sprintf("-MOVED %d %s\r\n", slot, c.addr(owner))
+				}
+				conn.sharded[channel] = true
+			} else {
+				conn.classic[channel] = true
+			}
+			reply += fmt.Sprintf("*3\r\n%s%s:%d\r\n", redistest.BulkString(strings.ToLower(command)), redistest.BulkString(channel), len(conn.sharded)+len(conn.classic))
+		}
+		return reply
+	case command == "SUNSUBSCRIBE" || command == "UNSUBSCRIBE":
+		var reply string
+		for _, channel := range args[1:] {
+			delete(conn.sharded, channel)
+			delete(conn.classic, channel)
+			reply += fmt.Sprintf("*3\r\n%s%s:%d\r\n", redistest.BulkString(strings.ToLower(command)), redistest.BulkString(channel), len(conn.sharded)+len(conn.classic))
+		}
+		return reply
+	default:
+		return fmt.Sprintf("-ERR unknown command '%s'\r\n", args[0])
+	}
+}
+
+// slots returns the reply to CLUSTER SLOTS, with the slot ranges and their owners
+// NOTE mutex must be held
+func (c *fakeCluster) slots() string {
+	var ranges []string
+	start := 0
+	for slot := 1; slot <= 16384; slot++ {
+		if slot < 16384 && c.owner(uint16(slot)) == c.owner(uint16(start)) {
+			continue
+		}
+
+		host, port, _ := net.SplitHostPort(c.addr(c.owner(uint16(start))))
+		portNumber, _ := strconv.Atoi(port)
+		ranges = append(ranges, fmt.Sprintf("*3\r\n:%d\r\n:%d\r\n*3\r\n%s:%d\r\n%s", start, slot-1,
+			redistest.BulkString(host), portNumber, redistest.BulkString(fmt.Sprintf("node%d", c.owner(uint16(start))))))
+		start = slot
+	}
+
+	return fmt.Sprintf("*%d\r\n%s", len(ranges), strings.Join(ranges, ""))
+}
@@ -0,0 +1,157 @@
+package pubsub
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/mediocregopher/radix/v3"
+	"github.com/mullvad/message-queue/message"
+)
+
+// Keyspace selects the keyspace notifications to subscribe to
+type Keyspace struct {
+	Database int
+	Pattern  string   // The glob-style pattern of the keys, such as "session:*"
+	Events   []string // The events passed on, such as "expired" or "set", all of them if not set
+	Fetch    bool     // Fetches the current value of the key for every event
+}
+
+// KeyspaceEvent is the JSON payload of the messages of keyspace notifications
+type KeyspaceEvent struct {
+	Key   string `json:"key"`
+	Event string `json:"event"`
+	// The value of the key when fetched, a string for strings and an object for hashes, or nil if the key doesn't
+	// exist, has another type or wasn't fetched
+	Value interface{} `json:"value,omitempty"`
+}
+
+// EnableKeyspaceEvents adds the flags, such as "Kx" for the keyspace notifications of expired keys, to the
+// notify-keyspace-events setting of the redis server, keeping any flags that were already set
+func (p *PubSub) EnableKeyspaceEvents(flags string) error {
+	var current []string
+	if err := p.client.Do(radix.Cmd(&current, "CONFIG", "GET", "notify-keyspace-events")); err != nil {
+		return err
+	}
+	if len(current) != 2 {
+		return fmt.Errorf("unexpected notify-keyspace-events setting %q", current)
+	}
+
+	enabled := current[1]
+	for _, flag := range flags {
+		if !strings.ContainsRune(enabled, flag) {
+			enabled += string(flag)
+		}
+	}
+
+	if enabled == current[1] {
+		return nil
+	}
+
+	return p.client.Do(radix.Cmd(nil, "CONFIG", "SET", "notify-keyspace-events", enabled))
+}
+
+// SubscribeKeyspace subscribes to the keyspace notifications of the keys matching the pattern until the context has
+// ended, and returns a channel for receiving a message for every event, with a KeyspaceEvent payload and the key and
+// event headers
+// The notifications have to be enabled on the redis server, see EnableKeyspaceEvents
+// Fetched values may be more recent than the event, as they're fetched once it has been received
+func (p *PubSub) SubscribeKeyspace(ctx context.Context, k Keyspace) (<-chan *message.Message, error) {
+	prefix := fmt.Sprintf("__keyspace@%d__:", k.Database)
+	pattern := prefix + k.Pattern
+
+	events := make(map[string]bool)
+	for _, event := range k.Events {
+		events[event] = true
+	}
+
+	in := make(chan radix.PubSubMessage)
+	gap := p.gapSignal(pattern)
+
+	err := p.conn.PSubscribe(in, pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	convert := func(msg radix.PubSubMessage) *message.Message {
+		e := KeyspaceEvent{
+			Key:   strings.TrimPrefix(msg.Channel, prefix),
+			Event: string(msg.Message),
+		}
+
+		if len(events) > 0 && !events[e.Event] {
+			return nil
+		}
+
+		if k.Fetch {
+			value, err := p.fetch(k.Database, e.Key)
+			if err != nil {
+				log.Printf("error fetching %q for keyspace notification: %s", e.Key, err)
+			}
+			e.Value = value
+		}
+
+		payload, err := json.Marshal(e)
+		if err != nil {
+			log.Printf("error encoding keyspace notification of %q: %s", e.Key, err)
+			return nil
+		}
+
+		m := message.New(msg.Channel, payload)
+		m.ContentType = "application/json"
+		m.Headers = map[string]string{"key": e.Key, "event": e.Event}
+		return m
+	}
+	unsubscribe := func() {
+		p.conn.PUnsubscribe(in, pattern)
+	}
+
+	out := make(chan *message.Message)
+	go p.worker(ctx, pattern, gap, in, out, convert, unsubscribe)
+
+	return out, nil
+}
+
+// fetch reads the value of a string or hash key in the database, or returns nil if it doesn't exist or has another
+// type
+func (p *PubSub) fetch(database int, key string) (value interface{}, err error) {
+	err = p.client.Do(radix.WithConn(key, func(conn radix.Conn) error {
+		// The connection is shared, so switch back to the default database afterwards, or close it if that fails, which
+		// keeps the pool from handing it out again
+		if database != 0 {
+			if err := conn.Do(radix.Cmd(nil, "SELECT", strconv.Itoa(database))); err != nil {
+				return err
+			}
+			defer func() {
+				if err := conn.Do(radix.Cmd(nil, "SELECT", "0")); err != nil {
+					conn.Close()
+				}
+			}()
+		}
+
+		var keyType string
+		if err := conn.Do(radix.Cmd(&keyType, "TYPE", key)); err != nil {
+			return err
+		}
+
+		switch keyType {
+		case "string":
+			var s string
+			err := conn.Do(radix.Cmd(&s, "GET", key))
+			value = s
+			return err
+		case "hash":
+			var fields map[string]string
+			err := conn.Do(radix.Cmd(&fields, "HGETALL", key))
+			value = fields
+			return err
+		default:
+			return nil
+		}
+	}))
+
+	return value, err
+}
@@ -0,0 +1,86 @@
+package pubsub_test
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/mullvad/message-queue/pubsub"
+	"github.com/mullvad/message-queue/test/redistest"
+)
+
+func TestKeyspace(t *testing.T) {
+	s := redistest.NewServer(redistest.Primary)
+	defer s.Close()
+
+	p, err := pubsub.New(s.Addr(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Shutdown()
+
+	t.Run("enable keyspace events", func(t *testing.T) {
+		for _, flags := range []string{"Kx", "Kg"} {
+			if err := p.EnableKeyspaceEvents(flags); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if events := s.Config("notify-keyspace-events"); events != "Kxg" {
+			t.Fatalf("wrong flags: %s", events)
+		}
+	})
+
+	t.Run("subscribe to keyspace notifications", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		ch, err := p.SubscribeKeyspace(ctx, pubsub.Keyspace{
+			Database: 2,
+			Pattern:  "session:*",
+			Events:   []string{"set", "expired"},
+			Fetch:    true,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		s.Set("session:1", "active")
+
+		// Other keys and events are skipped
+		s.Publish("__keyspace@2__:other:1", "set")
+		s.Publish("__keyspace@2__:session:1", "del")
+		s.Publish("__keyspace@2__:session:1", "set")
+		s.Publish("__keyspace@2__:session:2", "expired")
+
+		for _, expected := range []pubsub.KeyspaceEvent{
+			{Key: "session:1", Event: "set", Value: "active"},
+			{Key: "session:2", Event: "expired"},
+		} {
+			select {
+			case m := <-ch:
+				var e pubsub.KeyspaceEvent
+				if err := json.Unmarshal(m.Payload, &e); err != nil {
+					t.Fatal(err)
+				}
+
+				if !reflect.DeepEqual(e, expected) || m.Headers["key"] != expected.Key || m.Headers["event"] != expected.Event {
+					t.Fatalf("wrong message: %s %v", m.Payload, m.Headers)
+				}
+			case <-time.After(time.Second * 5):
+				t.Fatal("no message")
+			}
+		}
+
+		// Unsubscribe when the context ends
+		cancel()
+		for range ch {
+		}
+
+		if s.Subscriptions() != 0 {
+			t.Fatal("still subscribed")
+		}
+	})
+}
@@ -0,0 +1,97 @@
+package pubsub
+
+import (
+	"crypto/tls"
+
+	"github.com/mediocregopher/radix/v3"
+)
+
+// Option configures how the PubSub client connects to redis
+type Option func(o *options)
+
+type options struct {
+	username          string      // The ACL username for the redis servers, if set
+	tlsConfig         *tls.Config // Connects to the redis servers using TLS, if set
+	sentinelAuth      bool        // Authenticates with the sentinels using the options rather than their addresses
+	sentinelUsername  string
+	sentinelPassword  string
+	sentinelTLSConfig *tls.Config    // Connects to the sentinels using TLS, if set
+	replicas          bool           // Subscribes on a replica rather than the primary, when using sentinel
+	failoverHandler   func(Failover) // Called after every failover, when using sentinel
+}
+
+// WithUsername authenticates with the redis servers as the given redis 6 ACL user, rather than the default user
+func WithUsername(username string) Option {
+	return func(o *options) {
+		o.username = username
+	}
+}
+
+// WithTLS connects to the redis servers using TLS with the given configuration, which may set the root CAs for
+// verifying the servers and a client certificate for mutual TLS
+func WithTLS(config *tls.Config) Option {
+	return func(o *options) {
+		o.tlsConfig = config
+	}
+}
+
+// WithSentinelAuth authenticates with the sentinels using the given ACL username, which may be empty for the default
+// user, and password, instead of any authentication details in the sentinel addresses
+// This is needed for authenticating with the sentinels discovered from the ones given
+func WithSentinelAuth(username, password string) Option {
+	return func(o *options) {
+		o.sentinelAuth = true
+		o.sentinelUsername = username
+		o.sentinelPassword = password
+	}
+}
+
+// WithSentinelTLS connects to the sentinels using TLS with the given configuration
+func WithSentinelTLS(config *tls.Config) Option {
+	return func(o *options) {
+		o.sentinelTLSConfig = config
+	}
+}
+
+// WithReplicas subscribes on one of the replicas of the primary managed by redis sentinel, if any are available, to
+// take load off the primary, as the messages published on the primary are propagated to the replicas
+func WithReplicas() Option {
+	return func(o *options) {
+		o.replicas = true
+	}
+}
+
+// WithFailoverHandler calls the handler after every failover of the primary managed by redis sentinel, once the
+// subscriptions have been moved over
+func WithFailoverHandler(handler func(Failover)) Option {
+	return func(o *options) {
+		o.failoverHandler = handler
+	}
+}
+
+// dial connects to a redis server or sentinel, and authenticates if a password is set, as the given user if set
+func dial(network, address, username, password string, tlsConfig *tls.Config) (radix.Conn, error) {
+	var opts []radix.DialOpt
+	if tlsConfig != nil {
+		opts = append(opts, radix.DialUseTLS(tlsConfig))
+	}
+
+	// Without a user, authenticate using the password option, which overrides any password in a redis URL
+	if username == "" && password != "" {
+		opts = append(opts, radix.DialAuthPass(password))
+	}
+
+	conn, err := radix.Dial(network, address, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	if username != "" {
+		if err := conn.Do(radix.Cmd(nil, "AUTH", username, password)); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	return conn, nil
+}
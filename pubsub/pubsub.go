@@ -3,22 +3,58 @@ package pubsub
 import (
 	"context"
 	"fmt"
+	"log"
+	"sync"
 
 	"github.com/mediocregopher/radix/v3"
+	"github.com/mediocregopher/radix/v3/resp"
 	"github.com/mediocregopher/radix/v3/resp/resp2"
+	"github.com/mullvad/message-queue/message"
 )
 
 // PubSub is a client for recieving messages using redis pubsub
 type PubSub struct {
-	conn   radix.PubSubConn
+	conn   subscriptions
+	client radix.Client // For regular commands
 	ctx    context.Context
 	cancel context.CancelFunc
+
+	options  options
+	sentinel *sentinelState // Keeps track of the primary when using redis sentinel
+
+	mutex    sync.Mutex
+	password string                   // Used for every new connection
+	gaps     map[string]chan struct{} // Closed when messages may have been lost on a channel, by channel
+}
+
+// subscriptions passes the messages of redis pubsub channels on, which radix.PubSubConn does for a single server
+type subscriptions interface {
+	Subscribe(msgCh chan<- radix.PubSubMessage, channels ...string) error
+	Unsubscribe(msgCh chan<- radix.PubSubMessage, channels ...string) error
+	PSubscribe(msgCh chan<- radix.PubSubMessage, patterns ...string) error
+	PUnsubscribe(msgCh chan<- radix.PubSubMessage, patterns ...string) error
+	Close() error
 }
 
 // New creates a new PubSub client and establishes the connection to redis
-func New(address string, password string) (*PubSub, error) {
+func New(address string, password string, opts ...Option) (*PubSub, error) {
+	p := newPubSub(password, opts)
+
+	// The connection is only ever dialed again after losing it, and the messages published in the meantime
+	connected := false
 	connFunc := radix.PersistentPubSubConnFunc(func(string, address string) (radix.Conn, error) {
-		return radix.Dial("tcp", address, radix.DialAuthPass(password))
+		conn, err := p.dial("tcp", address)
+		if err != nil {
+			return nil, err
+		}
+
+		if connected {
+			log.Printf("reconnected to redis at %s, messages may have been lost", address)
+			conn = p.resubscribing(conn)
+		}
+		connected = true
+
+		return conn, nil
 	})
 
 	conn, err := radix.PersistentPubSubWithOpts("tcp", address, connFunc, radix.PersistentPubSubAbortAfter(3))
@@ -26,105 +62,259 @@ func New(address string, password string) (*PubSub, error) {
 		return nil, err
 	}
 
-	ctx, cancel := context.WithCancel(context.Background())
-	return &PubSub{
-		conn:   conn,
-		ctx:    ctx,
-		cancel: cancel,
-	}, nil
-}
-
-// NewWithSentinel creates a new PubSub client and establishes the connection to redis using sentinel
-func NewWithSentinel(serviceName string, sentinelAddrs []string, serverPass string) (*PubSub, error) {
-	s, err := radix.NewSentinel(serviceName, sentinelAddrs)
+	client, err := radix.NewPool("tcp", address, 1, radix.PoolConnFunc(p.dial))
 	if err != nil {
+		conn.Close()
 		return nil, err
 	}
 
-	connFunc := radix.PersistentPubSubConnFunc(func(string, string) (radix.Conn, error) {
-		// Get the primary redis server according to redis sentinel
-		primaryAddr, _ := s.Addrs()
+	p.conn = conn
+	p.client = client
+	p.ctx, p.cancel = context.WithCancel(context.Background())
+	return p, nil
+}
 
-		// Connect to it
-		conn, err := radix.Dial("tcp", primaryAddr, radix.DialAuthPass(serverPass))
-		if err != nil {
-			return nil, err
-		}
+// SetPassword changes the password used for new connections to the redis servers, for rotating passwords without
+// dropping the existing connections
+func (p *PubSub) SetPassword(password string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
 
-		// Check if it has the primary role
-		var rawRoleOutput []resp2.RawMessage
-		err = conn.Do(radix.Cmd(&rawRoleOutput, "ROLE"))
-		if err != nil {
-			return nil, err
-		}
+	p.password = password
+}
 
-		var role resp2.BulkString
-		err = rawRoleOutput[0].UnmarshalInto(&role)
-		if err != nil {
-			return nil, err
-		}
+func (p *PubSub) getPassword() string {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	return p.password
+}
+
+func newPubSub(password string, opts []Option) *PubSub {
+	p := &PubSub{
+		password: password,
+		gaps:     make(map[string]chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(&p.options)
+	}
+	return p
+}
+
+// dial connects to a redis server using the current password
+func (p *PubSub) dial(network, address string) (radix.Conn, error) {
+	return dial(network, address, p.options.username, p.getPassword(), p.options.tlsConfig)
+}
+
+// gapSignal returns a channel which is closed when messages may have been lost on the redis channel
+func (p *PubSub) gapSignal(channel string) <-chan struct{} {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
 
-		if role.S != "master" {
-			return nil, fmt.Errorf("Server is not the primary")
+	gap, ok := p.gaps[channel]
+	if !ok {
+		gap = make(chan struct{})
+		p.gaps[channel] = gap
+	}
+	return gap
+}
+
+// signalGap tells the subscriptions to the redis channels that messages may have been lost, such as after reconnecting
+func (p *PubSub) signalGap(channels ...string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	for _, channel := range channels {
+		if gap, ok := p.gaps[channel]; ok {
+			close(gap)
+			delete(p.gaps, channel)
 		}
+	}
+}
 
-		return conn, nil
-	})
+// resubscribing wraps a connection dialed again after losing the previous one, which radix subscribes to the channels
+// again, to signal the gaps of the channels once they have been subscribed to, as messages are lost until then
+func (p *PubSub) resubscribing(conn radix.Conn) radix.Conn {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
 
-	conn, err := radix.PersistentPubSubWithOpts("", "", connFunc)
-	if err != nil {
-		// This should never happen since we don't set a retry limit on the connection above
-		return nil, err
+	pending := make(map[string]bool, len(p.gaps))
+	for channel := range p.gaps {
+		pending[channel] = true
 	}
 
-	ctx, cancel := context.WithCancel(context.Background())
-	return &PubSub{
-		conn:   conn,
-		ctx:    ctx,
-		cancel: cancel,
-	}, nil
+	return &resubscribingConn{Conn: conn, pending: pending, signalGap: p.signalGap}
+}
+
+// resubscribingConn signals the gaps of the pending channels, or patterns, once subscribing to them is confirmed
+type resubscribingConn struct {
+	radix.Conn
+	pending   map[string]bool // Only accessed while decoding, which radix does from a single goroutine
+	signalGap func(channels ...string)
+}
+
+func (c *resubscribingConn) Decode(u resp.Unmarshaler) error {
+	if len(c.pending) == 0 {
+		return c.Conn.Decode(u)
+	}
+
+	// Read the whole reply, to look at it before passing it on
+	var raw resp2.RawMessage
+	if err := c.Conn.Decode(&raw); err != nil {
+		return err
+	}
+
+	var reply []string
+	if err := raw.UnmarshalInto(resp2.Any{I: &reply}); err == nil && len(reply) == 3 {
+		kind, channel := reply[0], reply[1]
+		if (kind == "subscribe" || kind == "psubscribe") && c.pending[channel] {
+			delete(c.pending, channel)
+			c.signalGap(channel)
+		}
+	}
+
+	return raw.UnmarshalInto(u)
 }
 
 // Subscribe subscribes to a redis pubsub channel, and returns a channel for receiving messages
-func (p *PubSub) Subscribe(channel string) (<-chan []byte, error) {
+func (p *PubSub) Subscribe(channel string) (<-chan *message.Message, error) {
+	return p.SubscribeContext(context.Background(), channel)
+}
+
+// SubscribeContext subscribes to a redis pubsub channel until the context has ended, and returns a channel for
+// receiving messages, which is closed when unsubscribing
+// A gap message is received whenever messages may have been lost, such as after reconnecting to redis
+func (p *PubSub) SubscribeContext(ctx context.Context, channel string) (<-chan *message.Message, error) {
 	in := make(chan radix.PubSubMessage)
+	gap := p.gapSignal(channel)
 
 	err := p.conn.Subscribe(in, channel)
 	if err != nil {
 		return nil, err
 	}
 
-	out := make(chan []byte)
-	go p.worker(channel, in, out)
+	convert := func(msg radix.PubSubMessage) *message.Message {
+		return message.New(channel, msg.Message)
+	}
+	unsubscribe := func() {
+		p.conn.Unsubscribe(in, channel)
+	}
+
+	out := make(chan *message.Message)
+	go p.worker(ctx, channel, gap, in, out, convert, unsubscribe)
 
 	return out, nil
 }
 
-func (p *PubSub) worker(channel string, in chan radix.PubSubMessage, out chan<- []byte) {
-	defer p.cleanup(channel, in, out)
+// worker passes on the messages converted from the redis pubsub messages, skipping the ones converted to nil, and the
+// gaps of the channel, which is a pattern for pattern subscriptions
+func (p *PubSub) worker(ctx context.Context, channel string, gap <-chan struct{}, in chan radix.PubSubMessage, out chan<- *message.Message, convert func(radix.PubSubMessage) *message.Message, unsubscribe func()) {
+	defer p.cleanup(in, out, unsubscribe)
 
 	for {
+		var m *message.Message
 		select {
 		case msg, open := <-in:
 			if !open {
 				return
 			}
+			if m = convert(msg); m == nil {
+				continue
+			}
+		case <-gap:
+			// Watch for the next gap before passing this one on, so that none go unnoticed
+			gap = p.gapSignal(channel)
+			m = message.NewGap(channel)
+		case <-ctx.Done():
+			return
+		case <-p.ctx.Done():
+			return
+		}
 
-			out <- msg.Message
+		select {
+		case out <- m:
+		case <-ctx.Done():
+			return
 		case <-p.ctx.Done():
 			return
 		}
 	}
 }
 
-func (p *PubSub) cleanup(channel string, in chan radix.PubSubMessage, out chan<- []byte) {
-	p.conn.Unsubscribe(in, channel)
+func (p *PubSub) cleanup(in chan radix.PubSubMessage, out chan<- *message.Message, unsubscribe func()) {
+	// Keep receiving while unsubscribing, as a message may be in the middle of being passed on
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-in:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	unsubscribe()
+	close(done)
 	close(in)
 	close(out)
 }
 
+// Publish publishes a message on a redis channel, using sharded pubsub on redis clusters that support it
+func (p *PubSub) Publish(channel string, payload []byte) error {
+	command := "PUBLISH"
+	if s, ok := p.conn.(*shardedConn); ok {
+		command = s.publishCommand()
+	}
+
+	return p.client.Do(radix.FlatCmd(nil, command, channel, payload))
+}
+
+// Snapshot reads the current state of a channel stored in redis, for seeding channel snapshots
+// A hash results in one message per field, in no particular order, and a string in a single message
+// Returns no messages if the key doesn't exist
+func (p *PubSub) Snapshot(channel string, key string) ([]*message.Message, error) {
+	var keyType string
+	err := p.client.Do(radix.Cmd(&keyType, "TYPE", key))
+	if err != nil {
+		return nil, err
+	}
+
+	switch keyType {
+	case "none":
+		return nil, nil
+	case "string":
+		var value []byte
+		err := p.client.Do(radix.Cmd(&value, "GET", key))
+		if err != nil {
+			return nil, err
+		}
+		return []*message.Message{message.New(channel, value)}, nil
+	case "hash":
+		var values map[string][]byte
+		err := p.client.Do(radix.Cmd(&values, "HGETALL", key))
+		if err != nil {
+			return nil, err
+		}
+
+		messages := make([]*message.Message, 0, len(values))
+		for field, value := range values {
+			m := message.New(channel, value)
+			m.Headers = map[string]string{"key": field}
+			messages = append(messages, m)
+		}
+		return messages, nil
+	default:
+		return nil, fmt.Errorf("%q: unsupported snapshot key type %s", key, keyType)
+	}
+}
+
 // Shutdown shuts everything down and closes the redis connection
 func (p *PubSub) Shutdown() {
 	p.cancel()
 	p.conn.Close()
+	p.client.Close()
+	if p.sentinel != nil {
+		p.sentinel.close()
+	}
 }
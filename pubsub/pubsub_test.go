@@ -1,32 +1,29 @@
 package pubsub_test
 
 import (
-	"sync"
+	"context"
 	"testing"
+	"time"
 
-	"github.com/mediocregopher/radix/v3"
+	"github.com/mullvad/message-queue/message"
 	"github.com/mullvad/message-queue/pubsub"
+	"github.com/mullvad/message-queue/test/redistest"
 )
 
-// This tests assumes that there's a sentinel running locally on 127.0.0.1:26379, with a group named "group"
-// Both the sentinels and the redis servers should have authentication enabled, with the password "foobar"
-
 const (
 	sentinelService = "group"
-	sentinelAddress = "redis://:foobar@127.0.0.1:26379"
-	redisAddress    = "redis://127.0.0.1:6379"
 	redisPassword   = "foobar"
 	channel         = "test"
-	message         = "foobar"
+	testMessage     = "foobar"
 )
 
 func TestPubSub(t *testing.T) {
-	if testing.Short() {
-		t.Skip("skipping integration tests")
-	}
+	s := redistest.NewServer(redistest.Primary)
+	defer s.Close()
+	s.RequireAuth("", redisPassword)
 
 	// Bypass sentinel and connect directly to the redis server
-	p, err := pubsub.New(redisAddress, redisPassword)
+	p, err := pubsub.New(s.Addr(), redisPassword)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -37,57 +34,189 @@ func TestPubSub(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	assertReceiveMessages(t, ch)
+	assertServerMessage(t, s, ch, testMessage)
 }
 
 func TestPubSubWithSentinel(t *testing.T) {
-	if testing.Short() {
-		t.Skip("skipping integration tests")
+	primary := redistest.NewServer(redistest.Primary)
+	defer primary.Close()
+	primary.RequireAuth("", redisPassword)
+
+	sentinel := redistest.NewServer(redistest.Sentinel)
+	defer sentinel.Close()
+	sentinel.RequireAuth("", redisPassword)
+	sentinel.SetTopology(primary)
+
+	// The sentinel addresses may contain authentication details
+	p, err := pubsub.NewWithSentinel(sentinelService, []string{"redis://:" + redisPassword + "@" + sentinel.Addr()}, redisPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer p.Shutdown()
+
+	ch, err := p.Subscribe(channel)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertServerMessage(t, primary, ch, testMessage)
+}
+
+func TestSubscribeContext(t *testing.T) {
+	s := redistest.NewServer(redistest.Primary)
+	defer s.Close()
+	s.RequireAuth("", redisPassword)
+
+	p, err := pubsub.New(s.Addr(), redisPassword)
+	if err != nil {
+		t.Fatal(err)
 	}
 
-	p, err := pubsub.NewWithSentinel(sentinelService, []string{sentinelAddress}, redisPassword)
+	defer p.Shutdown()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ch, err := p.SubscribeContext(ctx, channel)
 	if err != nil {
 		t.Fatal(err)
 	}
 
+	// Unsubscribing closes the channel
+	cancel()
+	for range ch {
+	}
+
+	if s.Subscriptions() != 0 {
+		t.Fatal("still subscribed")
+	}
+
+	// Rotating the password keeps the existing connections
+	s.RequireAuth("", "rotated")
+	p.SetPassword("rotated")
+	if _, err := p.Snapshot(channel, "missing"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGap(t *testing.T) {
+	s := redistest.NewServer(redistest.Primary)
+	defer s.Close()
+
+	p, err := pubsub.New(s.Addr(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
 	defer p.Shutdown()
 
 	ch, err := p.Subscribe(channel)
 	if err != nil {
 		t.Fatal(err)
 	}
-	assertReceiveMessages(t, ch)
+	assertServerMessage(t, s, ch, "before")
+
+	// The messages published while reconnecting are lost
+	s.Disconnect()
+	assertGap(t, ch, channel)
+
+	// The gap is only signalled once subscribed again, so nothing published after it is lost
+	if s.Publish(channel, "after") == 0 {
+		t.Fatal("gap signalled before subscribing again")
+	}
+	select {
+	case m := <-ch:
+		if string(m.Payload) != "after" {
+			t.Fatalf("wrong message: %#v", m)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("message published after the gap not received")
+	}
 }
 
-func assertReceiveMessages(t *testing.T, ch <-chan []byte) {
-	var wg sync.WaitGroup
-	wg.Add(1)
-	go func() {
-		actual := <-ch
-		if string(actual) != message {
-			t.Error("invalid message")
+func TestPublish(t *testing.T) {
+	s := redistest.NewServer(redistest.Primary)
+	defer s.Close()
+
+	p, err := pubsub.New(s.Addr(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Shutdown()
+
+	ch, err := p.Subscribe(channel)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := p.Publish(channel, []byte(testMessage)); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case m := <-ch:
+		if string(m.Payload) != testMessage {
+			t.Fatalf("wrong message: %s", m.Payload)
 		}
-		wg.Done()
-	}()
-	sendMessage(t)
-	wg.Wait()
+	case <-time.After(time.Second * 5):
+		t.Fatal("no message")
+	}
 }
 
-func sendMessage(t *testing.T) {
-	t.Helper()
+func TestSnapshot(t *testing.T) {
+	s := redistest.NewServer(redistest.Primary)
+	defer s.Close()
 
-	s, err := radix.NewSentinel(sentinelService, []string{sentinelAddress})
+	p, err := pubsub.New(s.Addr(), "")
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	addr, _ := s.Addrs()
+	defer p.Shutdown()
+
+	s.SetHash("snapshot", map[string]string{"a": "1", "b": "2"})
+
+	messages, err := p.Snapshot(channel, "snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(messages) != 2 {
+		t.Fatalf("wrong number of messages: %d", len(messages))
+	}
+
+	for _, m := range messages {
+		if m.Channel != channel || string(m.Payload) == "" || m.Headers["key"] == "" {
+			t.Errorf("invalid message %#v", m)
+		}
+	}
 
-	conn, err := radix.Dial("tcp", addr, radix.DialAuthPass(redisPassword))
+	messages, err = p.Snapshot(channel, "nonexistent")
 	if err != nil {
 		t.Fatal(err)
 	}
-	defer conn.Close()
 
-	conn.Do(radix.Cmd(nil, "PUBLISH", channel, message))
+	if len(messages) != 0 {
+		t.Fatal("got messages for nonexistent key")
+	}
+}
+
+// assertGap waits for a gap message, skipping any messages before it
+func assertGap(t *testing.T, ch <-chan *message.Message, channel string) {
+	t.Helper()
+
+	timeout := time.After(time.Second * 5)
+	for {
+		select {
+		case m, open := <-ch:
+			if !open {
+				t.Fatal("channel closed")
+			}
+			if m.Gap {
+				if m.Channel != channel || m.Payload != nil {
+					t.Fatalf("wrong gap: %#v", m)
+				}
+				return
+			}
+		case <-timeout:
+			t.Fatal("no gap")
+		}
+	}
 }
@@ -0,0 +1,120 @@
+package pubsub_test
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/mediocregopher/radix/v3"
+	"github.com/mullvad/message-queue/message"
+	"github.com/mullvad/message-queue/pubsub"
+)
+
+// These tests run against a real redis server, and redis sentinel, if their addresses are set, such as the ones started
+// with test/docker-compose.yml:
+//
+//	MQ_REDIS_ADDR=redis://127.0.0.1:6379 MQ_REDIS_SENTINEL_ADDR=redis://:foobar@127.0.0.1:26379 go test ./pubsub
+//
+// Both the sentinels and the redis servers should have authentication enabled, with the password "foobar", and the
+// sentinels should monitor the redis server in a group named "group"
+
+func TestRedis(t *testing.T) {
+	redisAddress := os.Getenv("MQ_REDIS_ADDR")
+	if redisAddress == "" {
+		t.Skip("MQ_REDIS_ADDR not set, skipping the tests against a real redis server")
+	}
+
+	conn, err := radix.Dial("tcp", redisAddress, radix.DialAuthPass(redisPassword))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	t.Run("pubsub", func(t *testing.T) {
+		p, err := pubsub.New(redisAddress, redisPassword)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer p.Shutdown()
+
+		ch, err := p.Subscribe(channel)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertRedisMessage(t, conn, ch)
+	})
+
+	t.Run("sentinel", func(t *testing.T) {
+		sentinelAddress := os.Getenv("MQ_REDIS_SENTINEL_ADDR")
+		if sentinelAddress == "" {
+			t.Skip("MQ_REDIS_SENTINEL_ADDR not set, skipping the tests against a real redis sentinel")
+		}
+
+		p, err := pubsub.NewWithSentinel(sentinelService, []string{sentinelAddress}, redisPassword)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer p.Shutdown()
+
+		ch, err := p.Subscribe(channel)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertRedisMessage(t, conn, ch)
+	})
+
+	t.Run("snapshot", func(t *testing.T) {
+		p, err := pubsub.New(redisAddress, redisPassword)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer p.Shutdown()
+
+		if err := conn.Do(radix.Cmd(nil, "HSET", "snapshot", "a", "1", "b", "2")); err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Do(radix.Cmd(nil, "DEL", "snapshot"))
+
+		messages, err := p.Snapshot(channel, "snapshot")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(messages) != 2 {
+			t.Fatalf("wrong number of messages: %d", len(messages))
+		}
+
+		for _, m := range messages {
+			if m.Channel != channel || string(m.Payload) == "" || m.Headers["key"] == "" {
+				t.Errorf("invalid message %#v", m)
+			}
+		}
+	})
+}
+
+// assertRedisMessage publishes a message on the redis server, until it's received as subscribing may not have been
+// confirmed yet
+func assertRedisMessage(t *testing.T, conn radix.Conn, ch <-chan *message.Message) {
+	t.Helper()
+
+	timeout := time.After(time.Second * 5)
+	for {
+		if err := conn.Do(radix.Cmd(nil, "PUBLISH", channel, testMessage)); err != nil {
+			t.Fatal(err)
+		}
+
+		select {
+		case m := <-ch:
+			if string(m.Payload) != testMessage || m.Channel != channel {
+				t.Fatalf("wrong message: %s", m.Payload)
+			}
+			return
+		case <-time.After(time.Millisecond * 100):
+		case <-timeout:
+			t.Fatal("no message received")
+		}
+	}
+}
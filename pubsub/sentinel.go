@@ -0,0 +1,308 @@
+package pubsub
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mediocregopher/radix/v3"
+	"github.com/mediocregopher/radix/v3/resp/resp2"
+)
+
+// Failover is a switch to another primary redis server by redis sentinel
+type Failover struct {
+	Service     string
+	Previous    string    // The address of the previous primary
+	Primary     string    // The address of the new primary
+	Down        time.Time // When sentinel considered the previous primary down, or zero if that wasn't seen
+	Switched    time.Time // When sentinel announced the new primary
+	Reconnected time.Time // When the subscriptions were moved over
+}
+
+// Duration returns how long the failover took, from the previous primary being considered down, or the switch if
+// that wasn't seen, until the subscriptions were moved over
+func (f Failover) Duration() time.Duration {
+	if f.Down.IsZero() {
+		return f.Reconnected.Sub(f.Switched)
+	}
+	return f.Reconnected.Sub(f.Down)
+}
+
+// NewWithSentinel creates a new PubSub client and establishes the connection to redis using sentinel
+// The sentinels are authenticated with using the details in their addresses, unless WithSentinelAuth is given
+// Failovers announced by the sentinels are followed right away, rather than once the connection breaks
+func NewWithSentinel(serviceName string, sentinelAddrs []string, serverPass string, opts ...Option) (*PubSub, error) {
+	p := newPubSub(serverPass, opts)
+
+	// The sentinel client connects to the primary for regular commands
+	sentinelOpts := []radix.SentinelOpt{
+		radix.SentinelPoolFunc(func(network, address string) (radix.Client, error) {
+			return radix.NewPool(network, address, 1, radix.PoolConnFunc(p.dial))
+		}),
+	}
+
+	// The sentinels discovered later on don't have any authentication details in their addresses
+	if p.options.sentinelAuth || p.options.sentinelTLSConfig != nil {
+		sentinelOpts = append(sentinelOpts, radix.SentinelConnFunc(p.dialSentinel))
+	}
+
+	s, err := radix.NewSentinel(serviceName, sentinelAddrs, sentinelOpts...)
+	if err != nil {
+		return nil, err
+	}
+
+	primary, _ := s.Addrs()
+	p.sentinel = &sentinelState{
+		service:       serviceName,
+		sentinel:      s,
+		sentinelAddrs: sentinelAddrs,
+		primary:       primary,
+	}
+
+	p.ctx, p.cancel = context.WithCancel(context.Background())
+
+	connFunc := radix.PersistentPubSubConnFunc(func(string, string) (radix.Conn, error) {
+		return p.dialSubscriber()
+	})
+
+	conn, err := radix.PersistentPubSubWithOpts("", "", connFunc)
+	if err != nil {
+		// This should never happen since we don't set a retry limit on the connection above
+		p.cancel()
+		s.Close()
+		return nil, err
+	}
+
+	p.conn = conn
+	p.client = s
+
+	if err := p.watchFailovers(); err != nil {
+		p.Shutdown()
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// sentinelState keeps track of the primary managed by redis sentinel, and the connection used for subscribing
+type sentinelState struct {
+	service       string
+	sentinel      *radix.Sentinel
+	sentinelAddrs []string // The sentinels given, which have any authentication details in their addresses
+	events        radix.PubSubConn
+
+	mutex    sync.Mutex
+	primary  string     // The address of the primary, updated as soon as a failover is announced
+	conn     radix.Conn // The connection used for subscribing
+	down     time.Time  // When the primary was considered down, if it is
+	failover *Failover  // The failover in progress, until the subscriptions have been moved over
+}
+
+func (s *sentinelState) close() {
+	if s.events != nil {
+		s.events.Close()
+	}
+}
+
+// dialSentinel connects to a sentinel using the sentinel authentication and TLS options
+func (p *PubSub) dialSentinel(network, address string) (radix.Conn, error) {
+	return dial(network, address, p.options.sentinelUsername, p.options.sentinelPassword, p.options.sentinelTLSConfig)
+}
+
+// dialSubscriber connects to a replica if enabled and available, and to the primary otherwise, for subscribing
+func (p *PubSub) dialSubscriber() (radix.Conn, error) {
+	s := p.sentinel
+
+	// The persistent connection keeps reconnecting when the connection breaks as it's closed
+	if p.ctx.Err() != nil {
+		return nil, p.ctx.Err()
+	}
+
+	s.mutex.Lock()
+	primary := s.primary
+	s.mutex.Unlock()
+
+	var conn radix.Conn
+	if p.options.replicas {
+		_, replicas := s.sentinel.Addrs()
+		if len(replicas) > 0 {
+			// The replicas may be out of date during a failover, in which case the primary is used
+			replica := replicas[rand.Intn(len(replicas))]
+			var err error
+			conn, err = p.dialRole(replica, "slave")
+			if err != nil {
+				log.Printf("error connecting to redis replica %s, using the primary: %s", replica, err)
+			}
+		}
+	}
+
+	if conn == nil {
+		var err error
+		conn, err = p.dialRole(primary, "master")
+		if err != nil {
+			// The primary may have changed without an announcement reaching us
+			current, _ := s.sentinel.Addrs()
+			s.mutex.Lock()
+			if s.primary == primary {
+				s.primary = current
+			}
+			s.mutex.Unlock()
+
+			return nil, err
+		}
+	}
+
+	s.mutex.Lock()
+	reconnected := s.conn != nil
+	s.conn = conn
+	failover := s.failover
+	s.failover = nil
+	s.mutex.Unlock()
+
+	// The connection is only ever dialed again after losing it, or following a failover, and the messages published in
+	// the meantime
+	if reconnected {
+		conn = p.resubscribing(conn)
+	}
+
+	if failover != nil {
+		failover.Reconnected = time.Now()
+		log.Printf("redis failover of %s from %s to %s completed in %s", failover.Service, failover.Previous, failover.Primary, failover.Duration())
+
+		if p.options.failoverHandler != nil {
+			p.options.failoverHandler(*failover)
+		}
+	}
+
+	return conn, nil
+}
+
+// dialRole connects to the redis server, and checks that it has the given role
+func (p *PubSub) dialRole(address string, role string) (radix.Conn, error) {
+	if address == "" {
+		return nil, fmt.Errorf("redis sentinel doesn't know the address of the %s", role)
+	}
+
+	conn, err := p.dial("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	var rawRoleOutput []resp2.RawMessage
+	err = conn.Do(radix.Cmd(&rawRoleOutput, "ROLE"))
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	var actual resp2.BulkString
+	if len(rawRoleOutput) == 0 {
+		err = fmt.Errorf("empty role")
+	} else {
+		err = rawRoleOutput[0].UnmarshalInto(&actual)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if actual.S != role {
+		conn.Close()
+		return nil, fmt.Errorf("%s has the role %q rather than %q", address, actual.S, role)
+	}
+
+	return conn, nil
+}
+
+// watchFailovers listens to the events of the sentinels, and moves the subscriptions over as soon as a failover is
+// announced
+func (p *PubSub) watchFailovers() error {
+	s := p.sentinel
+
+	// Take turns trying the sentinels
+	next := 0
+	connFunc := radix.PersistentPubSubConnFunc(func(string, string) (radix.Conn, error) {
+		address := s.sentinelAddrs[next%len(s.sentinelAddrs)]
+		next++
+
+		if p.options.sentinelAuth || p.options.sentinelTLSConfig != nil {
+			return p.dialSentinel("tcp", address)
+		}
+		return radix.Dial("tcp", address)
+	})
+
+	events, err := radix.PersistentPubSubWithOpts("", "", connFunc)
+	if err != nil {
+		return err
+	}
+	s.events = events
+
+	ch := make(chan radix.PubSubMessage)
+	if err := events.Subscribe(ch, "+switch-master", "+odown", "-odown"); err != nil {
+		return err
+	}
+
+	go func() {
+		for {
+			select {
+			case m := <-ch:
+				p.handleSentinelEvent(m.Channel, strings.Fields(string(m.Message)))
+			case <-p.ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return nil
+}
+
+// handleSentinelEvent keeps track of the primary being down, and switches to a new primary
+func (p *PubSub) handleSentinelEvent(event string, fields []string) {
+	s := p.sentinel
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	switch event {
+	case "+odown", "-odown":
+		// <instance-type> <name> <ip> <port>
+		if len(fields) < 4 || fields[0] != "master" || fields[1] != s.service {
+			return
+		}
+
+		if event == "+odown" {
+			log.Printf("redis sentinel considers the primary %s of %s down", net.JoinHostPort(fields[2], fields[3]), s.service)
+			s.down = time.Now()
+		} else {
+			s.down = time.Time{}
+		}
+	case "+switch-master":
+		// <name> <old-ip> <old-port> <new-ip> <new-port>
+		if len(fields) != 5 || fields[0] != s.service {
+			return
+		}
+
+		failover := &Failover{
+			Service:  s.service,
+			Previous: net.JoinHostPort(fields[1], fields[2]),
+			Primary:  net.JoinHostPort(fields[3], fields[4]),
+			Down:     s.down,
+			Switched: time.Now(),
+		}
+		log.Printf("redis sentinel switched the primary of %s from %s to %s", s.service, failover.Previous, failover.Primary)
+
+		s.primary = failover.Primary
+		s.failover = failover
+		s.down = time.Time{}
+
+		// Closing the connection makes the subscriptions reconnect, to the new primary
+		if s.conn != nil {
+			s.conn.Close()
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package pubsub_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mullvad/message-queue/message"
+	"github.com/mullvad/message-queue/pubsub"
+	"github.com/mullvad/message-queue/test/redistest"
+)
+
+func TestSentinelFailover(t *testing.T) {
+	t.Run("follow switch-master", func(t *testing.T) {
+		primary, replica := redistest.NewServer(redistest.Primary), redistest.NewServer(redistest.Replica)
+		defer primary.Close()
+		defer replica.Close()
+
+		sentinel := redistest.NewServer(redistest.Sentinel)
+		defer sentinel.Close()
+		sentinel.SetTopology(primary, replica)
+
+		failovers := make(chan pubsub.Failover, 1)
+		p, err := pubsub.NewWithSentinel(sentinelService, []string{sentinel.Addr()}, "", pubsub.WithFailoverHandler(func(f pubsub.Failover) {
+			failovers <- f
+		}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer p.Shutdown()
+
+		ch, err := p.Subscribe(channel)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertServerMessage(t, primary, ch, "before")
+
+		// Announce the failover, without the connection to the previous primary breaking
+		sentinel.Failover(sentinelService, replica)
+
+		select {
+		case f := <-failovers:
+			if f.Previous != primary.Addr() || f.Primary != replica.Addr() || f.Down.IsZero() || f.Duration() <= 0 {
+				t.Fatalf("wrong failover: %+v", f)
+			}
+		case <-time.After(time.Second * 5):
+			t.Fatal("failover not reported")
+		}
+
+		assertGap(t, ch, channel)
+		assertServerMessage(t, replica, ch, "after")
+
+		if primary.Subscriptions() != 0 {
+			t.Fatal("still subscribed on the previous primary")
+		}
+	})
+
+	t.Run("reconnect after disconnect", func(t *testing.T) {
+		primary := redistest.NewServer(redistest.Primary)
+		defer primary.Close()
+
+		sentinel := redistest.NewServer(redistest.Sentinel)
+		defer sentinel.Close()
+		sentinel.SetTopology(primary)
+
+		p, err := pubsub.NewWithSentinel(sentinelService, []string{sentinel.Addr()}, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer p.Shutdown()
+
+		ch, err := p.Subscribe(channel)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertServerMessage(t, primary, ch, "before")
+
+		// The subscriptions are restored on the same primary
+		primary.Disconnect()
+
+		assertGap(t, ch, channel)
+		assertServerMessage(t, primary, ch, "after")
+	})
+
+	t.Run("subscribe on replica", func(t *testing.T) {
+		primary, replica := redistest.NewServer(redistest.Primary), redistest.NewServer(redistest.Replica)
+		defer primary.Close()
+		defer replica.Close()
+
+		sentinel := redistest.NewServer(redistest.Sentinel)
+		defer sentinel.Close()
+		sentinel.SetTopology(primary, replica)
+
+		p, err := pubsub.NewWithSentinel(sentinelService, []string{sentinel.Addr()}, "", pubsub.WithReplicas())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer p.Shutdown()
+
+		ch, err := p.Subscribe(channel)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertServerMessage(t, replica, ch, "replicated")
+
+		if primary.Subscriptions() != 0 {
+			t.Fatal("subscribed on the primary")
+		}
+	})
+}
+
+// assertServerMessage keeps publishing the payload on the server until it's received, as the subscriptions may be
+// moving over
+func assertServerMessage(t *testing.T, s *redistest.Server, ch <-chan *message.Message, payload string) {
+	t.Helper()
+
+	ticker := time.NewTicker(time.Millisecond * 10)
+	defer ticker.Stop()
+
+	timeout := time.After(time.Second * 5)
+	for {
+		select {
+		case m := <-ch:
+			if string(m.Payload) == payload {
+				return
+			}
+		case <-ticker.C:
+			s.Publish(channel, payload)
+		case <-timeout:
+			t.Fatalf("%q not received", payload)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package pubsub_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/mullvad/message-queue/pubsub"
+	"github.com/mullvad/message-queue/test/redistest"
+)
+
+const (
+	aclUsername = "message-queue"
+	aclPassword = "secret"
+)
+
+func TestTLS(t *testing.T) {
+	ca, caKey := newCertificate(t, nil, nil, true)
+	server, serverKey := newCertificate(t, ca, caKey, false)
+	client, clientKey := newCertificate(t, ca, caKey, false)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+
+	s := redistest.NewTLSServer(redistest.Primary, &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{server.Raw}, PrivateKey: serverKey}},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    roots,
+	})
+	defer s.Close()
+	s.RequireAuth(aclUsername, aclPassword)
+
+	address := s.Addr()
+
+	clientCertificate := tls.Certificate{Certificate: [][]byte{client.Raw}, PrivateKey: clientKey}
+
+	t.Run("mutual TLS with ACL user", func(t *testing.T) {
+		p, err := pubsub.New(address, aclPassword, pubsub.WithUsername(aclUsername), pubsub.WithTLS(&tls.Config{
+			RootCAs:      roots,
+			Certificates: []tls.Certificate{clientCertificate},
+		}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer p.Shutdown()
+
+		ch, err := p.Subscribe(channel)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertServerMessage(t, s, ch, testMessage)
+	})
+
+	for _, test := range []struct {
+		name     string
+		username string
+		config   *tls.Config
+	}{
+		{"wrong user", "default", &tls.Config{RootCAs: roots, Certificates: []tls.Certificate{clientCertificate}}},
+		{"without client certificate", aclUsername, &tls.Config{RootCAs: roots}},
+		{"unknown CA", aclUsername, &tls.Config{Certificates: []tls.Certificate{clientCertificate}}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			p, err := pubsub.New(address, aclPassword, pubsub.WithUsername(test.username), pubsub.WithTLS(test.config))
+			if err == nil {
+				p.Shutdown()
+				t.Fatal("no error")
+			}
+		})
+	}
+}
+
+// newCertificate creates a certificate for 127.0.0.1, signed by the parent if set, and self-signed otherwise
+func newCertificate(t *testing.T, parent *x509.Certificate, parentKey *ecdsa.PrivateKey, isCA bool) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: "message-queue test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  isCA,
+	}
+
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return certificate, key
+}
@@ -0,0 +1,52 @@
+package queue
+
+import (
+	"time"
+)
+
+// Ack acknowledges a message by its sequence number, or every message up to and including it if cumulative
+type Ack struct {
+	Sequence   uint64
+	Cumulative bool
+}
+
+// WithAcks makes the subscriber acknowledge the messages it has received
+// On work queue channels, messages that aren't acknowledged within the timeout, or before the subscriber goes away,
+// are redelivered. Subscribers are given at most as many unacknowledged messages as the buffer size.
+// On broadcast channels, acknowledgements are only used for sessions, see WithSession.
+func WithAcks(acks <-chan Ack, timeout time.Duration) SubscribeOption {
+	return func(s *subscriber) {
+		s.acks = acks
+		s.ackTimeout = timeout
+	}
+}
+
+func (a Ack) covers(sequence uint64) bool {
+	if a.Cumulative {
+		return sequence <= a.Sequence
+	}
+	return sequence == a.Sequence
+}
+
+// ackWorker receives acknowledgements from a subscriber until it goes away
+func (q *Queue) ackWorker(c *channel, s *subscriber) {
+	for {
+		select {
+		case a, open := <-s.acks:
+			if !open {
+				return
+			}
+
+			q.mutex.Lock()
+			if s.session != nil {
+				s.session.ack(a)
+			}
+			if len(s.takeInflight(func(i inflight) bool { return a.covers(i.message.Sequence) })) > 0 {
+				c.flushBacklog()
+			}
+			q.mutex.Unlock()
+		case <-s.context.Done():
+			return
+		}
+	}
+}
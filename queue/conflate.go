@@ -0,0 +1,168 @@
+package queue
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"regexp"
+	"sync"
+
+	"github.com/mullvad/message-queue/message"
+)
+
+// KeyFunc extracts the key of a message, and returns false if the message has no key
+type KeyFunc func(m *message.Message) (string, bool)
+
+// FieldKey returns a KeyFunc using a field in the JSON payload as the key, see message.Field
+func FieldKey(path string) KeyFunc {
+	return func(m *message.Message) (string, bool) {
+		value, ok := m.Field(path)
+		if !ok || value == nil {
+			return "", false
+		}
+
+		switch value.(type) {
+		case map[string]interface{}, []interface{}:
+			return "", false
+		}
+
+		return fmt.Sprint(value), true
+	}
+}
+
+// PrefixKey returns a KeyFunc using the start of the payload up to the separator as the key
+// This is intended for publishers that prefix every payload with its key, such as "BTC-USD|{...}"
+func PrefixKey(separator string) KeyFunc {
+	return func(m *message.Message) (string, bool) {
+		i := bytes.Index(m.Payload, []byte(separator))
+		if i <= 0 {
+			return "", false
+		}
+
+		return string(m.Payload[:i]), true
+	}
+}
+
+// RegexKey returns a KeyFunc using the first submatch of the regular expression in the payload as the key
+// This is intended for payloads that aren't JSON, such as "order 1234: {...}" with the expression `^order (\d+):`
+func RegexKey(re *regexp.Regexp) KeyFunc {
+	return func(m *message.Message) (string, bool) {
+		match := re.FindSubmatch(m.Payload)
+		if len(match) < 2 || len(match[1]) == 0 {
+			return "", false
+		}
+
+		return string(match[1]), true
+	}
+}
+
+// WithConflation makes slow subscribers only keep the latest pending message for every key, instead of disconnecting
+// them when their buffer is full. Subscribers are still disconnected if they fall behind on more keys than the buffer
+// size. Messages without a key are never conflated. Work queue channels can't be conflated, see WithDispatch.
+func WithConflation(key KeyFunc) ChannelOption {
+	return func(c *channel) {
+		c.conflateKey = key
+	}
+}
+
+// conflator is a subscriber buffer keeping the latest pending message for every key, in the order the keys were added
+type conflator struct {
+	mutex   sync.Mutex
+	keys    []string
+	pending map[string]*message.Message
+	size    int
+	unkeyed uint64 // The number of messages pushed without a key, to keep them apart
+	notify  chan struct{}
+	done    chan struct{}
+}
+
+func newConflator(size int) *conflator {
+	return &conflator{
+		pending: make(map[string]*message.Message),
+		size:    size,
+		notify:  make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+}
+
+// push adds a message to the buffer, replacing any pending message with the same key
+// Returns false if the buffer is full
+func (c *conflator) push(key string, m *message.Message) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if _, ok := c.pending[key]; !ok {
+		if len(c.keys) >= c.size {
+			return false
+		}
+		c.keys = append(c.keys, key)
+	}
+	c.pending[key] = m
+
+	select {
+	case c.notify <- struct{}{}:
+	default:
+	}
+
+	return true
+}
+
+// pushUnkeyed adds a message that's never conflated to the buffer
+// Returns false if the buffer is full
+func (c *conflator) pushUnkeyed(m *message.Message) bool {
+	c.mutex.Lock()
+	c.unkeyed++
+	key := fmt.Sprintf("\x00%d", c.unkeyed)
+	c.mutex.Unlock()
+
+	return c.push(key, m)
+}
+
+func (c *conflator) pop() (*message.Message, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if len(c.keys) == 0 {
+		return nil, false
+	}
+
+	key := c.keys[0]
+	c.keys = c.keys[1:]
+
+	m := c.pending[key]
+	delete(c.pending, key)
+
+	return m, true
+}
+
+// stop makes run exit and close the subscriber channel
+func (c *conflator) stop() {
+	close(c.done)
+}
+
+// run passes the buffered messages on to the subscriber channel until stopped, or the context ends
+func (c *conflator) run(ctx context.Context, channel chan<- *message.Message) {
+	defer close(channel)
+
+	for {
+		m, ok := c.pop()
+		if !ok {
+			select {
+			case <-c.notify:
+				continue
+			case <-c.done:
+				return
+			case <-ctx.Done():
+				return
+			}
+		}
+
+		select {
+		case channel <- m:
+		case <-c.done:
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package queue
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"time"
+
+	"github.com/mullvad/message-queue/message"
+)
+
+// ContentHash is a KeyFunc using the SHA-256 hash of the payload as the key
+func ContentHash(m *message.Message) (string, bool) {
+	sum := sha256.Sum256(m.Payload)
+	return hex.EncodeToString(sum[:]), true
+}
+
+// HeaderKey returns a KeyFunc using a header of the message envelope as the key
+func HeaderKey(name string) KeyFunc {
+	return func(m *message.Message) (string, bool) {
+		value, ok := m.Headers[name]
+		return value, ok && value != ""
+	}
+}
+
+// WithDeduplication drops the messages with the same ID as a message received within the window before them
+// This is intended for channels with several redundant sources, see AddSource. Messages without an ID are never
+// dropped. If the ID isn't set, the content hash of the messages is used, see ContentHash.
+func WithDeduplication(id KeyFunc, window time.Duration) ChannelOption {
+	if id == nil {
+		id = ContentHash
+	}
+
+	return func(c *channel) {
+		c.deduplicator = &deduplicator{
+			id:     id,
+			window: window,
+			seen:   make(map[string]struct{}),
+		}
+	}
+}
+
+// deduplicator keeps track of the IDs of the messages received within the window
+type deduplicator struct {
+	id     KeyFunc
+	window time.Duration
+	seen   map[string]struct{}
+	order  []seenID // Oldest first
+}
+
+type seenID struct {
+	id       string
+	received time.Time
+}
+
+// duplicate returns whether a message with the same ID has been received within the window, and remembers the ID
+// of the message otherwise
+func (d *deduplicator) duplicate(m *message.Message, now time.Time) bool {
+	// Forget the IDs that have fallen out of the window
+	for len(d.order) > 0 && now.Sub(d.order[0].received) > d.window {
+		delete(d.seen, d.order[0].id)
+		d.order = d.order[1:]
+	}
+
+	id, ok := d.id(m)
+	if !ok {
+		return false
+	}
+
+	if _, ok := d.seen[id]; ok {
+		return true
+	}
+
+	d.seen[id] = struct{}{}
+	d.order = append(d.order, seenID{id: id, received: now})
+
+	return false
+}
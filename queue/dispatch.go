@@ -0,0 +1,177 @@
+package queue
+
+import (
+	"log"
+	"sort"
+	"time"
+
+	"github.com/mullvad/message-queue/message"
+)
+
+// Dispatch decides how the messages of a channel are distributed among its subscribers
+type Dispatch int
+
+const (
+	// Broadcast delivers every message to every subscriber
+	Broadcast Dispatch = iota
+	// RoundRobin delivers every message to one subscriber, taking turns
+	RoundRobin
+	// LeastLoaded delivers every message to the subscriber with the fewest pending messages
+	LeastLoaded
+)
+
+// dispatchInterval is how often work queue channels check for unacknowledged messages and retry their backlog
+const dispatchInterval = time.Millisecond * 100
+
+// WithDispatch makes the channel a work queue, where every message is delivered to exactly one subscriber
+// Subscribers with a full buffer are skipped instead of disconnected. Messages that no subscriber can take are kept
+// in a backlog of the same size as the subscriber buffers, and dropped if the backlog is full.
+func WithDispatch(d Dispatch) ChannelOption {
+	return func(c *channel) {
+		c.dispatch = d
+	}
+}
+
+type inflight struct {
+	message  *message.Message
+	deadline time.Time
+}
+
+// takeInflight removes and returns the unacknowledged messages matching the predicate, ordered by sequence number
+func (s *subscriber) takeInflight(predicate func(inflight) bool) []*message.Message {
+	var messages []*message.Message
+	for sequence, i := range s.inflight {
+		if predicate(i) {
+			messages = append(messages, i.message)
+			delete(s.inflight, sequence)
+		}
+	}
+
+	sort.Slice(messages, func(i, j int) bool {
+		return messages[i].Sequence < messages[j].Sequence
+	})
+
+	return messages
+}
+
+// load returns the number of pending messages of the subscriber
+// Work queue channels are never conflated, so their subscribers always buffer their messages in their channel
+func (s *subscriber) load() int {
+	if s.acks != nil {
+		return len(s.inflight)
+	}
+
+	return len(s.channel)
+}
+
+// full returns whether the subscriber can't take any more messages
+func (s *subscriber) full() bool {
+	if s.acks != nil {
+		return len(s.inflight) >= cap(s.channel) || len(s.channel) == cap(s.channel)
+	}
+
+	return len(s.channel) == cap(s.channel)
+}
+
+// dispatchMessage passes a message on to a single subscriber, or keeps it in the backlog if no subscriber can take it
+func (c *channel) dispatchMessage(m *message.Message) {
+	if c.dispatchOne(m) {
+		return
+	}
+
+	if len(c.backlog) >= c.bufferSize {
+		log.Printf("dropping message %d from %s: backlog full", m.Sequence, m.Channel)
+		return
+	}
+
+	c.backlog = append(c.backlog, m)
+}
+
+// dispatchOne passes a message on to a single subscriber, and returns false if no subscriber can take it
+func (c *channel) dispatchOne(m *message.Message) bool {
+	var next *subscriber
+	for s := range c.subscribers {
+		select {
+		case <-s.context.Done():
+			c.removeSubscriber(s)
+			continue
+		default:
+		}
+
+		if (s.filter != nil && !s.filter.Match(m)) || s.full() {
+			continue
+		}
+
+		if next == nil || c.before(s, next) {
+			next = s
+		}
+	}
+
+	if next == nil || !c.deliver(next, m) {
+		return false
+	}
+
+	c.dispatched++
+	next.lastDispatch = c.dispatched
+
+	if next.acks != nil {
+		next.inflight[m.Sequence] = inflight{
+			message:  m,
+			deadline: time.Now().Add(next.ackTimeout),
+		}
+	}
+
+	return true
+}
+
+// before returns whether a should be given a message before b
+func (c *channel) before(a, b *subscriber) bool {
+	if c.dispatch == LeastLoaded {
+		aLoad, bLoad := a.load(), b.load()
+		if aLoad != bLoad {
+			return aLoad < bLoad
+		}
+	}
+
+	// Take turns, starting with the subscriber that has waited the longest
+	return a.lastDispatch < b.lastDispatch
+}
+
+// flushBacklog tries to dispatch the messages in the backlog
+func (c *channel) flushBacklog() {
+	backlog := c.backlog
+	c.backlog = nil
+
+	var remaining []*message.Message
+	for _, m := range backlog {
+		if !c.dispatchOne(m) {
+			remaining = append(remaining, m)
+		}
+	}
+
+	// Subscribers that have gone away in the meantime may have requeued messages
+	c.backlog = append(c.backlog, remaining...)
+}
+
+// requeue puts messages that were dispatched, but not acknowledged, first in the backlog regardless of its size
+func (c *channel) requeue(messages []*message.Message) {
+	c.backlog = append(messages, c.backlog...)
+}
+
+// redeliver requeues the messages that haven't been acknowledged in time, and retries the backlog
+func (c *channel) redeliver(now time.Time) {
+	for s := range c.subscribers {
+		if len(s.inflight) == 0 {
+			continue
+		}
+
+		expired := s.takeInflight(func(i inflight) bool {
+			return now.After(i.deadline)
+		})
+		if len(expired) > 0 {
+			c.requeue(expired)
+		}
+	}
+
+	c.flushBacklog()
+}
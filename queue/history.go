@@ -0,0 +1,141 @@
+package queue
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mullvad/message-queue/message"
+)
+
+// History stores the messages of a channel, for subscribers to resume from
+// It must be safe for concurrent use, as messages are appended while subscribers read from it
+type History interface {
+	Append(m *message.Message) error
+	// Since returns up to limit messages with a sequence number after the given one, oldest first
+	Since(sequence uint64, limit int) ([]*message.Message, error)
+	// SinceTime returns up to limit messages from the given time or later, oldest first
+	SinceTime(t time.Time, limit int) ([]*message.Message, error)
+	// LastSequence returns the sequence number of the last message, or zero if there are none
+	LastSequence() uint64
+}
+
+// maxResume is the maximum number of messages delivered to a subscriber resuming from the history
+const maxResume = 10000
+
+// WithHistory stores every message of the channel in the history, continuing from its last sequence number
+func WithHistory(h History) ChannelOption {
+	return func(c *channel) {
+		c.history = h
+	}
+}
+
+// WithResume delivers the messages after the given sequence number from the history of the channel, before any new
+// messages. At most 10000 messages are delivered, so subscribers that have fallen further behind than that should
+// start over instead.
+func WithResume(sequence uint64) SubscribeOption {
+	return func(s *subscriber) {
+		s.resume = &sequence
+	}
+}
+
+// History returns the history of a channel
+// Returns an error if the given channel doesn't exist, or doesn't keep any history
+func (q *Queue) History(channelName string) (History, error) {
+	q.mutex.RLock()
+	defer q.mutex.RUnlock()
+
+	c, ok := q.channels[channelName]
+	if !ok {
+		return nil, fmt.Errorf("%q: channel doesn't exist", channelName)
+	}
+
+	if c.history == nil {
+		return nil, fmt.Errorf("%q: channel doesn't keep any history", channelName)
+	}
+
+	return c.history, nil
+}
+
+// MemoryHistory keeps the latest messages of a channel in memory
+type MemoryHistory struct {
+	mutex    sync.Mutex
+	messages []*message.Message // Oldest first
+	size     int
+}
+
+// NewMemoryHistory creates a history keeping up to size messages, which must be at least one
+func NewMemoryHistory(size int) *MemoryHistory {
+	return &MemoryHistory{
+		size: size,
+	}
+}
+
+// Append adds a message to the history, forgetting the oldest message if the history is full
+func (h *MemoryHistory) Append(m *message.Message) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if len(h.messages) > 0 && m.Sequence <= h.messages[len(h.messages)-1].Sequence {
+		return fmt.Errorf("sequence number %d not after %d", m.Sequence, h.messages[len(h.messages)-1].Sequence)
+	}
+
+	if len(h.messages) >= h.size {
+		// Reuse the underlying array rather than growing it forever
+		copy(h.messages, h.messages[len(h.messages)-h.size+1:])
+		h.messages = h.messages[:h.size-1]
+	}
+
+	h.messages = append(h.messages, m)
+
+	return nil
+}
+
+// Since returns up to limit messages with a sequence number after the given one, oldest first
+func (h *MemoryHistory) Since(sequence uint64, limit int) ([]*message.Message, error) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	i := sort.Search(len(h.messages), func(i int) bool {
+		return h.messages[i].Sequence > sequence
+	})
+
+	return h.take(i, limit), nil
+}
+
+// SinceTime returns up to limit messages from the given time or later, oldest first
+func (h *MemoryHistory) SinceTime(t time.Time, limit int) ([]*message.Message, error) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	// Messages are stored in the order they were received, so their times are increasing
+	i := sort.Search(len(h.messages), func(i int) bool {
+		return !h.messages[i].Time.Before(t)
+	})
+
+	return h.take(i, limit), nil
+}
+
+// take returns a copy of up to limit messages starting at the index
+func (h *MemoryHistory) take(i, limit int) []*message.Message {
+	end := len(h.messages)
+	if end-i > limit {
+		end = i + limit
+	}
+
+	messages := make([]*message.Message, end-i)
+	copy(messages, h.messages[i:end])
+	return messages
+}
+
+// LastSequence returns the sequence number of the last message, or zero if there are none
+func (h *MemoryHistory) LastSequence() uint64 {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if len(h.messages) == 0 {
+		return 0
+	}
+	return h.messages[len(h.messages)-1].Sequence
+}
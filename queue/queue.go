@@ -2,40 +2,119 @@ package queue
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"log"
+	"sort"
 	"sync"
+	"time"
+
+	"github.com/mullvad/message-queue/message"
 )
 
-// Queue is a message queue with multiple channels, where every message is broadcast to all subscribers of a channel
+// Queue is a message queue with multiple channels, where every message is broadcast to all subscribers of a channel,
+// or dispatched to one of them for work queue channels
 // It will automatically close the channels for and remove subscribers whose context has ended, or buffer is full
 type Queue struct {
-	channels   map[string]channel
+	channels   map[string]*channel
 	mutex      sync.RWMutex
 	ctx        context.Context
 	bufferSize int // The message buffer size for each subscriber to a channel
 }
 
 type channel struct {
-	queue       <-chan []byte
-	subscribers map[subscriber]struct{}
+	subscribers map[*subscriber]struct{}
+	conflateKey KeyFunc   // Conflates the pending messages of subscribers by key, if set
+	snapshot    *snapshot // The current state of the channel delivered to new subscribers, if set
+	history     History   // Stores the messages for subscribers to resume from, if set
+
+	queue        <-chan *message.Message // The source the channel was created with
+	extra        chan *message.Message   // Messages from the sources added later, where nil means that one was closed
+	sources      int                     // The number of open sources, the channel is closed when there are none left
+	done         chan struct{}           // Closed when the worker exits
+	sequence     uint64                  // The sequence number of the last message
+	published    uint64                  // The sequence number of the last message passed on to subscribers, guarded by the mutex
+	deduplicator *deduplicator           // Drops messages already received from another source, if set
+
+	dispatch       Dispatch           // How messages are distributed among the subscribers
+	dispatched     uint64             // The number of messages dispatched, used for taking turns
+	backlog        []*message.Message // Messages that no subscriber could take yet, for work queue channels
+	bufferSize     int
+	maxSubscribers int // The maximum number of subscribers, if set
+
+	sessions      map[string]*session // Sessions of subscribers that may resume, by their ID
+	sessionsAdded chan struct{}       // Signals the worker that a session has been added, for it to start expiring them
+}
+
+// ChannelOption configures a queue channel
+type ChannelOption func(c *channel)
+
+// WithBufferSize sets the message buffer size for each subscriber to the channel, instead of the queue default
+func WithBufferSize(size int) ChannelOption {
+	return func(c *channel) {
+		c.bufferSize = size
+	}
+}
+
+// WithMaxSubscribers limits the number of subscribers to the channel
+// Subscribing to a channel with the maximum number of subscribers fails with ErrTooManySubscribers, unless the
+// subscriber takes over the session of a connected subscriber
+func WithMaxSubscribers(max int) ChannelOption {
+	return func(c *channel) {
+		c.maxSubscribers = max
+	}
 }
 
+// ErrTooManySubscribers is returned when subscribing to a channel with the maximum number of subscribers
+var ErrTooManySubscribers = errors.New("too many subscribers")
+
 type subscriber struct {
-	channel chan<- []byte
-	context context.Context
+	channel   chan<- *message.Message
+	context   context.Context
+	filter    Filter
+	conflator *conflator // Buffers the pending messages instead of the channel for conflated channels
+
+	acks         <-chan Ack
+	ackTimeout   time.Duration
+	inflight     map[uint64]inflight // Dispatched messages waiting for an acknowledgement
+	lastDispatch uint64              // The dispatch count when the subscriber was last given a message
+
+	sessionID        string
+	sessionRetention time.Duration
+	session          *session
+	inboxMessages    int
+	inboxBytes       int
+
+	resume  *uint64 // The sequence number to resume from, if set
+	resumed uint64  // The last sequence number delivered from the history
+}
+
+// Filter decides which messages are delivered to a subscriber
+type Filter interface {
+	Match(m *message.Message) bool
+}
+
+// SubscribeOption configures a subscription
+type SubscribeOption func(s *subscriber)
+
+// WithFilter only delivers the messages matching the filter to the subscriber
+func WithFilter(f Filter) SubscribeOption {
+	return func(s *subscriber) {
+		s.filter = f
+	}
 }
 
 // New creates a new queue
 func New(ctx context.Context, bufferSize int) *Queue {
 	return &Queue{
-		channels:   make(map[string]channel),
+		channels:   make(map[string]*channel),
 		ctx:        ctx,
 		bufferSize: bufferSize,
 	}
 }
 
 // CreateChannel creates a new queue channel and returns a channel for broadcasting to it
-func (q *Queue) CreateChannel(channelName string) (chan<- []byte, error) {
+func (q *Queue) CreateChannel(channelName string, options ...ChannelOption) (chan<- *message.Message, error) {
 	q.mutex.Lock()
 	defer q.mutex.Unlock()
 
@@ -44,58 +123,253 @@ func (q *Queue) CreateChannel(channelName string) (chan<- []byte, error) {
 		return nil, fmt.Errorf("%q: channel already exists", channelName)
 	}
 
-	ch := make(chan []byte)
+	ch := make(chan *message.Message)
 
-	c := channel{
+	c := &channel{
 		queue:       ch,
-		subscribers: make(map[subscriber]struct{}),
+		extra:       make(chan *message.Message),
+		sources:     1,
+		done:        make(chan struct{}),
+		subscribers: make(map[*subscriber]struct{}),
+		bufferSize:  q.bufferSize,
+		sessions:    make(map[string]*session),
+		// Buffered, as there's no need to signal the worker again until it has noticed the last one
+		sessionsAdded: make(chan struct{}, 1),
+	}
+	for _, option := range options {
+		option(c)
+	}
+
+	// Subscribers of work queue channels are skipped rather than disconnected when they fall behind
+	if c.conflateKey != nil && c.dispatch != Broadcast {
+		return nil, fmt.Errorf("%q: work queue channels can't be conflated", channelName)
 	}
 
 	q.channels[channelName] = c
 
-	go q.worker(channelName, &c)
+	go q.worker(channelName, c)
 
 	return ch, nil
 }
 
+// AddSource adds another source to an existing queue channel, and returns a channel for broadcasting to it
+// The queue channel is closed once all of its sources have been closed
+// Returns an error if the given channel doesn't exist
+func (q *Queue) AddSource(channelName string) (chan<- *message.Message, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	c, ok := q.channels[channelName]
+	if !ok || c.sources == 0 {
+		return nil, fmt.Errorf("%q: channel doesn't exist", channelName)
+	}
+
+	c.sources++
+
+	ch := make(chan *message.Message)
+	go c.forward(ch)
+
+	return ch, nil
+}
+
+// forward passes the messages from a source added later on to the worker, and tells it when the source is closed
+func (c *channel) forward(source <-chan *message.Message) {
+	for m := range source {
+		select {
+		case c.extra <- m:
+		case <-c.done:
+			return
+		}
+	}
+
+	select {
+	case c.extra <- nil:
+	case <-c.done:
+	}
+}
+
 func (q *Queue) worker(channelName string, c *channel) {
 	defer q.cleanup(channelName, c)
 
+	if c.history != nil {
+		c.sequence = c.history.LastSequence()
+	}
+
+	// Periodically redeliver unacknowledged messages and retry the backlog of work queue channels, and forget
+	// expired sessions, while other channels only need to wake up for messages
+	var ticker *time.Ticker
+	var tick <-chan time.Time
+	startTicking := func() {
+		if ticker == nil {
+			ticker = time.NewTicker(dispatchInterval)
+			tick = ticker.C
+		}
+	}
+	defer func() {
+		if ticker != nil {
+			ticker.Stop()
+		}
+	}()
+
+	if c.dispatch != Broadcast {
+		startTicking()
+	}
+
 	for {
 		select {
-		case message, open := <-c.queue:
-			// The channel has been closed, exit
+		case m, open := <-c.queue:
+			// The source has been closed, exit if it was the last one
 			if !open {
-				return
+				c.queue = nil
+				if q.closeSource(c) {
+					return
+				}
+				continue
 			}
 
-			func() {
-				q.mutex.Lock()
-				defer q.mutex.Unlock()
-
-				for subscriber := range c.subscribers {
-					// Check the subscribers context
-					select {
-					// If it's done, remove the subscriber
-					case <-subscriber.context.Done():
-						c.removeSubscriber(subscriber)
-					default:
-						// Otherwise, try to write to the subscribers channel
-						select {
-						case subscriber.channel <- message:
-						// If the write fails (buffer is full), remove the subscriber
-						default:
-							c.removeSubscriber(subscriber)
-						}
-					}
+			q.publish(channelName, c, m)
+		case m := <-c.extra:
+			if m == nil {
+				if q.closeSource(c) {
+					return
 				}
-			}()
+				continue
+			}
+
+			q.publish(channelName, c, m)
+		case <-c.sessionsAdded:
+			startTicking()
+		case now := <-tick:
+			q.mutex.Lock()
+			c.removeGoneSubscribers()
+			if c.dispatch != Broadcast {
+				c.redeliver(now)
+			}
+			c.expireSessions(now)
+			idle := c.dispatch == Broadcast && len(c.sessions) == 0
+			q.mutex.Unlock()
+
+			// Any session added since is signalled, starting the ticker again
+			if idle {
+				ticker.Stop()
+				ticker = nil
+				tick = nil
+			}
 		case <-q.ctx.Done():
 			return
 		}
 	}
 }
 
+// closeSource keeps track of a closed source, and returns true if it was the last one
+func (q *Queue) closeSource(c *channel) bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	c.sources--
+	return c.sources == 0
+}
+
+// publish numbers a message, and passes it on to the subscribers
+func (q *Queue) publish(channelName string, c *channel, m *message.Message) {
+	if m.Gap {
+		q.mutex.Lock()
+		defer q.mutex.Unlock()
+
+		c.broadcastGap(m)
+		return
+	}
+
+	if c.deduplicator != nil && c.deduplicator.duplicate(m, time.Now()) {
+		return
+	}
+
+	// Copy the message before numbering it, as the source may pass the same message to several channels
+	c.sequence++
+	msg := *m
+	msg.Sequence = c.sequence
+
+	// Store the message before broadcasting it, so that subscribers resuming in the meantime don't miss it
+	if c.history != nil {
+		if err := c.history.Append(&msg); err != nil {
+			log.Printf("error storing message %d in %s: %s", msg.Sequence, channelName, err)
+		}
+	}
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	c.published = msg.Sequence
+
+	if c.snapshot != nil {
+		c.snapshot.update(&msg)
+	}
+
+	if c.dispatch == Broadcast {
+		c.broadcast(&msg)
+	} else {
+		c.flushBacklog()
+		c.dispatchMessage(&msg)
+	}
+}
+
+// broadcast passes a message on to all subscribers, removing the ones that have gone away or can't keep up
+func (c *channel) broadcast(m *message.Message) {
+	for subscriber := range c.subscribers {
+		// Check the subscribers context
+		select {
+		// If it's done, remove the subscriber
+		case <-subscriber.context.Done():
+			c.removeSubscriber(subscriber)
+		default:
+			// Skip the messages the subscriber isn't interested in, or has already got from the history
+			if (subscriber.filter != nil && !subscriber.filter.Match(m)) || m.Sequence <= subscriber.resumed {
+				continue
+			}
+
+			// Otherwise, try to deliver the message, and remove the subscriber if the buffer is full
+			if !c.deliver(subscriber, m) {
+				c.removeSubscriber(subscriber)
+				continue
+			}
+
+			// Keep track of the message until it's acknowledged, and remove subscribers that fall too far behind
+			if subscriber.session != nil && subscriber.acks != nil && !subscriber.session.track(m, c.bufferSize) {
+				c.removeSubscriber(subscriber)
+			}
+		}
+	}
+
+	// Keep the message for the sessions that are disconnected
+	for _, s := range c.sessions {
+		if s.subscriber == nil {
+			s.store(m)
+		}
+	}
+}
+
+// broadcastGap passes a gap on to all subscribers, no matter their filter or the dispatch of the channel, as they may
+// all have missed messages, removing the ones that have gone away or can't keep up
+// Gaps aren't numbered or stored in the history
+func (c *channel) broadcastGap(m *message.Message) {
+	for subscriber := range c.subscribers {
+		select {
+		case <-subscriber.context.Done():
+			c.removeSubscriber(subscriber)
+		default:
+			if !c.deliver(subscriber, m) {
+				c.removeSubscriber(subscriber)
+			}
+		}
+	}
+
+	for _, s := range c.sessions {
+		if s.subscriber == nil {
+			s.store(m)
+		}
+	}
+}
+
 func (q *Queue) cleanup(channelName string, c *channel) {
 	q.mutex.Lock()
 	defer q.mutex.Unlock()
@@ -104,39 +378,230 @@ func (q *Queue) cleanup(channelName string, c *channel) {
 		c.removeSubscriber(subscriber)
 	}
 
+	// Stop forwarding messages from the other sources
+	close(c.done)
+
 	delete(q.channels, channelName)
 }
 
-func (c *channel) removeSubscriber(s subscriber) {
+// removeGoneSubscribers removes the subscribers whose context has ended
+func (c *channel) removeGoneSubscribers() {
+	for subscriber := range c.subscribers {
+		select {
+		case <-subscriber.context.Done():
+			c.removeSubscriber(subscriber)
+		default:
+		}
+	}
+}
+
+// deliver passes a message to a subscriber without blocking, and returns false if the subscriber's buffer is full
+func (c *channel) deliver(s *subscriber, m *message.Message) bool {
+	if s.conflator != nil {
+		// Gaps are conflated with each other, as one is enough to resync
+		if m.Gap {
+			return s.conflator.push("\x00gap", m)
+		}
+
+		// Never conflate messages without a key
+		key, ok := c.conflateKey(m)
+		if !ok {
+			return s.conflator.pushUnkeyed(m)
+		}
+		return s.conflator.push(key, m)
+	}
+
+	select {
+	case s.channel <- m:
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *channel) removeSubscriber(s *subscriber) {
 	delete(c.subscribers, s)
+
+	// Give unacknowledged messages to someone else
+	if len(s.inflight) > 0 {
+		c.requeue(s.takeInflight(func(inflight) bool { return true }))
+	}
+
+	// Keep the session around for the subscriber to resume
+	if s.session != nil {
+		s.session.detach(s)
+	}
+
+	// The conflator owns the channel, and closes it when stopped
+	if s.conflator != nil {
+		s.conflator.stop()
+		return
+	}
+
 	close(s.channel)
 }
 
 // Subscribe subscribes to a queue channel, and returns a channel for receiving messages
+// For channels with a snapshot, the current state of the channel is delivered before any new messages
+// For resumed sessions, the messages that haven't been acknowledged, and the messages published while disconnected,
+// are delivered before any new messages
+// When resuming from the history of the channel, the missed messages are delivered before any new messages
 // Consumers should check whether the channel is closed, as the queue may terminate subscriptions at any time
 // Returns an error if the given channel doesn't exist
-func (q *Queue) Subscribe(context context.Context, channelName string) (<-chan []byte, error) {
+func (q *Queue) Subscribe(context context.Context, channelName string, options ...SubscribeOption) (<-chan *message.Message, error) {
+	q.mutex.RLock()
+	c, ok := q.channels[channelName]
+	q.mutex.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("%q: channel doesn't exist", channelName)
+	}
+
+	s := &subscriber{
+		context: context,
+	}
+	for _, option := range options {
+		option(s)
+	}
+
+	// Reading the history may take a while, so it's read without holding up the other channels, and the messages
+	// published in the meantime are read once the mutex is held
+	var history []*message.Message
+	if s.resume != nil && c.history != nil {
+		var err error
+		history, err = c.history.Since(*s.resume, maxResume)
+		if err != nil {
+			return nil, fmt.Errorf("%q: error reading history: %s", channelName, err)
+		}
+	}
+
 	q.mutex.Lock()
 	defer q.mutex.Unlock()
 
-	_, ok := q.channels[channelName]
-	if !ok {
+	// The channel may have been closed, and another created with the same name, while reading the history
+	if q.channels[channelName] != c {
 		return nil, fmt.Errorf("%q: channel doesn't exist", channelName)
 	}
 
-	channel := make(chan []byte, q.bufferSize)
+	if c.maxSubscribers > 0 && len(c.subscribers) >= c.maxSubscribers {
+		c.removeGoneSubscribers()
 
-	newChannel := q.channels[channelName]
-	s := subscriber{
-		context: context,
-		channel: channel,
+		session := c.sessions[s.sessionID]
+		takeover := s.sessionID != "" && session != nil && session.subscriber != nil
+		if len(c.subscribers) >= c.maxSubscribers && !takeover {
+			return nil, fmt.Errorf("%q: %w", channelName, ErrTooManySubscribers)
+		}
+	}
+
+	var snapshot []*message.Message
+	if c.snapshot != nil {
+		for _, m := range c.snapshot.messages() {
+			if s.filter == nil || s.filter.Match(m) {
+				snapshot = append(snapshot, m)
+			}
+		}
+	}
+
+	var resumed []*message.Message
+	if s.resume != nil && c.history != nil {
+		last := *s.resume
+		if len(history) > 0 {
+			last = history[len(history)-1].Sequence
+		}
+
+		// Messages published after they were read are no longer delivered live to the subscriber, so they're read too
+		if c.published > last && len(history) < maxResume {
+			messages, err := c.history.Since(last, maxResume-len(history))
+			if err != nil {
+				return nil, fmt.Errorf("%q: error reading history: %s", channelName, err)
+			}
+			history = append(history, messages...)
+		}
+
+		// Any of the messages yet to be published are skipped when published, as they're delivered from the history
+		for _, m := range history {
+			s.resumed = m.Sequence
+			if s.filter == nil || s.filter.Match(m) {
+				resumed = append(resumed, m)
+			}
+		}
+	}
+
+	// Resume the session, if any, taking it over from any previous subscriber
+	var pending []*message.Message
+	if s.sessionID != "" && c.dispatch == Broadcast {
+		s.session = c.sessions[s.sessionID]
+		if s.session == nil {
+			s.session = newSession(s.sessionRetention)
+			c.sessions[s.sessionID] = s.session
+
+			select {
+			case c.sessionsAdded <- struct{}{}:
+			default:
+			}
+		} else if s.session.subscriber != nil {
+			c.removeSubscriber(s.session.subscriber)
+		}
+		pending = s.session.attach(s)
+	}
+
+	// Unacknowledged messages, and the messages in the inbox, may also be in the history
+	missed := mergeMessages(resumed, pending)
+
+	// Make room for the snapshot and missed messages in the buffer
+	bufferSize := c.bufferSize + len(snapshot) + len(missed)
+
+	var channel chan *message.Message
+	if c.conflateKey != nil {
+		channel = make(chan *message.Message)
+		s.conflator = newConflator(bufferSize)
+		go s.conflator.run(context, channel)
+	} else {
+		channel = make(chan *message.Message, bufferSize)
+	}
+	s.channel = channel
+
+	for _, m := range snapshot {
+		c.deliver(s, m)
+	}
+
+	for _, m := range missed {
+		c.deliver(s, m)
+	}
+
+	c.subscribers[s] = struct{}{}
+
+	if s.acks != nil {
+		s.inflight = make(map[uint64]inflight)
+		go q.ackWorker(c, s)
+	}
+
+	if c.dispatch != Broadcast {
+		c.flushBacklog()
 	}
-	newChannel.subscribers[s] = struct{}{}
-	q.channels[channelName] = newChannel
 
 	return channel, nil
 }
 
+// mergeMessages merges two lists of messages ordered by sequence number, leaving out duplicates
+func mergeMessages(a, b []*message.Message) []*message.Message {
+	merged := make([]*message.Message, 0, len(a)+len(b))
+	for len(a) > 0 || len(b) > 0 {
+		var next *message.Message
+		switch {
+		case len(b) == 0 || (len(a) > 0 && a[0].Sequence <= b[0].Sequence):
+			next, a = a[0], a[1:]
+		default:
+			next, b = b[0], b[1:]
+		}
+
+		if len(merged) == 0 || merged[len(merged)-1].Sequence != next.Sequence {
+			merged = append(merged, next)
+		}
+	}
+	return merged
+}
+
 // SubscriberCount returns the total count of subscribers for all channels
 func (q *Queue) SubscriberCount() (subscriberCount int) {
 	q.mutex.RLock()
@@ -148,3 +613,79 @@ func (q *Queue) SubscriberCount() (subscriberCount int) {
 
 	return
 }
+
+// Channels returns the names of the open channels, sorted
+func (q *Queue) Channels() []string {
+	q.mutex.RLock()
+	defer q.mutex.RUnlock()
+
+	names := make([]string, 0, len(q.channels))
+	for name := range q.channels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// Closed returns a channel that's closed once the worker of the queue channel has exited and the channel has been
+// removed, after which its name may be reused, and its history is no longer used by the queue
+// The returned channel is already closed if the channel doesn't exist
+func (q *Queue) Closed(channelName string) <-chan struct{} {
+	q.mutex.RLock()
+	defer q.mutex.RUnlock()
+
+	c, ok := q.channels[channelName]
+	if !ok {
+		closed := make(chan struct{})
+		close(closed)
+		return closed
+	}
+
+	return c.done
+}
+
+// ChannelSubscriberCount returns the count of subscribers for a channel, or zero if it doesn't exist
+func (q *Queue) ChannelSubscriberCount(channelName string) int {
+	q.mutex.RLock()
+	defer q.mutex.RUnlock()
+
+	c, ok := q.channels[channelName]
+	if !ok {
+		return 0
+	}
+
+	// Subscribers that have gone away are only removed once there's a message for them, so they're not counted
+	count := 0
+	for subscriber := range c.subscribers {
+		select {
+		case <-subscriber.context.Done():
+		default:
+			count++
+		}
+	}
+	return count
+}
+
+// SetLimits changes the message buffer size for new subscribers to a channel, where zero means the queue default, and
+// its maximum number of subscribers, where zero means unlimited
+// Existing subscribers keep their buffers, and are never disconnected for exceeding a lowered maximum
+// Returns an error if the given channel doesn't exist
+func (q *Queue) SetLimits(channelName string, bufferSize int, maxSubscribers int) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	c, ok := q.channels[channelName]
+	if !ok {
+		return fmt.Errorf("%q: channel doesn't exist", channelName)
+	}
+
+	if bufferSize <= 0 {
+		bufferSize = q.bufferSize
+	}
+
+	c.bufferSize = bufferSize
+	c.maxSubscribers = maxSubscribers
+
+	return nil
+}
@@ -2,8 +2,13 @@ package queue_test
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/mullvad/message-queue/message"
 	"github.com/mullvad/message-queue/queue"
 )
 
@@ -24,6 +29,13 @@ func TestCreateChannel(t *testing.T) {
 			t.Fatal("No error")
 		}
 	})
+
+	t.Run("error on conflated work queue", func(t *testing.T) {
+		_, err := q.CreateChannel("conflated-work", queue.WithDispatch(queue.RoundRobin), queue.WithConflation(queue.FieldKey("id")))
+		if err == nil {
+			t.Fatal("No error")
+		}
+	})
 }
 
 func TestSubscribe(t *testing.T) {
@@ -52,11 +64,143 @@ func TestSubscribe(t *testing.T) {
 			t.Fatal(err)
 		}
 
-		channel <- []byte("test")
+		channel <- message.New("test", []byte("test"))
+
+		msg := <-sub
+		if string(msg.Payload) != "test" {
+			t.Fatalf("wrong message: %s", msg.Payload)
+		}
+	})
+
+	t.Run("messages are numbered", func(t *testing.T) {
+		channel, err := q.CreateChannel("sequence")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		sub, err := q.Subscribe(ctx, "sequence")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Send the same message twice, the queue shouldn't modify the original
+		m := message.New("source", []byte("test"))
+		channel <- m
+		channel <- m
+
+		for i := uint64(1); i <= 2; i++ {
+			msg := <-sub
+			if msg.Sequence != i {
+				t.Fatalf("wrong sequence number: %d", msg.Sequence)
+			}
+			if msg.Channel != "source" {
+				t.Fatalf("wrong source channel: %s", msg.Channel)
+			}
+		}
+
+		if m.Sequence != 0 {
+			t.Fatal("original message modified")
+		}
+	})
+
+	t.Run("subscribe with filter", func(t *testing.T) {
+		channel, err := q.CreateChannel("filter")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		sub, err := q.Subscribe(ctx, "filter", queue.WithFilter(payloadFilter("match")))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		channel <- message.New("filter", []byte("skip"))
+		channel <- message.New("filter", []byte("match"))
 
-		message := <-sub
-		if string(message) != "test" {
-			t.Fatalf("wrong message: %s", message)
+		msg := <-sub
+		if string(msg.Payload) != "match" {
+			t.Fatalf("wrong message: %s", msg.Payload)
+		}
+	})
+
+	t.Run("buffer size per channel", func(t *testing.T) {
+		channel, err := q.CreateChannel("buffer", queue.WithBufferSize(1))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		sub, err := q.Subscribe(ctx, "buffer")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// The subscriber should be disconnected when the second message doesn't fit in the buffer
+		channel <- message.New("buffer", []byte("first"))
+		channel <- message.New("buffer", []byte("second"))
+		channel <- message.New("buffer", []byte("third"))
+
+		count := 0
+		for range sub {
+			count++
+		}
+
+		if count != 1 {
+			t.Fatalf("wrong number of messages: %d", count)
+		}
+	})
+
+	t.Run("max subscribers", func(t *testing.T) {
+		_, err := q.CreateChannel("max", queue.WithMaxSubscribers(1))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		subCtx, subCancel := context.WithCancel(ctx)
+		if _, err := q.Subscribe(subCtx, "max"); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := q.Subscribe(ctx, "max"); !errors.Is(err, queue.ErrTooManySubscribers) {
+			t.Fatalf("wrong error: %v", err)
+		}
+
+		// Subscribers that have gone away make room for new ones
+		subCancel()
+		if _, err := q.Subscribe(ctx, "max"); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("change limits", func(t *testing.T) {
+		_, err := q.CreateChannel("limits", queue.WithMaxSubscribers(1))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := q.Subscribe(ctx, "limits"); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := q.SetLimits("limits", 0, 2); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := q.Subscribe(ctx, "limits"); err != nil {
+			t.Fatal(err)
+		}
+
+		// Lowering the maximum keeps the existing subscribers
+		if err := q.SetLimits("limits", 0, 1); err != nil {
+			t.Fatal(err)
+		}
+		if count := q.ChannelSubscriberCount("limits"); count != 2 {
+			t.Fatalf("wrong subscriber count: %d", count)
+		}
+		if _, err := q.Subscribe(ctx, "limits"); !errors.Is(err, queue.ErrTooManySubscribers) {
+			t.Fatalf("wrong error: %v", err)
+		}
+
+		if err := q.SetLimits("missing", 0, 0); err == nil {
+			t.Fatal("no error for missing channel")
 		}
 	})
 
@@ -73,7 +217,7 @@ func TestSubscribe(t *testing.T) {
 			t.Fatal(err)
 		}
 
-		channel <- []byte("test")
+		channel <- message.New("test", []byte("test"))
 
 		_, open := <-sub
 		if open {
@@ -82,6 +226,806 @@ func TestSubscribe(t *testing.T) {
 	})
 }
 
+func TestConflation(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	q := queue.New(ctx, 2)
+
+	t.Run("keep latest message per key", func(t *testing.T) {
+		channel, err := q.CreateChannel("conflate", queue.WithConflation(queue.FieldKey("key")))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		sub, err := q.Subscribe(ctx, "conflate")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, payload := range []string{`{"key":"a","value":1}`, `{"key":"a","value":2}`, `{"key":"a","value":3}`, `{"key":"b","value":1}`} {
+			channel <- message.New("conflate", []byte(payload))
+		}
+
+		// The first message may already have been passed on before the others arrived
+		var received []string
+		for msg := range sub {
+			received = append(received, string(msg.Payload))
+			if string(msg.Payload) == `{"key":"b","value":1}` {
+				break
+			}
+		}
+
+		if len(received) > 3 || received[len(received)-2] != `{"key":"a","value":3}` {
+			t.Fatalf("wrong messages: %s", received)
+		}
+	})
+
+	t.Run("never conflate messages without a key", func(t *testing.T) {
+		// Seeds all have the same sequence number, which mustn't make them conflated with each other
+		var initial []*message.Message
+		for _, field := range []string{"a", "b", "c"} {
+			m := message.New("seeds", []byte(field))
+			m.Headers = map[string]string{"key": field}
+			initial = append(initial, m)
+		}
+
+		_, err := q.CreateChannel("seeds", queue.WithConflation(queue.FieldKey("id")), queue.WithSnapshot(queue.FieldKey("id"), initial...))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		sub, err := q.Subscribe(ctx, "seeds")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, expected := range []string{"a", "b", "c"} {
+			if msg := <-sub; string(msg.Payload) != expected {
+				t.Fatalf("wrong message: %s", msg.Payload)
+			}
+		}
+	})
+
+	t.Run("disconnect when falling behind on too many keys", func(t *testing.T) {
+		channel, err := q.CreateChannel("overflow", queue.WithConflation(queue.PrefixKey("|")))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		sub, err := q.Subscribe(ctx, "overflow")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// The last message makes sure that the previous ones have been processed
+		payloads := []string{"a|1", "b|1", "c|1", "d|1", "e|1"}
+		for _, payload := range payloads {
+			channel <- message.New("overflow", []byte(payload))
+		}
+
+		count := 0
+		for range sub {
+			count++
+		}
+
+		if count == len(payloads) {
+			t.Fatal("subscriber not disconnected")
+		}
+	})
+}
+
+func TestSnapshot(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	q := queue.New(ctx, 1)
+
+	t.Run("latest message", func(t *testing.T) {
+		channel, err := q.CreateChannel("latest", queue.WithSnapshot(nil, message.New("latest", []byte("initial"))))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		sub, err := q.Subscribe(ctx, "latest")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if msg := <-sub; string(msg.Payload) != "initial" {
+			t.Fatalf("wrong message: %s", msg.Payload)
+		}
+
+		channel <- message.New("latest", []byte("first"))
+		channel <- message.New("latest", []byte("second"))
+		<-sub
+		<-sub
+
+		sub, err = q.Subscribe(ctx, "latest")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if msg := <-sub; string(msg.Payload) != "second" {
+			t.Fatalf("wrong message: %s", msg.Payload)
+		}
+	})
+
+	t.Run("latest message per key", func(t *testing.T) {
+		channel, err := q.CreateChannel("keys", queue.WithSnapshot(queue.PrefixKey("|")))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, payload := range []string{"a|1", "b|1", "a|2", "unkeyed"} {
+			channel <- message.New("keys", []byte(payload))
+		}
+
+		// Make sure that the previous messages have been processed
+		channel <- message.New("keys", []byte("c|1"))
+
+		// The snapshot should be filtered as well
+		sub, err := q.Subscribe(ctx, "keys", queue.WithFilter(payloadFilter("a|2")))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		channel <- message.New("keys", []byte("a|2"))
+
+		for i := 0; i < 2; i++ {
+			if msg := <-sub; string(msg.Payload) != "a|2" {
+				t.Fatalf("wrong message: %s", msg.Payload)
+			}
+		}
+
+		// The snapshot should be delivered even though it's larger than the buffer
+		sub, err = q.Subscribe(ctx, "keys")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, expected := range []string{"a|2", "b|1", "c|1"} {
+			if msg := <-sub; string(msg.Payload) != expected {
+				t.Fatalf("wrong message: %s", msg.Payload)
+			}
+		}
+	})
+
+	t.Run("seed keyed by header", func(t *testing.T) {
+		// Such as the fields of a redis hash, without the key in the payload
+		var initial []*message.Message
+		for _, field := range []string{"a", "b"} {
+			m := message.New("seeded", []byte(`{"price":1}`))
+			m.Headers = map[string]string{"key": field}
+			initial = append(initial, m)
+		}
+
+		channel, err := q.CreateChannel("seeded", queue.WithSnapshot(queue.FieldKey("id"), initial...))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		channel <- message.New("seeded", []byte(`{"id":"a","price":2}`))
+
+		// Make sure that the previous message has been processed
+		channel <- message.New("seeded", []byte(`{"id":"c","price":1}`))
+
+		sub, err := q.Subscribe(ctx, "seeded")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, expected := range []string{`{"id":"a","price":2}`, `{"price":1}`, `{"id":"c","price":1}`} {
+			if msg := <-sub; string(msg.Payload) != expected {
+				t.Fatalf("wrong message: %s", msg.Payload)
+			}
+		}
+	})
+
+	t.Run("remove keys with tombstones", func(t *testing.T) {
+		channel, err := q.CreateChannel("tombstones", queue.WithSnapshot(queue.HeaderKey("id")))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, m := range []struct{ id, payload string }{{"a", "1"}, {"b", "1"}, {"a", ""}, {"c", "1"}} {
+			msg := message.New("tombstones", []byte(m.payload))
+			msg.Headers = map[string]string{"id": m.id}
+			channel <- msg
+		}
+
+		// Make sure that the previous messages have been processed
+		last := message.New("tombstones", []byte("2"))
+		last.Headers = map[string]string{"id": "c"}
+		channel <- last
+
+		sub, err := q.Subscribe(ctx, "tombstones")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, expected := range []string{"b", "c"} {
+			if msg := <-sub; msg.Headers["id"] != expected {
+				t.Fatalf("wrong message: %v", msg.Headers)
+			}
+		}
+	})
+}
+
+func TestDispatch(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	q := queue.New(ctx, 2)
+
+	t.Run("round robin", func(t *testing.T) {
+		channel, err := q.CreateChannel("round-robin", queue.WithDispatch(queue.RoundRobin))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		first, err := q.Subscribe(ctx, "round-robin")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		second, err := q.Subscribe(ctx, "round-robin")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Every subscriber should get one message each, without being disconnected for a full buffer
+		for i := 0; i < 4; i++ {
+			channel <- message.New("round-robin", []byte("test"))
+		}
+
+		for _, sub := range []<-chan *message.Message{first, second} {
+			for i := 0; i < 2; i++ {
+				if _, open := <-sub; !open {
+					t.Fatal("channel closed")
+				}
+			}
+
+			select {
+			case msg := <-sub:
+				t.Fatalf("got extra message %d", msg.Sequence)
+			default:
+			}
+		}
+	})
+
+	t.Run("least loaded", func(t *testing.T) {
+		channel, err := q.CreateChannel("least-loaded", queue.WithDispatch(queue.LeastLoaded))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		busy, err := q.Subscribe(ctx, "least-loaded")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		channel <- message.New("least-loaded", []byte("busy"))
+
+		idle, err := q.Subscribe(ctx, "least-loaded")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		channel <- message.New("least-loaded", []byte("idle"))
+
+		if msg := <-idle; string(msg.Payload) != "idle" {
+			t.Fatalf("wrong message: %s", msg.Payload)
+		}
+		if msg := <-busy; string(msg.Payload) != "busy" {
+			t.Fatalf("wrong message: %s", msg.Payload)
+		}
+	})
+
+	t.Run("backlog without subscribers", func(t *testing.T) {
+		channel, err := q.CreateChannel("backlog", queue.WithDispatch(queue.RoundRobin))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		channel <- message.New("backlog", []byte("test"))
+
+		sub, err := q.Subscribe(ctx, "backlog")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if msg := <-sub; string(msg.Payload) != "test" {
+			t.Fatalf("wrong message: %s", msg.Payload)
+		}
+	})
+
+	t.Run("redeliver unacknowledged messages", func(t *testing.T) {
+		channel, err := q.CreateChannel("acks", queue.WithDispatch(queue.RoundRobin))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		acks := make(chan queue.Ack)
+		sub, err := q.Subscribe(ctx, "acks", queue.WithAcks(acks, time.Millisecond*10))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		channel <- message.New("acks", []byte("test"))
+
+		// Ignore the first delivery, and acknowledge the redelivery
+		first := <-sub
+		second := <-sub
+		if second.Sequence != first.Sequence {
+			t.Fatalf("wrong message redelivered: %d", second.Sequence)
+		}
+		acks <- queue.Ack{Sequence: second.Sequence}
+
+		select {
+		case msg := <-sub:
+			t.Fatalf("acknowledged message redelivered: %d", msg.Sequence)
+		case <-time.After(time.Millisecond * 300):
+		}
+	})
+
+	t.Run("redeliver when subscriber goes away", func(t *testing.T) {
+		channel, err := q.CreateChannel("gone", queue.WithDispatch(queue.RoundRobin))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		subCtx, subCancel := context.WithCancel(ctx)
+		gone, err := q.Subscribe(subCtx, "gone", queue.WithAcks(make(chan queue.Ack), time.Hour))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		channel <- message.New("gone", []byte("test"))
+		msg := <-gone
+		subCancel()
+
+		sub, err := q.Subscribe(ctx, "gone")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if redelivered := <-sub; redelivered.Sequence != msg.Sequence {
+			t.Fatalf("wrong message redelivered: %d", redelivered.Sequence)
+		}
+	})
+}
+
+func TestSession(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	q := queue.New(ctx, 100)
+
+	channel, err := q.CreateChannel("session")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	subscribe := func(ctx context.Context, acks chan queue.Ack) <-chan *message.Message {
+		sub, err := q.Subscribe(ctx, "session", queue.WithAcks(acks, time.Hour), queue.WithSession("id", time.Hour))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sub
+	}
+
+	subCtx, subCancel := context.WithCancel(ctx)
+	acks := make(chan queue.Ack)
+	sub := subscribe(subCtx, acks)
+
+	for _, payload := range []string{"first", "second", "third"} {
+		channel <- message.New("session", []byte(payload))
+	}
+
+	// Acknowledge the first message twice, to make sure that the first acknowledgement has been processed
+	first := <-sub
+	acks <- queue.Ack{Sequence: first.Sequence}
+	acks <- queue.Ack{Sequence: first.Sequence}
+	subCancel()
+
+	// The unacknowledged messages should be redelivered in order when resuming the session
+	acks = make(chan queue.Ack)
+	sub = subscribe(ctx, acks)
+
+	var last *message.Message
+	for _, expected := range []string{"second", "third"} {
+		last = <-sub
+		if string(last.Payload) != expected {
+			t.Fatalf("wrong message: %s", last.Payload)
+		}
+	}
+
+	acks <- queue.Ack{Sequence: last.Sequence, Cumulative: true}
+	acks <- queue.Ack{Sequence: last.Sequence, Cumulative: true}
+
+	// Nothing should be redelivered once everything has been acknowledged
+	sub = subscribe(ctx, make(chan queue.Ack))
+
+	channel <- message.New("session", []byte("fourth"))
+
+	if msg := <-sub; string(msg.Payload) != "fourth" {
+		t.Fatalf("wrong message: %s", msg.Payload)
+	}
+}
+
+func TestInbox(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	q := queue.New(ctx, 100)
+
+	tests := []struct {
+		name        string
+		maxMessages int
+		maxBytes    int
+		payloads    []string
+		expected    []string
+	}{
+		{"keep messages while disconnected", 10, 0, []string{"a", "b"}, []string{"a", "b"}},
+		{"drop the oldest messages", 2, 0, []string{"a", "b", "c"}, []string{"b", "c"}},
+		{"limit the size", 10, 4, []string{"aa", "bb", "cc"}, []string{"bb", "cc"}},
+	}
+
+	for i, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			name := fmt.Sprintf("inbox-%d", i)
+			channel, err := q.CreateChannel(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			subscribe := func(ctx context.Context) <-chan *message.Message {
+				sub, err := q.Subscribe(ctx, name, queue.WithSession("device", time.Hour), queue.WithInbox(test.maxMessages, test.maxBytes))
+				if err != nil {
+					t.Fatal(err)
+				}
+				return sub
+			}
+
+			// The subscriber is removed, and its session detached, when the first message is published
+			subCtx, subCancel := context.WithCancel(ctx)
+			subscribe(subCtx)
+			subCancel()
+
+			for _, payload := range test.payloads {
+				channel <- message.New(name, []byte(payload))
+			}
+
+			sub := subscribe(ctx)
+			channel <- message.New(name, []byte("live"))
+
+			for _, expected := range append(test.expected, "live") {
+				if msg := <-sub; string(msg.Payload) != expected {
+					t.Fatalf("wrong message: %s", msg.Payload)
+				}
+			}
+		})
+	}
+}
+
+func TestGap(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	q := queue.New(ctx, 100)
+
+	t.Run("deliver to every subscriber", func(t *testing.T) {
+		channel, err := q.CreateChannel("gap", queue.WithDispatch(queue.RoundRobin))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var subs []<-chan *message.Message
+		for _, options := range [][]queue.SubscribeOption{nil, {queue.WithFilter(payloadFilter("match"))}} {
+			sub, err := q.Subscribe(ctx, "gap", options...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			subs = append(subs, sub)
+		}
+
+		// Every subscriber should get the gap no matter its filter, and the gap shouldn't be numbered
+		channel <- message.NewGap("gap")
+		channel <- message.New("gap", []byte("match"))
+
+		for _, sub := range subs {
+			if msg := <-sub; !msg.Gap || msg.Sequence != 0 {
+				t.Fatalf("wrong message: %#v", msg)
+			}
+		}
+
+		select {
+		case msg := <-subs[0]:
+			if msg.Sequence != 1 {
+				t.Fatalf("wrong sequence number: %d", msg.Sequence)
+			}
+		case msg := <-subs[1]:
+			if msg.Sequence != 1 {
+				t.Fatalf("wrong sequence number: %d", msg.Sequence)
+			}
+		}
+	})
+
+	t.Run("deliver after the inbox", func(t *testing.T) {
+		channel, err := q.CreateChannel("gap-inbox")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		subscribe := func(ctx context.Context) <-chan *message.Message {
+			sub, err := q.Subscribe(ctx, "gap-inbox", queue.WithSession("device", time.Hour), queue.WithInbox(10, 0))
+			if err != nil {
+				t.Fatal(err)
+			}
+			return sub
+		}
+
+		subCtx, subCancel := context.WithCancel(ctx)
+		subscribe(subCtx)
+		subCancel()
+
+		channel <- message.New("gap-inbox", []byte("a"))
+		channel <- message.NewGap("gap-inbox")
+		channel <- message.New("gap-inbox", []byte("b"))
+
+		sub := subscribe(ctx)
+		for _, expected := range []string{"a", "b", ""} {
+			if msg := <-sub; string(msg.Payload) != expected || msg.Gap != (expected == "") {
+				t.Fatalf("wrong message: %#v", msg)
+			}
+		}
+	})
+}
+
+func TestHistory(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	q := queue.New(ctx, 1)
+
+	// Pretend that the channel existed before a restart
+	history := queue.NewMemoryHistory(10)
+	for i := uint64(1); i <= 3; i++ {
+		m := message.New("history", []byte("old"))
+		m.Sequence = i
+		history.Append(m)
+	}
+
+	channel, err := q.CreateChannel("history", queue.WithHistory(history))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	channel <- message.New("history", []byte("new"))
+
+	// Make sure that the previous message has been processed
+	channel <- message.New("history", []byte("new"))
+
+	// Resuming should deliver the missed messages even though they don't fit in the buffer, and continue the sequence
+	sub, err := q.Subscribe(ctx, "history", queue.WithResume(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, expected := range []uint64{3, 4, 5, 6} {
+		// The last message may still be on its way into the history, in which case it's delivered live
+		if expected == 6 {
+			channel <- message.New("history", []byte("new"))
+		}
+
+		msg := <-sub
+		if msg == nil || msg.Sequence != expected {
+			t.Fatalf("wrong message: %v", msg)
+		}
+	}
+
+	t.Run("messages published while reading the history", func(t *testing.T) {
+		history := &slowHistory{
+			MemoryHistory: queue.NewMemoryHistory(10),
+			reading:       make(chan struct{}),
+			read:          make(chan struct{}),
+		}
+
+		channel, err := q.CreateChannel("slow-history", queue.WithHistory(history))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		channel <- message.New("slow-history", []byte("old"))
+		channel <- message.New("slow-history", []byte("old"))
+
+		subscribed := make(chan (<-chan *message.Message))
+		go func() {
+			sub, err := q.Subscribe(ctx, "slow-history", queue.WithResume(1))
+			if err != nil {
+				t.Error(err)
+			}
+			subscribed <- sub
+		}()
+
+		// The last message may or may not have been passed on yet once the history has been read
+		<-history.reading
+		for i := 0; i < 3; i++ {
+			channel <- message.New("slow-history", []byte("new"))
+		}
+		close(history.read)
+
+		// Every message is delivered once, in order
+		sub := <-subscribed
+		for _, expected := range []uint64{2, 3, 4, 5, 6} {
+			if expected == 6 {
+				channel <- message.New("slow-history", []byte("new"))
+			}
+
+			msg := <-sub
+			if msg == nil || msg.Sequence != expected {
+				t.Fatalf("wrong message: %v", msg)
+			}
+		}
+	})
+}
+
+// slowHistory is a history that reads the messages, and then waits for the read channel to be closed before returning
+// them the first time
+type slowHistory struct {
+	*queue.MemoryHistory
+	reading chan struct{}
+	read    chan struct{}
+	once    sync.Once
+}
+
+func (h *slowHistory) Since(sequence uint64, limit int) ([]*message.Message, error) {
+	messages, err := h.MemoryHistory.Since(sequence, limit)
+	h.once.Do(func() {
+		close(h.reading)
+		<-h.read
+	})
+	return messages, err
+}
+
+func TestMemoryHistory(t *testing.T) {
+	history := queue.NewMemoryHistory(3)
+
+	start := time.Now()
+	for i := uint64(1); i <= 5; i++ {
+		m := message.New("history", []byte("test"))
+		m.Sequence = i
+		m.Time = start.Add(time.Duration(i) * time.Second)
+		if err := history.Append(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	t.Run("forget the oldest messages", func(t *testing.T) {
+		messages, err := history.Since(0, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(messages) != 3 || messages[0].Sequence != 3 || history.LastSequence() != 5 {
+			t.Fatalf("wrong messages: %d", len(messages))
+		}
+	})
+
+	t.Run("limit", func(t *testing.T) {
+		messages, err := history.Since(3, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(messages) != 1 || messages[0].Sequence != 4 {
+			t.Fatalf("wrong messages: %d", len(messages))
+		}
+	})
+
+	t.Run("since time", func(t *testing.T) {
+		messages, err := history.SinceTime(start.Add(4*time.Second), 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(messages) != 2 || messages[0].Sequence != 4 {
+			t.Fatalf("wrong messages: %d", len(messages))
+		}
+	})
+
+	t.Run("reject out of order messages", func(t *testing.T) {
+		m := message.New("history", []byte("test"))
+		m.Sequence = 5
+		if err := history.Append(m); err == nil {
+			t.Fatal("no error")
+		}
+	})
+}
+
+func TestSources(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	q := queue.New(ctx, 100)
+
+	t.Run("error on invalid channel", func(t *testing.T) {
+		_, err := q.AddSource("nonexistent")
+		if err == nil {
+			t.Fatal("No error")
+		}
+	})
+
+	t.Run("combine channels", func(t *testing.T) {
+		eu, err := q.CreateChannel("all-alerts")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		us, err := q.AddSource("all-alerts")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		sub, err := q.Subscribe(ctx, "all-alerts")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		eu <- message.New("alerts.eu", []byte("test"))
+		if msg := <-sub; msg.Channel != "alerts.eu" || msg.Sequence != 1 {
+			t.Fatalf("wrong message: %s %d", msg.Channel, msg.Sequence)
+		}
+
+		us <- message.New("alerts.us", []byte("test"))
+		if msg := <-sub; msg.Channel != "alerts.us" || msg.Sequence != 2 {
+			t.Fatalf("wrong message: %s %d", msg.Channel, msg.Sequence)
+		}
+	})
+
+	t.Run("deduplicate messages from redundant sources", func(t *testing.T) {
+		first, err := q.CreateChannel("redundant", queue.WithDeduplication(queue.FieldKey("id"), time.Hour))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		second, err := q.AddSource("redundant")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		sub, err := q.Subscribe(ctx, "redundant")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		first <- message.New("redundant", []byte(`{"id":1}`))
+		second <- message.New("redundant", []byte(`{"id":1}`))
+		second <- message.New("redundant", []byte(`{"id":2}`))
+		first <- message.New("redundant", []byte(`{"id":2}`))
+		first <- message.New("redundant", []byte(`{"id":3}`))
+
+		for _, expected := range []string{`{"id":1}`, `{"id":2}`, `{"id":3}`} {
+			if msg := <-sub; string(msg.Payload) != expected {
+				t.Fatalf("wrong message: %s", msg.Payload)
+			}
+		}
+
+		// The channel should only be closed once all of its sources are
+		close(first)
+		second <- message.New("redundant", []byte(`{"id":4}`))
+		if msg := <-sub; string(msg.Payload) != `{"id":4}` {
+			t.Fatalf("wrong message: %s", msg.Payload)
+		}
+
+		close(second)
+		if _, open := <-sub; open {
+			t.Fatal("channel not closed")
+		}
+	})
+}
+
 func TestClose(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -99,6 +1043,10 @@ func TestClose(t *testing.T) {
 			t.Fatal(err)
 		}
 
+		if channels := q.Channels(); len(channels) != 1 || channels[0] != "close" {
+			t.Fatalf("wrong channels: %v", channels)
+		}
+
 		close(channel)
 
 		_, open := <-sub
@@ -106,6 +1054,10 @@ func TestClose(t *testing.T) {
 			t.Fatal("channel not closed")
 		}
 
+		if channels := q.Channels(); len(channels) != 0 {
+			t.Fatalf("closed channel not removed: %v", channels)
+		}
+
 		// Try recreating the channel
 		_, err = q.CreateChannel("close")
 		if err != nil {
@@ -113,6 +1065,37 @@ func TestClose(t *testing.T) {
 		}
 	})
 
+	t.Run("wait for the channel to be closed", func(t *testing.T) {
+		channel, err := q.CreateChannel("closed")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		closed := q.Closed("closed")
+		select {
+		case <-closed:
+			t.Fatal("closed before its sources")
+		default:
+		}
+
+		close(channel)
+
+		select {
+		case <-closed:
+		case <-time.After(time.Second * 5):
+			t.Fatal("not closed")
+		}
+
+		// The name can be reused right away
+		if _, err := q.CreateChannel("closed"); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, open := <-q.Closed("nonexistent"); open {
+			t.Fatal("nonexistent channel not closed")
+		}
+	})
+
 	t.Run("test subscriber that has gone away", func(t *testing.T) {
 		channel, err := q.CreateChannel("subscriber")
 		if err != nil {
@@ -125,6 +1108,34 @@ func TestClose(t *testing.T) {
 			t.Fatal(err)
 		}
 
-		channel <- []byte("test")
+		channel <- message.New("test", []byte("test"))
 	})
+
+	t.Run("subscribers that have gone away aren't counted", func(t *testing.T) {
+		_, err := q.CreateChannel("gone")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		subCtx, subCancel := context.WithCancel(ctx)
+		if _, err := q.Subscribe(subCtx, "gone"); err != nil {
+			t.Fatal(err)
+		}
+
+		if count := q.ChannelSubscriberCount("gone"); count != 1 {
+			t.Fatalf("wrong subscriber count %d", count)
+		}
+
+		// Counted right away, even though there are no messages for removing it
+		subCancel()
+		if count := q.ChannelSubscriberCount("gone"); count != 0 {
+			t.Fatalf("wrong subscriber count %d", count)
+		}
+	})
+}
+
+type payloadFilter string
+
+func (f payloadFilter) Match(m *message.Message) bool {
+	return string(m.Payload) == string(f)
 }
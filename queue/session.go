@@ -0,0 +1,157 @@
+package queue
+
+import (
+	"sort"
+	"time"
+
+	"github.com/mullvad/message-queue/message"
+)
+
+// WithSession makes the subscription to a broadcast channel survive reconnects
+// The session is kept for the retention period after the subscriber goes away, and is resumed by the next subscriber
+// with the same session ID. For subscribers acknowledging messages, see WithAcks, the unacknowledged messages are
+// redelivered, and subscribers with more unacknowledged messages than the buffer size are disconnected. Messages
+// published while no subscriber is connected are kept in the inbox of the session, see WithInbox.
+func WithSession(id string, retention time.Duration) SubscribeOption {
+	return func(s *subscriber) {
+		s.sessionID = id
+		s.sessionRetention = retention
+	}
+}
+
+// WithInbox keeps the messages matching the filter of the subscriber in the inbox of its session while it's
+// disconnected, and delivers them when the session is resumed
+// The inbox holds up to maxMessages messages, with payloads of up to maxBytes in total, after which the oldest messages
+// are dropped. Zero disables the inbox.
+func WithInbox(maxMessages, maxBytes int) SubscribeOption {
+	return func(s *subscriber) {
+		s.inboxMessages = maxMessages
+		s.inboxBytes = maxBytes
+	}
+}
+
+// session keeps track of the messages delivered to a subscriber that haven't been acknowledged
+type session struct {
+	unacked    map[uint64]*message.Message
+	subscriber *subscriber // The current subscriber, if connected
+	retention  time.Duration
+	expires    time.Time // When the session is forgotten, if disconnected
+
+	filter      Filter             // The filter of the last subscriber, for the messages kept in the inbox
+	inbox       []*message.Message // Messages published while disconnected, oldest first
+	inboxSize   int                // The total payload size of the messages in the inbox
+	gap         *message.Message   // The last gap while disconnected, delivered after the inbox
+	maxMessages int
+	maxBytes    int
+}
+
+func newSession(retention time.Duration) *session {
+	return &session{
+		unacked:   make(map[uint64]*message.Message),
+		retention: retention,
+	}
+}
+
+// track adds a delivered message, and returns false if there are more unacknowledged messages than the limit
+func (s *session) track(m *message.Message, limit int) bool {
+	s.unacked[m.Sequence] = m
+	return len(s.unacked) <= limit
+}
+
+func (s *session) ack(a Ack) {
+	if !a.Cumulative {
+		delete(s.unacked, a.Sequence)
+		return
+	}
+
+	for sequence := range s.unacked {
+		if a.covers(sequence) {
+			delete(s.unacked, sequence)
+		}
+	}
+}
+
+// attach connects the subscriber to the session, and returns the messages it should get first, ordered by sequence
+// number
+func (s *session) attach(sub *subscriber) []*message.Message {
+	s.subscriber = sub
+	s.filter = sub.filter
+	s.maxMessages = sub.inboxMessages
+	s.maxBytes = sub.inboxBytes
+
+	inbox, gap := s.inbox, s.gap
+	s.inbox = nil
+	s.inboxSize = 0
+	s.gap = nil
+
+	var messages []*message.Message
+	if sub.acks == nil {
+		messages = mergeMessages(s.pending(), inbox)
+	} else {
+		// The messages in the inbox have to be acknowledged as well
+		for _, m := range inbox {
+			s.unacked[m.Sequence] = m
+		}
+		messages = s.pending()
+	}
+
+	if gap != nil {
+		messages = append(messages, gap)
+	}
+	return messages
+}
+
+// store keeps a message published while disconnected in the inbox, dropping the oldest messages if it's full
+// Gaps aren't numbered, and are kept aside instead
+func (s *session) store(m *message.Message) {
+	if m.Gap {
+		s.gap = m
+		return
+	}
+
+	if s.maxMessages <= 0 || (s.filter != nil && !s.filter.Match(m)) {
+		return
+	}
+
+	s.inbox = append(s.inbox, m)
+	s.inboxSize += len(m.Payload)
+
+	for len(s.inbox) > 0 && (len(s.inbox) > s.maxMessages || (s.maxBytes > 0 && s.inboxSize > s.maxBytes)) {
+		s.inboxSize -= len(s.inbox[0].Payload)
+		s.inbox[0] = nil
+		s.inbox = s.inbox[1:]
+	}
+}
+
+// pending returns the unacknowledged messages ordered by sequence number
+func (s *session) pending() []*message.Message {
+	messages := make([]*message.Message, 0, len(s.unacked))
+	for _, m := range s.unacked {
+		messages = append(messages, m)
+	}
+
+	sort.Slice(messages, func(i, j int) bool {
+		return messages[i].Sequence < messages[j].Sequence
+	})
+
+	return messages
+}
+
+// detach disconnects the subscriber from the session, starting the retention period
+func (s *session) detach(sub *subscriber) {
+	if s.subscriber != sub {
+		return
+	}
+
+	s.subscriber = nil
+	s.expires = time.Now().Add(s.retention)
+}
+
+// expireSessions forgets the sessions that have been disconnected for longer than their retention period
+func (c *channel) expireSessions(now time.Time) {
+	for id, s := range c.sessions {
+		if s.subscriber == nil && now.After(s.expires) {
+			delete(c.sessions, id)
+		}
+	}
+}
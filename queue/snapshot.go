@@ -0,0 +1,96 @@
+package queue
+
+import (
+	"github.com/mullvad/message-queue/message"
+)
+
+// WithSnapshot keeps the latest message of the channel, and delivers it to new subscribers before any new messages.
+// If a key is given, the latest message for every key is kept instead, and messages without a key are ignored. A
+// message with an empty payload is a tombstone, which removes its key from the snapshot, and the keys seen first are
+// removed once there are more than 10000 of them.
+// The snapshot may be seeded with initial messages, such as the state stored in redis on startup. Initial messages with
+// a "key" header, such as the fields of a redis hash, are kept by that key rather than the one given.
+func WithSnapshot(key KeyFunc, initial ...*message.Message) ChannelOption {
+	return func(c *channel) {
+		c.snapshot = newSnapshot(key)
+		for _, m := range initial {
+			c.snapshot.seed(m)
+		}
+	}
+}
+
+// maxSnapshot is the maximum number of keys kept in a snapshot, which are all delivered to new subscribers
+const maxSnapshot = 10000
+
+// snapshot is the latest message for every key, in the order the keys were first seen
+type snapshot struct {
+	key    KeyFunc
+	keys   []string
+	latest map[string]*message.Message
+}
+
+func newSnapshot(key KeyFunc) *snapshot {
+	return &snapshot{
+		key:    key,
+		latest: make(map[string]*message.Message),
+	}
+}
+
+func (s *snapshot) seed(m *message.Message) {
+	if key, ok := m.Headers["key"]; ok && s.key != nil {
+		s.set(key, m)
+		return
+	}
+
+	s.update(m)
+}
+
+func (s *snapshot) update(m *message.Message) {
+	var key string
+	if s.key != nil {
+		var ok bool
+		key, ok = s.key(m)
+		if !ok {
+			return
+		}
+	}
+
+	s.set(key, m)
+}
+
+func (s *snapshot) set(key string, m *message.Message) {
+	if s.key != nil && len(m.Payload) == 0 {
+		s.remove(key)
+		return
+	}
+
+	if _, ok := s.latest[key]; !ok {
+		if len(s.keys) >= maxSnapshot {
+			s.remove(s.keys[0])
+		}
+		s.keys = append(s.keys, key)
+	}
+	s.latest[key] = m
+}
+
+func (s *snapshot) remove(key string) {
+	if _, ok := s.latest[key]; !ok {
+		return
+	}
+	delete(s.latest, key)
+
+	for i, k := range s.keys {
+		if k == key {
+			s.keys = append(s.keys[:i], s.keys[i+1:]...)
+			return
+		}
+	}
+}
+
+func (s *snapshot) messages() []*message.Message {
+	messages := make([]*message.Message, 0, len(s.keys))
+	for _, key := range s.keys {
+		messages = append(messages, s.latest[key])
+	}
+	return messages
+}
@@ -0,0 +1,275 @@
+package record
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/mullvad/message-queue/message"
+)
+
+// Format is the format of a recording
+type Format int
+
+const (
+	// NDJSON records every message as a line of JSON, with the message as an envelope like the one sent to clients
+	NDJSON Format = iota
+	// Binary records every message as a big-endian length followed by the fields of the message, prefixed by their
+	// lengths, and starts with a magic string for telling it apart from NDJSON
+	Binary
+)
+
+// ParseFormat parses the name of a format, either "ndjson" or "binary"
+func ParseFormat(name string) (Format, error) {
+	switch name {
+	case "ndjson":
+		return NDJSON, nil
+	case "binary":
+		return Binary, nil
+	default:
+		return 0, fmt.Errorf("unknown format %q, expected 'ndjson' or 'binary'", name)
+	}
+}
+
+const (
+	magic         = "MQREC\x00\x01\n"
+	maxRecordSize = 64 * 1024 * 1024
+)
+
+var errCorrupt = errors.New("corrupt record")
+
+// Entry is a recorded message, and the time it was recorded
+type Entry struct {
+	Time    time.Time        `json:"time"`
+	Message *message.Message `json:"message"`
+}
+
+// Writer writes the entries of a recording
+type Writer struct {
+	mutex   sync.Mutex
+	w       io.Writer
+	format  Format
+	started bool
+}
+
+// NewWriter creates a writer of a recording in the format
+func NewWriter(w io.Writer, format Format) *Writer {
+	return &Writer{
+		w:      w,
+		format: format,
+	}
+}
+
+// Write records an entry, and may be called concurrently
+// Every entry is written with a single write, for a recording to be readable up to its last entry if it's cut short
+func (w *Writer) Write(e Entry) error {
+	var data []byte
+	var err error
+	if w.format == Binary {
+		data, err = encodeBinary(e)
+	} else {
+		data, err = json.Marshal(e)
+		data = append(data, '\n')
+	}
+	if err != nil {
+		return err
+	}
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.format == Binary && !w.started {
+		if _, err := io.WriteString(w.w, magic); err != nil {
+			return err
+		}
+	}
+	w.started = true
+
+	_, err = w.w.Write(data)
+	return err
+}
+
+// Reader reads the entries of a recording in either format
+type Reader struct {
+	r      *bufio.Reader
+	format *Format // Detected on the first read
+	line   int     // The line of the last NDJSON entry read, for pointing out errors
+}
+
+// NewReader creates a reader of a recording, detecting its format
+func NewReader(r io.Reader) *Reader {
+	return &Reader{
+		r: bufio.NewReader(r),
+	}
+}
+
+// Read returns the next entry, or io.EOF at the end of the recording
+func (r *Reader) Read() (Entry, error) {
+	if r.format == nil {
+		format := NDJSON
+		if prefix, _ := r.r.Peek(len(magic)); string(prefix) == magic {
+			format = Binary
+			r.r.Discard(len(magic))
+		}
+		r.format = &format
+	}
+
+	if *r.format == Binary {
+		return decodeBinary(r.r)
+	}
+
+	for {
+		line, err := r.r.ReadBytes('\n')
+		if err == io.EOF && len(line) > 0 {
+			// An entry cut short by the recording being interrupted
+			return Entry{}, fmt.Errorf("line %d: %w", r.line+1, io.ErrUnexpectedEOF)
+		}
+		if err != nil {
+			return Entry{}, err
+		}
+		r.line++
+
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+
+		var e Entry
+		if err := json.Unmarshal(line, &e); err != nil {
+			return Entry{}, fmt.Errorf("line %d: %s", r.line, err)
+		}
+		if e.Message == nil {
+			return Entry{}, fmt.Errorf("line %d: entry without a message", r.line)
+		}
+		return e, nil
+	}
+}
+
+// encodeBinary encodes an entry as a record of the binary format
+// The record is the length of the rest of it, the time in nanoseconds since the Unix epoch, whether the message is a
+// gap, the channel, content type, headers and payload
+func encodeBinary(e Entry) ([]byte, error) {
+	m := e.Message
+
+	var b bytes.Buffer
+	b.Write(make([]byte, 4))
+
+	var fixed [9]byte
+	binary.BigEndian.PutUint64(fixed[0:8], uint64(e.Time.UnixNano()))
+	if m.Gap {
+		fixed[8] = 1
+	}
+	b.Write(fixed[:])
+
+	writeField(&b, []byte(m.Channel))
+	writeField(&b, []byte(m.ContentType))
+	writeUvarint(&b, uint64(len(m.Headers)))
+	for name, value := range m.Headers {
+		writeField(&b, []byte(name))
+		writeField(&b, []byte(value))
+	}
+	writeField(&b, m.Payload)
+
+	data := b.Bytes()
+	if len(data)-4 > maxRecordSize {
+		return nil, fmt.Errorf("message of %d bytes too large to record", len(data))
+	}
+	binary.BigEndian.PutUint32(data[0:4], uint32(len(data)-4))
+
+	return data, nil
+}
+
+func writeField(b *bytes.Buffer, field []byte) {
+	writeUvarint(b, uint64(len(field)))
+	b.Write(field)
+}
+
+func writeUvarint(b *bytes.Buffer, x uint64) {
+	var buf [binary.MaxVarintLen64]byte
+	b.Write(buf[:binary.PutUvarint(buf[:], x)])
+}
+
+func decodeBinary(r io.Reader) (Entry, error) {
+	var length [4]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return Entry{}, err
+	}
+
+	size := binary.BigEndian.Uint32(length[:])
+	if size > maxRecordSize || size < 9 {
+		return Entry{}, errCorrupt
+	}
+
+	data := make([]byte, size)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return Entry{}, io.ErrUnexpectedEOF
+	}
+
+	e := Entry{Time: time.Unix(0, int64(binary.BigEndian.Uint64(data[0:8])))}
+	gap := data[8] == 1
+	fields := bytes.NewReader(data[9:])
+
+	channel, err := readField(fields)
+	if err != nil {
+		return Entry{}, err
+	}
+	contentType, err := readField(fields)
+	if err != nil {
+		return Entry{}, err
+	}
+
+	headerCount, err := binary.ReadUvarint(fields)
+	if err != nil || headerCount > uint64(fields.Len()) {
+		return Entry{}, errCorrupt
+	}
+	var headers map[string]string
+	if headerCount > 0 {
+		headers = make(map[string]string, headerCount)
+	}
+	for i := uint64(0); i < headerCount; i++ {
+		name, err := readField(fields)
+		if err != nil {
+			return Entry{}, err
+		}
+		value, err := readField(fields)
+		if err != nil {
+			return Entry{}, err
+		}
+		headers[string(name)] = string(value)
+	}
+
+	payload, err := readField(fields)
+	if err != nil {
+		return Entry{}, err
+	}
+
+	e.Message = &message.Message{
+		Time:        e.Time,
+		Channel:     string(channel),
+		ContentType: string(contentType),
+		Headers:     headers,
+		Payload:     payload,
+		Gap:         gap,
+	}
+	if gap {
+		e.Message.Payload = nil
+	}
+
+	return e, nil
+}
+
+func readField(r *bytes.Reader) ([]byte, error) {
+	length, err := binary.ReadUvarint(r)
+	if err != nil || length > uint64(r.Len()) {
+		return nil, errCorrupt
+	}
+
+	field := make([]byte, length)
+	r.Read(field)
+	return field, nil
+}
@@ -0,0 +1,186 @@
+package record_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/mullvad/message-queue/message"
+	"github.com/mullvad/message-queue/record"
+)
+
+func TestRecording(t *testing.T) {
+	start := time.Unix(1600000000, 0)
+
+	withHeaders := message.New("orders", []byte(`{"id":1}`))
+	withHeaders.ContentType = "application/json"
+	withHeaders.Headers = map[string]string{"key": "1"}
+
+	entries := []record.Entry{
+		{Time: start, Message: withHeaders},
+		{Time: start.Add(time.Millisecond), Message: message.New("orders", []byte("text"))},
+		{Time: start.Add(time.Second), Message: message.New("binary", []byte{0, 0xff, '\n'})},
+		{Time: start.Add(time.Second * 2), Message: message.NewGap("orders")},
+	}
+
+	for _, format := range []string{"ndjson", "binary"} {
+		t.Run(format, func(t *testing.T) {
+			f, err := record.ParseFormat(format)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var b bytes.Buffer
+			w := record.NewWriter(&b, f)
+			for _, e := range entries {
+				if err := w.Write(e); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			r := record.NewReader(bytes.NewReader(b.Bytes()))
+			for i, expected := range entries {
+				e, err := r.Read()
+				if err != nil {
+					t.Fatalf("entry %d: %s", i, err)
+				}
+
+				if !e.Time.Equal(expected.Time) {
+					t.Errorf("entry %d: wrong time %s", i, e.Time)
+				}
+
+				m := e.Message
+				if m.Channel != expected.Message.Channel || m.ContentType != expected.Message.ContentType || m.Gap != expected.Message.Gap ||
+					!bytes.Equal(m.Payload, expected.Message.Payload) || !reflect.DeepEqual(m.Headers, expected.Message.Headers) {
+					t.Errorf("entry %d: wrong message %#v", i, m)
+				}
+			}
+
+			if _, err := r.Read(); err != io.EOF {
+				t.Fatalf("expected the end of the recording, got %v", err)
+			}
+
+			// The entries before an interrupted write are still readable
+			r = record.NewReader(bytes.NewReader(b.Bytes()[:b.Len()-3]))
+			for i := 0; i < len(entries)-1; i++ {
+				if _, err := r.Read(); err != nil {
+					t.Fatalf("entry %d: %s", i, err)
+				}
+			}
+			if _, err := r.Read(); !errors.Is(err, io.ErrUnexpectedEOF) {
+				t.Fatalf("expected a truncated entry, got %v", err)
+			}
+		})
+	}
+
+	t.Run("unknown format", func(t *testing.T) {
+		if _, err := record.ParseFormat("xml"); err == nil {
+			t.Fatal("no error")
+		}
+	})
+
+	t.Run("invalid entry", func(t *testing.T) {
+		r := record.NewReader(bytes.NewBufferString("\n{\"time\":\"2020-09-13T12:26:40Z\"}\n"))
+		if _, err := r.Read(); err == nil || err.Error() != "line 2: entry without a message" {
+			t.Fatalf("wrong error: %v", err)
+		}
+	})
+}
+
+func TestSource(t *testing.T) {
+	start := time.Unix(1600000000, 0)
+
+	var b bytes.Buffer
+	w := record.NewWriter(&b, record.NDJSON)
+	for i, channel := range []string{"a", "b", "a"} {
+		w.Write(record.Entry{
+			Time:    start.Add(time.Millisecond * 200 * time.Duration(i)),
+			Message: message.New(channel, []byte{byte('0' + i)}),
+		})
+	}
+	recording := b.Bytes()
+
+	t.Run("timing", func(t *testing.T) {
+		for _, test := range []struct {
+			speed    float64
+			min, max time.Duration
+		}{
+			{1, time.Millisecond * 400, time.Millisecond * 600},
+			{4, time.Millisecond * 100, time.Millisecond * 300},
+			{0, 0, time.Millisecond * 100},
+		} {
+			s := record.NewSource()
+
+			ctx, cancel := context.WithCancel(context.Background())
+			a, _ := s.SubscribeContext(ctx, "a")
+			b, _ := s.SubscribeContext(ctx, "b")
+
+			played := time.Now()
+			done := make(chan error, 1)
+			go func() {
+				done <- s.Play(ctx, record.NewReader(bytes.NewReader(recording)), test.speed)
+			}()
+
+			var received []string
+			for _, ch := range []<-chan *message.Message{a, b, a} {
+				select {
+				case m := <-ch:
+					received = append(received, string(m.Payload))
+				case <-time.After(time.Second * 5):
+					t.Fatalf("speed %v: message not replayed", test.speed)
+				}
+			}
+
+			if err := <-done; err != nil {
+				t.Fatal(err)
+			}
+			elapsed := time.Since(played)
+			cancel()
+
+			if !reflect.DeepEqual(received, []string{"0", "1", "2"}) {
+				t.Errorf("speed %v: wrong messages %v", test.speed, received)
+			}
+			if elapsed < test.min || elapsed > test.max {
+				t.Errorf("speed %v: replayed in %s", test.speed, elapsed)
+			}
+		}
+	})
+
+	t.Run("publish and unsubscribe", func(t *testing.T) {
+		s := record.NewSource()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		ch, _ := s.SubscribeContext(ctx, "a")
+
+		go s.Publish("a", []byte("published"))
+		select {
+		case m := <-ch:
+			if string(m.Payload) != "published" {
+				t.Fatalf("wrong message %q", m.Payload)
+			}
+		case <-time.After(time.Second * 5):
+			t.Fatal("message not received")
+		}
+
+		// Unsubscribing closes the channel, and nothing is delivered to it anymore
+		cancel()
+		for range ch {
+		}
+		s.Publish("a", []byte("ignored"))
+	})
+
+	t.Run("canceled", func(t *testing.T) {
+		s := record.NewSource()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		if err := s.Play(ctx, record.NewReader(bytes.NewReader(recording)), 1); err != context.Canceled {
+			t.Fatalf("wrong error: %v", err)
+		}
+	})
+}
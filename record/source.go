@@ -0,0 +1,132 @@
+package record
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/mullvad/message-queue/message"
+)
+
+// Source replays recordings to the subscribers of the recorded channels, standing in for redis when running without it
+type Source struct {
+	mutex         sync.Mutex
+	subscriptions map[string]map[*subscription]bool // By channel
+}
+
+type subscription struct {
+	ctx context.Context
+	out chan *message.Message
+}
+
+// NewSource creates a source without any subscribers
+func NewSource() *Source {
+	return &Source{
+		subscriptions: make(map[string]map[*subscription]bool),
+	}
+}
+
+// SubscribeContext returns a channel receiving the messages replayed on the channel, until the context has ended
+func (s *Source) SubscribeContext(ctx context.Context, channel string) (<-chan *message.Message, error) {
+	sub := &subscription{
+		ctx: ctx,
+		out: make(chan *message.Message),
+	}
+
+	s.mutex.Lock()
+	if s.subscriptions[channel] == nil {
+		s.subscriptions[channel] = make(map[*subscription]bool)
+	}
+	s.subscriptions[channel][sub] = true
+	s.mutex.Unlock()
+
+	go func() {
+		<-ctx.Done()
+
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+
+		delete(s.subscriptions[channel], sub)
+		if len(s.subscriptions[channel]) == 0 {
+			delete(s.subscriptions, channel)
+		}
+		close(sub.out)
+	}()
+
+	return sub.out, nil
+}
+
+// Publish passes a message on to the subscribers of the channel right away, as if it had been recorded
+func (s *Source) Publish(channel string, payload []byte) error {
+	s.deliver(message.New(channel, payload))
+	return nil
+}
+
+// Play replays the recording at the original timing multiplied by the speed, such as 2 for twice as fast, or as fast as
+// the subscribers keep up if the speed is zero
+// It returns nil at the end of the recording, or the context error if it ends first
+func (s *Source) Play(ctx context.Context, r *Reader, speed float64) error {
+	if speed < 0 {
+		return errors.New("the speed must not be negative")
+	}
+
+	var first time.Time
+	start := time.Now()
+	for {
+		e, err := r.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if first.IsZero() {
+			first = e.Time
+		}
+
+		if speed > 0 {
+			at := start.Add(time.Duration(float64(e.Time.Sub(first)) / speed))
+			if wait := time.Until(at); wait > 0 {
+				select {
+				case <-time.After(wait):
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			}
+		}
+
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		s.deliver(replayed(e.Message))
+	}
+}
+
+// replayed copies a recorded message, as received now
+func replayed(recorded *message.Message) *message.Message {
+	if recorded.Gap {
+		return message.NewGap(recorded.Channel)
+	}
+
+	m := message.New(recorded.Channel, recorded.Payload)
+	m.ContentType = recorded.ContentType
+	m.Headers = recorded.Headers
+	return m
+}
+
+// deliver passes the message on to every subscriber of its channel, waiting for each of them to receive it
+func (s *Source) deliver(m *message.Message) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for sub := range s.subscriptions[m.Channel] {
+		select {
+		case sub.out <- m:
+		case <-sub.ctx.Done():
+		}
+	}
+}
@@ -0,0 +1,555 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/mullvad/message-queue/api"
+	"github.com/mullvad/message-queue/config"
+	"github.com/mullvad/message-queue/message"
+	"github.com/mullvad/message-queue/pubsub"
+	"github.com/mullvad/message-queue/record"
+	"github.com/mullvad/message-queue/router"
+	"github.com/mullvad/message-queue/schema"
+	"github.com/mullvad/message-queue/wal"
+)
+
+// state keeps track of the channels and routes set up from the configuration, for applying changes to it while
+// running without dropping the connections of clients
+type state struct {
+	ctx     context.Context
+	pubsubs []*pubsub.PubSub // The primary redis servers, followed by the redundant ones, unless replaying
+	sources []source         // Where the channels are fed from, the redis servers or the recording being replayed
+	api     *api.API
+
+	mutex    sync.Mutex
+	cfg      *config.Config // The configuration last applied, if any
+	channels map[string]*channelState
+	routes   map[string]*routeState   // By source and channel
+	closing  map[string]chan struct{} // Closed once the history of a removed channel has been closed, by channel
+}
+
+type channelState struct {
+	config   config.Channel
+	sources  map[string]context.CancelFunc // Unsubscribes from the source on every redis server
+	keyspace context.CancelFunc            // Unsubscribes from the keyspace notifications, if the channel has any
+	log      *wal.Log                      // The history of the channel, if kept on disk
+	schema   *schema.Schema                // The schema of published messages, if any
+}
+
+// source is something channels can be fed from, either a redis server or a recording being replayed
+type source interface {
+	SubscribeContext(ctx context.Context, channel string) (<-chan *message.Message, error)
+}
+
+type routeState struct {
+	config config.Route
+	router *router.Router
+	cancel context.CancelFunc
+}
+
+// newState creates the state of channels fed from the redis servers, or from the recording being replayed if set
+func newState(ctx context.Context, pubsubs []*pubsub.PubSub, replay *record.Source, a *api.API) *state {
+	var sources []source
+	if replay != nil {
+		sources = append(sources, replay)
+	}
+	for _, ps := range pubsubs {
+		sources = append(sources, ps)
+	}
+
+	return &state{
+		ctx:      ctx,
+		pubsubs:  pubsubs,
+		sources:  sources,
+		api:      a,
+		channels: make(map[string]*channelState),
+		routes:   make(map[string]*routeState),
+		closing:  make(map[string]chan struct{}),
+	}
+}
+
+// apply makes the running channels and routes match the configuration
+// Channels are added, removed and have their sources and limits changed in place, while changes to how a channel
+// distributes or stores its messages, and to most global settings, only take effect after a restart
+// Every change is attempted, and the first error is returned
+func (s *state) apply(cfg *config.Config) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var first error
+	fail := func(err error) {
+		log.Println("error applying configuration:", err)
+		if first == nil {
+			first = err
+		}
+	}
+
+	if s.cfg != nil {
+		if cfg.Redis.Password != s.cfg.Redis.Password {
+			for _, ps := range s.pubsubs {
+				ps.SetPassword(cfg.Redis.Password)
+			}
+		}
+
+		if changed := restartRequired(s.cfg, cfg); changed != "" {
+			log.Printf("changes to %s only take effect after a restart", changed)
+		}
+	}
+
+	// Compare against the channels that are actually open, as a channel is closed if redis closes its sources
+	open := make(map[string]bool)
+	for _, name := range q.Channels() {
+		open[name] = true
+	}
+
+	configured := make(map[string]bool)
+	for _, channel := range cfg.Channels {
+		configured[channel.Name] = true
+	}
+
+	for name, c := range s.channels {
+		if !configured[name] || !open[name] {
+			s.removeChannel(name, c)
+		}
+	}
+
+	for _, channel := range cfg.Channels {
+		c, ok := s.channels[channel.Name]
+		if !ok {
+			if err := s.addChannel(cfg, channel); err != nil {
+				fail(fmt.Errorf("channel %q: %w", channel.Name, err))
+			}
+			continue
+		}
+
+		if err := s.updateChannel(cfg, c, channel); err != nil {
+			fail(fmt.Errorf("channel %q: %w", channel.Name, err))
+		}
+	}
+
+	routes := make(map[string]config.Route)
+	for _, route := range cfg.Routes {
+		routes[routeKey(route)] = route
+	}
+
+	for key, r := range s.routes {
+		if _, ok := routes[key]; !ok {
+			r.cancel()
+			delete(s.routes, key)
+		}
+	}
+
+	for key, route := range routes {
+		if r, ok := s.routes[key]; ok {
+			r.config = route
+			r.router.SetMaxChannels(route.MaxChannels)
+			continue
+		}
+
+		if err := s.addRoute(cfg, key, route); err != nil {
+			fail(fmt.Errorf("route %q: %w", route.Source, err))
+		}
+	}
+
+	s.cfg = cfg
+
+	// Authentication, publishing and ping intervals apply to new connections
+	s.api.SetChannels(channelSettings(s.channels))
+
+	creators := make([]api.Creator, 0, len(s.routes))
+	for _, r := range s.routes {
+		var tokens []string
+		if r.config.Auth != nil {
+			tokens = r.config.Auth.Tokens
+		}
+
+		creators = append(creators, api.Creator{
+			ChannelCreator: r.router,
+			Settings:       api.ChannelSettings{Tokens: tokens},
+		})
+	}
+	s.api.SetCreators(creators)
+
+	return first
+}
+
+// addChannel creates a channel and subscribes to its sources
+func (s *state) addChannel(cfg *config.Config, channel config.Channel) error {
+	publishSchema, err := channel.Publish.LoadSchema()
+	if err != nil {
+		return err
+	}
+
+	// A removed channel of the same name may still be storing its last messages in the history
+	if closing, ok := s.closing[channel.Name]; ok {
+		<-closing
+		delete(s.closing, channel.Name)
+	}
+
+	options, l, err := setupChannelOptions(cfg, channel)
+	if err != nil {
+		return err
+	}
+
+	out, err := q.CreateChannel(channel.Name, options...)
+	if err != nil {
+		closeLog(l)
+		return err
+	}
+
+	c := &channelState{
+		config:  channel,
+		sources: make(map[string]context.CancelFunc),
+		log:     l,
+		schema:  publishSchema,
+	}
+	s.channels[channel.Name] = c
+
+	// The channel was created with the input of its first source
+	for _, source := range channel.SourceChannels() {
+		if err := s.addSource(c, source, out); err != nil {
+			s.removeChannel(channel.Name, c)
+			return err
+		}
+		out = nil
+	}
+
+	if channel.Keyspace != nil {
+		if err := s.addKeyspace(c, *channel.Keyspace, out); err != nil {
+			s.removeChannel(channel.Name, c)
+			return err
+		}
+	}
+
+	return nil
+}
+
+// updateChannel changes the sources and limits of a running channel
+func (s *state) updateChannel(cfg *config.Config, c *channelState, channel config.Channel) error {
+	if !reflect.DeepEqual(structure(c.config), structure(channel)) {
+		log.Printf("channel %q: changes to how messages are distributed or stored, or to its keyspace notifications, only take effect after a restart", channel.Name)
+	}
+
+	sources := make(map[string]bool)
+	for _, source := range channel.SourceChannels() {
+		sources[source] = true
+	}
+
+	var first error
+	for _, source := range channel.SourceChannels() {
+		if _, ok := c.sources[source]; ok {
+			continue
+		}
+
+		if err := s.addSource(c, source, nil); err != nil && first == nil {
+			first = err
+		}
+	}
+
+	// Removing the last source would close the channel, which is only done when it's removed
+	for source, cancel := range c.sources {
+		if !sources[source] && (len(c.sources) > 1 || c.keyspace != nil) {
+			cancel()
+			delete(c.sources, source)
+		}
+	}
+
+	bufferSize := channel.BufferSize
+	if bufferSize == 0 {
+		bufferSize = cfg.BufferSize
+	}
+	if err := q.SetLimits(channel.Name, bufferSize, channel.MaxSubscribers); err != nil && first == nil {
+		first = err
+	}
+
+	// Keep the settings the channel is running with
+	c.config.Sources = channel.Sources
+	c.config.BufferSize = channel.BufferSize
+	c.config.MaxSubscribers = channel.MaxSubscribers
+	c.config.PingInterval = channel.PingInterval
+	c.config.Auth = channel.Auth
+
+	// Keep publishing as it was if the new schema can't be loaded
+	if publishSchema, err := channel.Publish.LoadSchema(); err != nil {
+		if first == nil {
+			first = err
+		}
+	} else {
+		c.config.Publish = channel.Publish
+		c.schema = publishSchema
+	}
+
+	return first
+}
+
+// addSource feeds the channel from the source on every redis server, or from the recording being replayed, using the
+// given input first if set, and adding new inputs to the channel otherwise
+func (s *state) addSource(c *channelState, source string, first chan<- *message.Message) (err error) {
+	ctx, cancel := context.WithCancel(s.ctx)
+	c.sources[source] = cancel
+
+	defer func() {
+		// Close the unused input, and unsubscribe from the source
+		if first != nil {
+			close(first)
+		}
+		if err != nil {
+			cancel()
+			delete(c.sources, source)
+		}
+	}()
+
+	for _, src := range s.sources {
+		in, err := src.SubscribeContext(ctx, source)
+		if err != nil {
+			return err
+		}
+
+		input := first
+		first = nil
+		if input == nil {
+			input, err = q.AddSource(c.config.Name)
+			if err != nil {
+				return err
+			}
+		}
+
+		go channelWorker(ctx, in, input)
+	}
+
+	return nil
+}
+
+// addKeyspace feeds the channel from the keyspace notifications on every redis server, enabling them first if
+// configured, using the given input first if set, and adding new inputs to the channel otherwise
+func (s *state) addKeyspace(c *channelState, keyspace config.Keyspace, first chan<- *message.Message) (err error) {
+	ctx, cancel := context.WithCancel(s.ctx)
+	c.keyspace = cancel
+
+	defer func() {
+		if first != nil {
+			close(first)
+		}
+		if err != nil {
+			cancel()
+			c.keyspace = nil
+		}
+	}()
+
+	for _, ps := range s.pubsubs {
+		if keyspace.Enable != "" {
+			if err := ps.EnableKeyspaceEvents(keyspace.Enable); err != nil {
+				return fmt.Errorf("error enabling keyspace notifications: %s", err)
+			}
+		}
+
+		in, err := ps.SubscribeKeyspace(ctx, pubsub.Keyspace{
+			Database: keyspace.Database,
+			Pattern:  keyspace.Pattern,
+			Events:   keyspace.Events,
+			Fetch:    keyspace.Fetch,
+		})
+		if err != nil {
+			return err
+		}
+
+		input := first
+		first = nil
+		if input == nil {
+			input, err = q.AddSource(c.config.Name)
+			if err != nil {
+				return err
+			}
+		}
+
+		go channelWorker(ctx, in, input)
+	}
+
+	return nil
+}
+
+// removeChannel unsubscribes from the sources of a channel, which closes it and disconnects its subscribers, and closes
+// its history once the queue is done with the channel
+func (s *state) removeChannel(name string, c *channelState) {
+	closed := q.Closed(name)
+
+	for _, cancel := range c.sources {
+		cancel()
+	}
+	if c.keyspace != nil {
+		c.keyspace()
+	}
+
+	if c.log != nil {
+		closing := make(chan struct{})
+		s.closing[name] = closing
+
+		go func() {
+			<-closed
+			closeLog(c.log)
+			close(closing)
+		}()
+	}
+
+	delete(s.channels, name)
+}
+
+// addRoute routes the messages of the source into the channels named after the rule
+func (s *state) addRoute(cfg *config.Config, key string, route config.Route) error {
+	prefix, keyFunc, err := route.Rule()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(s.ctx)
+	in, err := s.sources[0].SubscribeContext(ctx, route.Source)
+	if err != nil {
+		cancel()
+		return err
+	}
+
+	r := router.New(q, router.Rule{Prefix: prefix, Key: keyFunc}, cfg.RouteIdleTimeout, route.MaxChannels)
+	go r.Run(ctx, in)
+
+	s.routes[key] = &routeState{config: route, router: r, cancel: cancel}
+	return nil
+}
+
+// close closes every channel, and waits for their history to be closed
+func (s *state) close() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for name, c := range s.channels {
+		s.removeChannel(name, c)
+	}
+
+	for _, closing := range s.closing {
+		<-closing
+	}
+}
+
+func closeLog(l *wal.Log) {
+	if l == nil {
+		return
+	}
+
+	if err := l.Close(); err != nil {
+		log.Println("error closing history", err)
+	}
+}
+
+func routeKey(route config.Route) string {
+	return route.Source + "=" + route.Channel
+}
+
+// structure returns the settings of a channel that can't be changed while it's running
+func structure(channel config.Channel) interface{} {
+	return []interface{}{
+		channel.SlowConsumer,
+		channel.ConflateKey,
+		channel.Dispatch,
+		channel.Snapshot,
+		channel.Dedup,
+		channel.Retention,
+		channel.Keyspace,
+	}
+}
+
+// restartRequired returns the global settings that differ between the configurations and can't be changed while
+// running, or an empty string if there are none
+func restartRequired(old, new *config.Config) string {
+	for _, setting := range []struct {
+		name     string
+		old, new interface{}
+	}{
+		{"listen", old.Listen, new.Listen},
+		{"statsd_address", old.StatsdAddress, new.StatsdAddress},
+		{"ping_interval", old.PingInterval, new.PingInterval},
+		{"ping_timeout", old.PingTimeout, new.PingTimeout},
+		{"ack_timeout", old.AckTimeout, new.AckTimeout},
+		{"session_retention", old.SessionRetention, new.SessionRetention},
+		{"inbox_messages", old.InboxMessages, new.InboxMessages},
+		{"inbox_bytes", old.InboxBytes, new.InboxBytes},
+		{"dedup_window", old.DedupWindow, new.DedupWindow},
+		{"route_idle_timeout", old.RouteIdleTimeout, new.RouteIdleTimeout},
+		{"history", old.History, new.History},
+		{"replay", old.Replay, new.Replay},
+		{"redis.server_address", old.Redis.ServerAddress, new.Redis.ServerAddress},
+		{"redis.sentinel_service", old.Redis.SentinelService, new.Redis.SentinelService},
+		{"redis.sentinel_addresses", old.Redis.SentinelAddresses, new.Redis.SentinelAddresses},
+		{"redis.replicas", old.Redis.Replicas, new.Redis.Replicas},
+		{"redis.cluster_addresses", old.Redis.ClusterAddresses, new.Redis.ClusterAddresses},
+		{"redis.mirror_addresses", old.Redis.MirrorAddresses, new.Redis.MirrorAddresses},
+		{"redis.username", old.Redis.Username, new.Redis.Username},
+		{"redis.tls", old.Redis.TLS, new.Redis.TLS},
+		{"redis.sentinel_username", old.Redis.SentinelUsername, new.Redis.SentinelUsername},
+		{"redis.sentinel_password", old.Redis.SentinelPassword, new.Redis.SentinelPassword},
+		{"redis.sentinel_tls", old.Redis.SentinelTLS, new.Redis.SentinelTLS},
+	} {
+		if !reflect.DeepEqual(setting.old, setting.new) {
+			return setting.name
+		}
+	}
+
+	return ""
+}
+
+// reload reads the configuration file and applies it, keeping the running configuration if it's invalid
+func (s *state) reload(path string) {
+	cfg, err := config.Load(path)
+	if err != nil {
+		log.Printf("not reloading invalid configuration: %s", err)
+		return
+	}
+
+	if err := s.apply(cfg); err != nil {
+		log.Printf("configuration partially reloaded: %s", err)
+		return
+	}
+
+	log.Printf("configuration reloaded from %s", path)
+}
+
+// watchFile polls the file for changes to its modification time or size, until the context has ended
+func watchFile(ctx context.Context, path string, interval time.Duration) <-chan struct{} {
+	changes := make(chan struct{}, 1)
+
+	go func() {
+		last, _ := os.Stat(path)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				info, err := os.Stat(path)
+				if err != nil {
+					// The file may be in the middle of being replaced
+					continue
+				}
+
+				if last != nil && info.ModTime().Equal(last.ModTime()) && info.Size() == last.Size() {
+					continue
+				}
+				last = info
+
+				select {
+				case changes <- struct{}{}:
+				default:
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return changes
+}
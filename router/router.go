@@ -0,0 +1,271 @@
+package router
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mullvad/message-queue/message"
+	"github.com/mullvad/message-queue/queue"
+)
+
+// Rule routes the messages of a source channel into queue channels named after a key of every message
+type Rule struct {
+	Prefix string        // The prefix of the names of the queue channels, such as "orders."
+	Key    queue.KeyFunc // The key of every message, appended to the prefix
+}
+
+// DefaultMaxChannels is the maximum number of routed channels open at once, if not set
+const DefaultMaxChannels = 1000
+
+// onDemandRatio is the ratio of the maximum number of routed channels to the maximum number created on demand, before
+// any messages have been routed to them, so that clients subscribing to made up channels can't starve routed messages
+const onDemandRatio = 10
+
+// ErrTooManyChannels is returned when creating a routed channel while the maximum number are open
+var ErrTooManyChannels = errors.New("too many routed channels")
+
+// Router routes the messages of a source channel into dynamically created queue channels
+// Routed channels are closed once they have had no messages and no subscribers for the idle timeout, and at most the
+// maximum number of them are open at once, of which only a tenth may be created on demand, as any client may create
+// them by subscribing
+type Router struct {
+	queue       *queue.Queue
+	rule        Rule
+	options     []queue.ChannelOption
+	idleTimeout time.Duration
+	maxChannels int
+
+	mutex    sync.Mutex
+	channels map[string]*route
+	closed   bool
+}
+
+type route struct {
+	input    chan<- *message.Message
+	lastUsed time.Time
+	closing  <-chan struct{} // Closed once the queue has removed the channel, if it's being closed
+	onDemand bool            // Created on demand, and no messages have been routed to it yet
+}
+
+// New creates a new router, creating up to the maximum number of routed channels, DefaultMaxChannels if zero, with the
+// given options
+func New(q *queue.Queue, rule Rule, idleTimeout time.Duration, maxChannels int, options ...queue.ChannelOption) *Router {
+	if maxChannels <= 0 {
+		maxChannels = DefaultMaxChannels
+	}
+
+	return &Router{
+		queue:       q,
+		rule:        rule,
+		options:     options,
+		idleTimeout: idleTimeout,
+		maxChannels: maxChannels,
+		channels:    make(map[string]*route),
+	}
+}
+
+// Run routes the messages from the source channel until it's closed, or the context has ended, and then closes the
+// routed channels
+// Messages without a key are dropped, and gaps are passed on to every routed channel
+func (r *Router) Run(ctx context.Context, in <-chan *message.Message) {
+	defer r.close()
+
+	ticker := time.NewTicker(r.idleTimeout / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case m, open := <-in:
+			if !open {
+				return
+			}
+
+			if m.Gap {
+				// The routed channels are only closed by this goroutine, so they can be sent to without the mutex
+				for _, input := range r.inputs() {
+					select {
+					case input <- m:
+					case <-ctx.Done():
+						return
+					}
+				}
+				continue
+			}
+
+			key, ok := r.rule.Key(m)
+			if !ok {
+				continue
+			}
+
+			input, err := r.channel(r.rule.Prefix+key, false)
+			if err != nil {
+				log.Println("error routing message", err)
+				continue
+			}
+
+			select {
+			case input <- m:
+			case <-ctx.Done():
+				return
+			}
+		case now := <-ticker.C:
+			r.closeIdle(now)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// SetMaxChannels changes the maximum number of routed channels, DefaultMaxChannels if zero
+// Channels already open above the new maximum are left open until they're idle
+func (r *Router) SetMaxChannels(maxChannels int) {
+	if maxChannels <= 0 {
+		maxChannels = DefaultMaxChannels
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.maxChannels = maxChannels
+}
+
+// Matches returns whether the name of the channel matches the rule
+func (r *Router) Matches(channelName string) bool {
+	return strings.HasPrefix(channelName, r.rule.Prefix) && len(channelName) > len(r.rule.Prefix)
+}
+
+// Create creates the routed channel, so that clients may subscribe to it before any messages have been routed to it
+// Returns an error if the name doesn't match the rule, or the maximum number of routed channels, or of channels created
+// on demand, are open
+func (r *Router) Create(channelName string) error {
+	if !r.Matches(channelName) {
+		return fmt.Errorf("%q: not a routed channel", channelName)
+	}
+
+	_, err := r.channel(channelName, true)
+	return err
+}
+
+// channel returns the input of a routed channel, creating it if it doesn't exist, either on demand or for routing a
+// message to it
+func (r *Router) channel(channelName string, onDemand bool) (chan<- *message.Message, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.closed {
+		return nil, fmt.Errorf("%q: router closed", channelName)
+	}
+
+	if c, ok := r.channels[channelName]; ok {
+		if c.closing == nil {
+			c.lastUsed = time.Now()
+			c.onDemand = c.onDemand && onDemand
+			return c.input, nil
+		}
+
+		// The name can only be reused once the queue is done with the closed channel, which doesn't take long
+		<-c.closing
+		delete(r.channels, channelName)
+	}
+
+	if len(r.channels) >= r.maxChannels || (onDemand && r.onDemandChannels() >= r.maxOnDemandChannels()) {
+		return nil, fmt.Errorf("%q: %w", channelName, ErrTooManyChannels)
+	}
+
+	input, err := r.queue.CreateChannel(channelName, r.options...)
+	if err != nil {
+		return nil, err
+	}
+
+	r.channels[channelName] = &route{
+		input:    input,
+		lastUsed: time.Now(),
+		onDemand: onDemand,
+	}
+
+	return input, nil
+}
+
+// onDemandChannels returns the number of channels created on demand that no messages have been routed to yet
+// NOTE mutex must be held
+func (r *Router) onDemandChannels() int {
+	n := 0
+	for _, c := range r.channels {
+		if c.onDemand {
+			n++
+		}
+	}
+	return n
+}
+
+// maxOnDemandChannels returns the maximum number of channels created on demand, which is at least one
+// NOTE mutex must be held
+func (r *Router) maxOnDemandChannels() int {
+	if r.maxChannels < onDemandRatio {
+		return 1
+	}
+	return r.maxChannels / onDemandRatio
+}
+
+// inputs returns the inputs of the routed channels
+func (r *Router) inputs() []chan<- *message.Message {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	inputs := make([]chan<- *message.Message, 0, len(r.channels))
+	for _, c := range r.channels {
+		if c.closing == nil {
+			inputs = append(inputs, c.input)
+		}
+	}
+	return inputs
+}
+
+// closeIdle closes the routed channels that have had no messages and no subscribers for the idle timeout
+// Closed channels are kept track of until the queue has removed them, so that they aren't created again before then
+func (r *Router) closeIdle(now time.Time) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	for name, c := range r.channels {
+		if c.closing != nil {
+			select {
+			case <-c.closing:
+				delete(r.channels, name)
+			default:
+			}
+			continue
+		}
+
+		if now.Sub(c.lastUsed) < r.idleTimeout {
+			continue
+		}
+
+		if r.queue.ChannelSubscriberCount(name) > 0 {
+			c.lastUsed = now
+			continue
+		}
+
+		c.closing = r.queue.Closed(name)
+		close(c.input)
+	}
+}
+
+func (r *Router) close() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	for name, c := range r.channels {
+		if c.closing == nil {
+			close(c.input)
+		}
+		delete(r.channels, name)
+	}
+
+	r.closed = true
+}
@@ -0,0 +1,170 @@
+package router_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/mullvad/message-queue/message"
+	"github.com/mullvad/message-queue/queue"
+	"github.com/mullvad/message-queue/router"
+)
+
+func TestRouter(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	q := queue.New(ctx, 100)
+
+	in := make(chan *message.Message)
+	r := router.New(q, router.Rule{Prefix: "orders.", Key: queue.FieldKey("customer")}, time.Millisecond*20, 0)
+	go r.Run(ctx, in)
+
+	t.Run("route messages", func(t *testing.T) {
+		if err := r.Create("orders.1"); err != nil {
+			t.Fatal(err)
+		}
+
+		sub, err := q.Subscribe(ctx, "orders.1")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		in <- message.New("orders", []byte(`{"customer":2}`))
+		in <- message.New("orders", []byte(`{"customer":1}`))
+
+		if msg := <-sub; string(msg.Payload) != `{"customer":1}` || msg.Channel != "orders" {
+			t.Fatalf("wrong message: %s", msg.Payload)
+		}
+	})
+
+	t.Run("pass on gaps to every channel", func(t *testing.T) {
+		var subs []<-chan *message.Message
+		for _, name := range []string{"orders.4", "orders.5"} {
+			r.Create(name)
+			sub, err := q.Subscribe(ctx, name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			subs = append(subs, sub)
+		}
+
+		in <- message.NewGap("orders")
+
+		for _, sub := range subs {
+			if msg := <-sub; !msg.Gap {
+				t.Fatalf("wrong message: %s", msg.Payload)
+			}
+		}
+	})
+
+	t.Run("ignore other channels", func(t *testing.T) {
+		if r.Matches("other.1") || r.Matches("orders.") || !r.Matches("orders.1") {
+			t.Fatal("wrong channels matched")
+		}
+
+		if r.Create("other.1") == nil || r.Create("orders.") == nil {
+			t.Fatal("channel created")
+		}
+	})
+
+	t.Run("close idle channels", func(t *testing.T) {
+		in <- message.New("orders", []byte(`{"customer":3}`))
+
+		time.Sleep(time.Millisecond * 100)
+
+		if _, err := q.Subscribe(ctx, "orders.3"); err == nil {
+			t.Fatal("channel not closed")
+		}
+
+		// Channels with subscribers are kept
+		if _, err := q.Subscribe(ctx, "orders.1"); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("route to closed channels again", func(t *testing.T) {
+		if err := r.Create("orders.3"); err != nil {
+			t.Fatal(err)
+		}
+
+		sub, err := q.Subscribe(ctx, "orders.3")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		in <- message.New("orders", []byte(`{"customer":3}`))
+		if m := <-sub; string(m.Payload) != `{"customer":3}` {
+			t.Fatalf("wrong message: %s", m.Payload)
+		}
+	})
+
+	t.Run("close channels with the source", func(t *testing.T) {
+		sub, err := q.Subscribe(ctx, "orders.1")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		close(in)
+
+		for range sub {
+		}
+
+		if err := r.Create("orders.1"); err == nil {
+			t.Fatal("channel created after closing")
+		}
+		if _, err := q.Subscribe(ctx, "orders.1"); err == nil {
+			t.Fatal("channel created after closing")
+		}
+	})
+}
+
+func TestMaxChannels(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	q := queue.New(ctx, 100)
+
+	in := make(chan *message.Message)
+	r := router.New(q, router.Rule{Prefix: "orders.", Key: queue.FieldKey("customer")}, time.Minute, 20)
+	go r.Run(ctx, in)
+
+	// A tenth of the channels may be created on demand
+	for _, name := range []string{"orders.1", "orders.2"} {
+		if err := r.Create(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := r.Create("orders.3"); !errors.Is(err, router.ErrTooManyChannels) {
+		t.Fatalf("wrong error: %v", err)
+	}
+
+	// Messages still create channels, and channels created on demand no longer count as such once they get messages
+	in <- message.New("orders", []byte(`{"customer":3}`))
+	in <- message.New("orders", []byte(`{"customer":1}`))
+	in <- message.New("orders", []byte(`{"customer":3}`))
+
+	if _, err := q.Subscribe(ctx, "orders.3"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := r.Create("orders.4"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Messages for other keys are dropped rather than creating channels once the maximum number are open
+	r.SetMaxChannels(4)
+	in <- message.New("orders", []byte(`{"customer":5}`))
+	in <- message.New("orders", []byte(`{"customer":1}`))
+
+	if _, err := q.Subscribe(ctx, "orders.5"); err == nil {
+		t.Fatal("channel created")
+	}
+
+	// The open channels can still be created
+	if err := r.Create("orders.2"); err != nil {
+		t.Fatal(err)
+	}
+}
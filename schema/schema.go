@@ -0,0 +1,420 @@
+package schema
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"unicode/utf8"
+)
+
+// Schema is a parsed JSON schema that JSON values can be validated against
+//
+// A subset of JSON Schema is supported, which covers describing the structure of messages:
+//
+//	type, enum, const, properties, required, additionalProperties, items, minItems, maxItems,
+//	minLength, maxLength, pattern, minimum, maximum, exclusiveMinimum and exclusiveMaximum
+//
+// Annotations such as title and description are ignored, and any other keywords are rejected rather than ignored,
+// so that values are never accepted by a schema that means to reject them
+type Schema struct {
+	always *bool // Set for the boolean schemas, true accepting and false rejecting everything
+
+	types                []string
+	enum                 []interface{}
+	constant             *interface{}
+	properties           map[string]*Schema
+	required             []string
+	additionalProperties *Schema
+	items                *Schema
+	minItems, maxItems   *int
+	minLength, maxLength *int
+	pattern              *regexp.Regexp
+	minimum, maximum     *float64
+	exclusiveMinimum     *float64
+	exclusiveMaximum     *float64
+}
+
+// annotations are the keywords that don't affect validation
+var annotations = map[string]bool{
+	"$schema":     true,
+	"$id":         true,
+	"$comment":    true,
+	"title":       true,
+	"description": true,
+	"default":     true,
+	"examples":    true,
+}
+
+var types = map[string]bool{
+	"null":    true,
+	"boolean": true,
+	"object":  true,
+	"array":   true,
+	"number":  true,
+	"integer": true,
+	"string":  true,
+}
+
+// Parse parses a JSON schema
+func Parse(data []byte) (*Schema, error) {
+	var value interface{}
+	if err := json.Unmarshal(data, &value); err != nil {
+		return nil, err
+	}
+
+	return parse(value, "")
+}
+
+func parse(value interface{}, path string) (*Schema, error) {
+	var object map[string]interface{}
+	switch v := value.(type) {
+	case bool:
+		return &Schema{always: &v}, nil
+	case map[string]interface{}:
+		object = v
+	default:
+		return nil, errorf(path, "a schema must be an object or a boolean")
+	}
+
+	s := &Schema{}
+	var err error
+
+	// Go through the keywords in order, for the errors to be deterministic
+	keywords := make([]string, 0, len(object))
+	for keyword := range object {
+		keywords = append(keywords, keyword)
+	}
+	sort.Strings(keywords)
+
+	for _, keyword := range keywords {
+		v := object[keyword]
+		keywordPath := join(path, keyword)
+
+		switch keyword {
+		case "type":
+			s.types, err = parseTypes(v, keywordPath)
+		case "enum":
+			values, ok := v.([]interface{})
+			if !ok {
+				return nil, errorf(keywordPath, "expected an array")
+			}
+			s.enum = values
+		case "const":
+			s.constant = &v
+		case "properties":
+			properties, ok := v.(map[string]interface{})
+			if !ok {
+				return nil, errorf(keywordPath, "expected an object")
+			}
+
+			s.properties = make(map[string]*Schema)
+			for name, property := range properties {
+				if s.properties[name], err = parse(property, join(keywordPath, name)); err != nil {
+					return nil, err
+				}
+			}
+		case "required":
+			s.required, err = parseStrings(v, keywordPath)
+		case "additionalProperties":
+			s.additionalProperties, err = parse(v, keywordPath)
+		case "items":
+			s.items, err = parse(v, keywordPath)
+		case "minItems":
+			s.minItems, err = parseCount(v, keywordPath)
+		case "maxItems":
+			s.maxItems, err = parseCount(v, keywordPath)
+		case "minLength":
+			s.minLength, err = parseCount(v, keywordPath)
+		case "maxLength":
+			s.maxLength, err = parseCount(v, keywordPath)
+		case "pattern":
+			expression, ok := v.(string)
+			if !ok {
+				return nil, errorf(keywordPath, "expected a string")
+			}
+			if s.pattern, err = regexp.Compile(expression); err != nil {
+				return nil, errorf(keywordPath, "%s", err)
+			}
+		case "minimum":
+			s.minimum, err = parseNumber(v, keywordPath)
+		case "maximum":
+			s.maximum, err = parseNumber(v, keywordPath)
+		case "exclusiveMinimum":
+			s.exclusiveMinimum, err = parseNumber(v, keywordPath)
+		case "exclusiveMaximum":
+			s.exclusiveMaximum, err = parseNumber(v, keywordPath)
+		default:
+			if !annotations[keyword] {
+				return nil, errorf(keywordPath, "unsupported keyword")
+			}
+		}
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return s, nil
+}
+
+func parseTypes(value interface{}, path string) ([]string, error) {
+	var names []string
+	if name, ok := value.(string); ok {
+		names = []string{name}
+	} else {
+		var err error
+		if names, err = parseStrings(value, path); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, name := range names {
+		if !types[name] {
+			return nil, errorf(path, "unknown type %q", name)
+		}
+	}
+
+	return names, nil
+}
+
+func parseStrings(value interface{}, path string) ([]string, error) {
+	values, ok := value.([]interface{})
+	if !ok {
+		return nil, errorf(path, "expected an array of strings")
+	}
+
+	result := make([]string, 0, len(values))
+	for _, v := range values {
+		s, ok := v.(string)
+		if !ok {
+			return nil, errorf(path, "expected an array of strings")
+		}
+		result = append(result, s)
+	}
+
+	return result, nil
+}
+
+func parseCount(value interface{}, path string) (*int, error) {
+	number, ok := value.(float64)
+	if !ok || number < 0 || number != math.Trunc(number) {
+		return nil, errorf(path, "expected a non-negative integer")
+	}
+
+	count := int(number)
+	return &count, nil
+}
+
+func parseNumber(value interface{}, path string) (*float64, error) {
+	number, ok := value.(float64)
+	if !ok {
+		return nil, errorf(path, "expected a number")
+	}
+	return &number, nil
+}
+
+// Validate checks that the JSON value, as decoded by encoding/json, matches the schema, and returns an error pointing
+// out the first mismatch otherwise
+func (s *Schema) Validate(value interface{}) error {
+	return s.validate(value, "")
+}
+
+// ValidateJSON decodes the JSON document and validates it
+func (s *Schema) ValidateJSON(data []byte) error {
+	var value interface{}
+	if err := json.Unmarshal(data, &value); err != nil {
+		return fmt.Errorf("invalid JSON: %s", err)
+	}
+
+	return s.Validate(value)
+}
+
+func (s *Schema) validate(value interface{}, path string) error {
+	if s.always != nil {
+		if !*s.always {
+			return errorf(path, "not allowed")
+		}
+		return nil
+	}
+
+	if len(s.types) > 0 && !s.hasType(value) {
+		if len(s.types) == 1 {
+			return errorf(path, "expected %s", s.types[0])
+		}
+		return errorf(path, "expected one of %v", s.types)
+	}
+
+	if s.constant != nil && !reflect.DeepEqual(value, *s.constant) {
+		return errorf(path, "expected %s", encode(*s.constant))
+	}
+
+	if s.enum != nil && !s.inEnum(value) {
+		return errorf(path, "expected one of %s", encode(s.enum))
+	}
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		return s.validateObject(v, path)
+	case []interface{}:
+		return s.validateArray(v, path)
+	case string:
+		return s.validateString(v, path)
+	case float64:
+		return s.validateNumber(v, path)
+	}
+
+	return nil
+}
+
+func (s *Schema) hasType(value interface{}) bool {
+	for _, name := range s.types {
+		switch v := value.(type) {
+		case nil:
+			if name == "null" {
+				return true
+			}
+		case bool:
+			if name == "boolean" {
+				return true
+			}
+		case map[string]interface{}:
+			if name == "object" {
+				return true
+			}
+		case []interface{}:
+			if name == "array" {
+				return true
+			}
+		case string:
+			if name == "string" {
+				return true
+			}
+		case float64:
+			if name == "number" || (name == "integer" && v == math.Trunc(v)) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func (s *Schema) inEnum(value interface{}) bool {
+	for _, allowed := range s.enum {
+		if reflect.DeepEqual(value, allowed) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Schema) validateObject(object map[string]interface{}, path string) error {
+	for _, name := range s.required {
+		if _, ok := object[name]; !ok {
+			return errorf(join(path, name), "required")
+		}
+	}
+
+	names := make([]string, 0, len(object))
+	for name := range object {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		property, ok := s.properties[name]
+		if !ok {
+			property = s.additionalProperties
+		}
+
+		if property != nil {
+			if err := property.validate(object[name], join(path, name)); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (s *Schema) validateArray(array []interface{}, path string) error {
+	if s.minItems != nil && len(array) < *s.minItems {
+		return errorf(path, "expected at least %d items", *s.minItems)
+	}
+
+	if s.maxItems != nil && len(array) > *s.maxItems {
+		return errorf(path, "expected at most %d items", *s.maxItems)
+	}
+
+	if s.items != nil {
+		for i, item := range array {
+			if err := s.items.validate(item, join(path, strconv.Itoa(i))); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (s *Schema) validateString(value string, path string) error {
+	length := utf8.RuneCountInString(value)
+
+	if s.minLength != nil && length < *s.minLength {
+		return errorf(path, "expected at least %d characters", *s.minLength)
+	}
+
+	if s.maxLength != nil && length > *s.maxLength {
+		return errorf(path, "expected at most %d characters", *s.maxLength)
+	}
+
+	if s.pattern != nil && !s.pattern.MatchString(value) {
+		return errorf(path, "expected to match %q", s.pattern)
+	}
+
+	return nil
+}
+
+func (s *Schema) validateNumber(value float64, path string) error {
+	if s.minimum != nil && value < *s.minimum {
+		return errorf(path, "expected at least %v", *s.minimum)
+	}
+
+	if s.maximum != nil && value > *s.maximum {
+		return errorf(path, "expected at most %v", *s.maximum)
+	}
+
+	if s.exclusiveMinimum != nil && value <= *s.exclusiveMinimum {
+		return errorf(path, "expected more than %v", *s.exclusiveMinimum)
+	}
+
+	if s.exclusiveMaximum != nil && value >= *s.exclusiveMaximum {
+		return errorf(path, "expected less than %v", *s.exclusiveMaximum)
+	}
+
+	return nil
+}
+
+// join appends a field to a dot-delimited path, like the paths of filter expressions
+func join(path, field string) string {
+	if path == "" {
+		return field
+	}
+	return path + "." + field
+}
+
+func errorf(path string, format string, args ...interface{}) error {
+	if path == "" {
+		path = "value"
+	}
+	return fmt.Errorf("%s: %s", path, fmt.Sprintf(format, args...))
+}
+
+func encode(value interface{}) string {
+	data, _ := json.Marshal(value)
+	return string(data)
+}
@@ -0,0 +1,88 @@
+package schema_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/mullvad/message-queue/schema"
+)
+
+const cursor = `{
+	"$schema": "http://json-schema.org/draft-07/schema#",
+	"title": "Cursor",
+	"type": "object",
+	"required": ["user", "x", "y"],
+	"additionalProperties": false,
+	"properties": {
+		"user": {"type": "string", "minLength": 1, "maxLength": 8, "pattern": "^[a-z]+$"},
+		"x": {"type": "integer", "minimum": 0, "exclusiveMaximum": 1000},
+		"y": {"type": "number", "minimum": 0},
+		"color": {"enum": ["red", "blue"]},
+		"tags": {"type": "array", "items": {"type": "string"}, "maxItems": 2},
+		"version": {"const": 1},
+		"note": {"type": ["string", "null"]}
+	}
+}`
+
+func TestValidate(t *testing.T) {
+	s, err := schema.Parse([]byte(cursor))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		Document string
+		Error    string
+	}{
+		{`{"user":"alice","x":1,"y":2.5}`, ""},
+		{`{"user":"alice","x":1,"y":2,"color":"red","tags":["a","b"],"version":1,"note":null}`, ""},
+		{`[]`, "value: expected object"},
+		{`{"user":"alice","x":1}`, "y: required"},
+		{`{"user":"alice","x":1.5,"y":2}`, "x: expected integer"},
+		{`{"user":"alice","x":1000,"y":2}`, "x: expected less than 1000"},
+		{`{"user":"alice","x":1,"y":-1}`, "y: expected at least 0"},
+		{`{"user":"","x":1,"y":2}`, "user: expected at least 1 characters"},
+		{`{"user":"alicealice","x":1,"y":2}`, "user: expected at most 8 characters"},
+		{`{"user":"Alice","x":1,"y":2}`, "user: expected to match"},
+		{`{"user":"alice","x":1,"y":2,"color":"green"}`, `color: expected one of ["red","blue"]`},
+		{`{"user":"alice","x":1,"y":2,"tags":["a",1]}`, "tags.1: expected string"},
+		{`{"user":"alice","x":1,"y":2,"tags":["a","b","c"]}`, "tags: expected at most 2 items"},
+		{`{"user":"alice","x":1,"y":2,"version":2}`, "version: expected 1"},
+		{`{"user":"alice","x":1,"y":2,"note":1}`, "note: expected one of [string null]"},
+		{`{"user":"alice","x":1,"y":2,"extra":true}`, "extra: not allowed"},
+		{`{"user":`, "invalid JSON"},
+	}
+
+	for _, test := range tests {
+		err := s.ValidateJSON([]byte(test.Document))
+		if test.Error == "" && err != nil {
+			t.Errorf("%s: %s", test.Document, err)
+		} else if test.Error != "" && (err == nil || !strings.Contains(err.Error(), test.Error)) {
+			t.Errorf("%s: wrong error %v", test.Document, err)
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		Schema string
+		Error  string
+	}{
+		{`true`, ""},
+		{`{"type":"integer","description":"anything"}`, ""},
+		{`"object"`, "a schema must be an object or a boolean"},
+		{`{"type":"float"}`, `type: unknown type "float"`},
+		{`{"oneOf":[{"type":"string"}]}`, "oneOf: unsupported keyword"},
+		{`{"properties":{"a":{"minLength":-1}}}`, "properties.a.minLength: expected a non-negative integer"},
+		{`{"pattern":"("}`, "pattern:"},
+	}
+
+	for _, test := range tests {
+		_, err := schema.Parse([]byte(test.Schema))
+		if test.Error == "" && err != nil {
+			t.Errorf("%s: %s", test.Schema, err)
+		} else if test.Error != "" && (err == nil || !strings.Contains(err.Error(), test.Error)) {
+			t.Errorf("%s: wrong error %v", test.Schema, err)
+		}
+	}
+}
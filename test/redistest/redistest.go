@@ -0,0 +1,467 @@
+package redistest
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// The roles of servers, as reported by the ROLE command
+const (
+	Primary  = "master"
+	Replica  = "slave"
+	Sentinel = "sentinel"
+)
+
+// Server is a stand-in for a redis server or sentinel speaking RESP2, implementing authentication, pubsub, the
+// sentinel commands and enough of the other commands for the pubsub package
+// Failures are injected by disconnecting its clients, changing its role, and announcing failovers if it's a sentinel
+type Server struct {
+	listener net.Listener
+
+	mutex    sync.Mutex
+	role     string
+	username string // The ACL user clients must authenticate as, the default user if not set
+	password string // Clients must authenticate if set
+	primary  *Server
+	replicas []*Server
+	conns    map[net.Conn]*conn
+	values   map[string]string            // String keys, shared between the databases
+	hashes   map[string]map[string]string // Hash keys, shared between the databases
+	config   map[string]string
+}
+
+// conn is the state of a client connection
+type conn struct {
+	authenticated bool
+	channels      map[string]bool
+	patterns      map[string]bool
+}
+
+// NewServer starts a server with the given role, listening on a random local port
+// It panics if it fails to listen, like httptest.NewServer
+func NewServer(role string) *Server {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(fmt.Sprintf("redistest: failed to listen: %s", err))
+	}
+
+	return serve(listener, role)
+}
+
+// NewTLSServer starts a server with the given role terminating TLS with the configuration, which may require client
+// certificates
+func NewTLSServer(role string, config *tls.Config) *Server {
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", config)
+	if err != nil {
+		panic(fmt.Sprintf("redistest: failed to listen: %s", err))
+	}
+
+	return serve(listener, role)
+}
+
+func serve(listener net.Listener, role string) *Server {
+	s := &Server{
+		listener: listener,
+		role:     role,
+		conns:    make(map[net.Conn]*conn),
+		values:   make(map[string]string),
+		hashes:   make(map[string]map[string]string),
+		config:   map[string]string{"notify-keyspace-events": ""},
+	}
+
+	go func() {
+		for {
+			c, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(c)
+		}
+	}()
+
+	return s
+}
+
+// Addr returns the address the server listens on, such as "127.0.0.1:1234"
+func (s *Server) Addr() string {
+	return s.listener.Addr().String()
+}
+
+// Close stops listening and disconnects the clients
+func (s *Server) Close() {
+	s.listener.Close()
+	s.Disconnect()
+}
+
+// Disconnect closes the connections of the clients, which may connect again
+func (s *Server) Disconnect() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for c := range s.conns {
+		c.Close()
+	}
+}
+
+// RequireAuth requires new connections to authenticate with the password, as the ACL user if set
+func (s *Server) RequireAuth(username, password string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.username = username
+	s.password = password
+}
+
+// SetRole changes the role of the server, without disconnecting its clients
+func (s *Server) SetRole(role string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.role = role
+}
+
+// SetTopology sets the primary and replicas announced by a sentinel, for every service
+func (s *Server) SetTopology(primary *Server, replicas ...*Server) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.primary = primary
+	s.replicas = replicas
+}
+
+// Failover makes the replica the primary of the service managed by a sentinel, and the previous primary one of its
+// replicas, and announces it like redis sentinel, with +odown followed by +switch-master
+func (s *Server) Failover(service string, replica *Server) {
+	s.mutex.Lock()
+	previous := s.primary
+	replicas := []*Server{previous}
+	for _, r := range s.replicas {
+		if r != replica {
+			replicas = append(replicas, r)
+		}
+	}
+	s.mutex.Unlock()
+
+	previous.SetRole(Replica)
+	replica.SetRole(Primary)
+	s.SetTopology(replica, replicas...)
+
+	s.Publish("+odown", fmt.Sprintf("master %s %s #quorum 1/1", service, hostPort(previous.Addr())))
+	s.Publish("+switch-master", fmt.Sprintf("%s %s %s", service, hostPort(previous.Addr()), hostPort(replica.Addr())))
+}
+
+// Set sets a string key
+func (s *Server) Set(key string, value string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	delete(s.hashes, key)
+	s.values[key] = value
+}
+
+// SetHash sets a hash key
+func (s *Server) SetHash(key string, fields map[string]string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	delete(s.values, key)
+	s.hashes[key] = fields
+}
+
+// Config returns a configuration parameter, as set with CONFIG SET
+func (s *Server) Config(name string) string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.config[name]
+}
+
+// Publish sends a message to the clients subscribed to the channel, or a pattern matching it, and returns their number
+func (s *Server) Publish(channel string, payload string) int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.deliver(channel, payload)
+}
+
+// NOTE mutex must be held
+func (s *Server) deliver(channel string, payload string) int {
+	receivers := 0
+	for c, state := range s.conns {
+		if state.channels[channel] {
+			fmt.Fprintf(c, "*3\r\n%s%s%s", BulkString("message"), BulkString(channel), BulkString(payload))
+			receivers++
+		}
+
+		for pattern := range state.patterns {
+			if matched, _ := path.Match(pattern, channel); matched {
+				fmt.Fprintf(c, "*4\r\n%s%s%s%s", BulkString("pmessage"), BulkString(pattern), BulkString(channel), BulkString(payload))
+				receivers++
+			}
+		}
+	}
+	return receivers
+}
+
+// Subscriptions returns the number of channels and patterns subscribed to over all connections
+func (s *Server) Subscriptions() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	count := 0
+	for _, state := range s.conns {
+		count += len(state.channels) + len(state.patterns)
+	}
+	return count
+}
+
+func (s *Server) serve(c net.Conn) {
+	s.mutex.Lock()
+	s.conns[c] = &conn{
+		channels: make(map[string]bool),
+		patterns: make(map[string]bool),
+	}
+	s.mutex.Unlock()
+
+	defer func() {
+		s.mutex.Lock()
+		delete(s.conns, c)
+		s.mutex.Unlock()
+		c.Close()
+	}()
+
+	r := bufio.NewReader(c)
+	for {
+		args, err := ReadCommand(r)
+		if err != nil {
+			return
+		}
+
+		s.mutex.Lock()
+		reply := s.reply(s.conns[c], args)
+		_, err = io.WriteString(c, reply)
+		s.mutex.Unlock()
+
+		if err != nil {
+			return
+		}
+	}
+}
+
+// reply executes a command
+// NOTE mutex must be held
+func (s *Server) reply(c *conn, args []string) string {
+	command := strings.ToUpper(args[0])
+
+	if command == "AUTH" {
+		username, password := "", ""
+		switch len(args) {
+		case 2:
+			password = args[1]
+		case 3:
+			username, password = args[1], args[2]
+		default:
+			return "-ERR wrong number of arguments for 'auth' command\r\n"
+		}
+		if username == "default" {
+			username = ""
+		}
+
+		if s.password == "" || username != s.username || password != s.password {
+			return "-WRONGPASS invalid username-password pair or user is disabled.\r\n"
+		}
+		c.authenticated = true
+		return "+OK\r\n"
+	}
+
+	if s.password != "" && !c.authenticated {
+		return "-NOAUTH Authentication required.\r\n"
+	}
+
+	subscribed := len(c.channels) + len(c.patterns)
+
+	switch {
+	case command == "PING" && subscribed > 0:
+		return fmt.Sprintf("*2\r\n%s%s", BulkString("pong"), BulkString(""))
+	case command == "PING":
+		return "+PONG\r\n"
+	case command == "ROLE" && s.role != Sentinel:
+		return fmt.Sprintf("*3\r\n%s:0\r\n*0\r\n", BulkString(s.role))
+	case command == "SENTINEL" && s.role == Sentinel && len(args) == 3:
+		switch strings.ToUpper(args[1]) {
+		case "MASTER":
+			if s.primary == nil {
+				return "-ERR No such master with that name\r\n"
+			}
+			return instance(s.primary)
+		case "SLAVES", "REPLICAS":
+			reply := fmt.Sprintf("*%d\r\n", len(s.replicas))
+			for _, replica := range s.replicas {
+				reply += instance(replica)
+			}
+			return reply
+		case "SENTINELS":
+			return "*0\r\n"
+		}
+	case command == "SUBSCRIBE" || command == "UNSUBSCRIBE" || command == "PSUBSCRIBE" || command == "PUNSUBSCRIBE":
+		subscribedTo := c.channels
+		if command[0] == 'P' {
+			subscribedTo = c.patterns
+		}
+
+		names := args[1:]
+		unsubscribe := strings.HasSuffix(command, "UNSUBSCRIBE")
+		if unsubscribe && len(names) == 0 {
+			for name := range subscribedTo {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+		}
+
+		var reply string
+		for _, name := range names {
+			if unsubscribe {
+				delete(subscribedTo, name)
+			} else {
+				subscribedTo[name] = true
+			}
+			reply += fmt.Sprintf("*3\r\n%s%s:%d\r\n", BulkString(strings.ToLower(command)), BulkString(name), len(c.channels)+len(c.patterns))
+		}
+		return reply
+	case subscribed > 0:
+		return fmt.Sprintf("-ERR Can't execute '%s': only (P)SUBSCRIBE / (P)UNSUBSCRIBE / PING are allowed in this context\r\n", args[0])
+	case command == "PUBLISH" && len(args) == 3:
+		return fmt.Sprintf(":%d\r\n", s.deliver(args[1], args[2]))
+	case command == "CONFIG" && len(args) == 3 && strings.ToUpper(args[1]) == "GET":
+		value, ok := s.config[args[2]]
+		if !ok {
+			return "*0\r\n"
+		}
+		return fmt.Sprintf("*2\r\n%s%s", BulkString(args[2]), BulkString(value))
+	case command == "CONFIG" && len(args) == 4 && strings.ToUpper(args[1]) == "SET":
+		s.config[args[2]] = args[3]
+		return "+OK\r\n"
+	case command == "SELECT" && len(args) == 2:
+		return "+OK\r\n"
+	case command == "TYPE" && len(args) == 2:
+		if _, ok := s.values[args[1]]; ok {
+			return "+string\r\n"
+		}
+		if _, ok := s.hashes[args[1]]; ok {
+			return "+hash\r\n"
+		}
+		return "+none\r\n"
+	case command == "GET" && len(args) == 2:
+		if value, ok := s.values[args[1]]; ok {
+			return BulkString(value)
+		}
+		return "$-1\r\n"
+	case command == "SET" && len(args) == 3:
+		delete(s.hashes, args[1])
+		s.values[args[1]] = args[2]
+		return "+OK\r\n"
+	case command == "HSET" && len(args) >= 4 && len(args)%2 == 0:
+		delete(s.values, args[1])
+		fields, ok := s.hashes[args[1]]
+		if !ok {
+			fields = make(map[string]string)
+			s.hashes[args[1]] = fields
+		}
+
+		added := 0
+		for i := 2; i < len(args); i += 2 {
+			if _, ok := fields[args[i]]; !ok {
+				added++
+			}
+			fields[args[i]] = args[i+1]
+		}
+		return fmt.Sprintf(":%d\r\n", added)
+	case command == "HGETALL" && len(args) == 2:
+		fields := s.hashes[args[1]]
+
+		names := make([]string, 0, len(fields))
+		for name := range fields {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		reply := fmt.Sprintf("*%d\r\n", len(fields)*2)
+		for _, name := range names {
+			reply += BulkString(name) + BulkString(fields[name])
+		}
+		return reply
+	case command == "DEL" && len(args) >= 2:
+		deleted := 0
+		for _, key := range args[1:] {
+			_, isValue := s.values[key]
+			_, isHash := s.hashes[key]
+			if isValue || isHash {
+				deleted++
+			}
+			delete(s.values, key)
+			delete(s.hashes, key)
+		}
+		return fmt.Sprintf(":%d\r\n", deleted)
+	}
+
+	return fmt.Sprintf("-ERR unknown command '%s'\r\n", args[0])
+}
+
+// instance describes a server like the SENTINEL MASTER command
+func instance(s *Server) string {
+	host, port, _ := net.SplitHostPort(s.Addr())
+	return fmt.Sprintf("*4\r\n%s%s%s%s", BulkString("ip"), BulkString(host), BulkString("port"), BulkString(port))
+}
+
+// hostPort formats an address like the sentinel announcements, such as "127.0.0.1 1234"
+func hostPort(addr string) string {
+	host, port, _ := net.SplitHostPort(addr)
+	return host + " " + port
+}
+
+// ReadCommand reads a command sent as an array of bulk strings, for stand-ins of other kinds of redis servers
+func ReadCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+
+	count, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "*")))
+	if err != nil || count < 1 {
+		return nil, fmt.Errorf("invalid command: %q", line)
+	}
+
+	args := make([]string, count)
+	for i := range args {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+
+		size, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "$")))
+		if err != nil {
+			return nil, fmt.Errorf("invalid argument: %q", line)
+		}
+
+		data := make([]byte, size+2)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, err
+		}
+		args[i] = string(data[:size])
+	}
+
+	return args, nil
+}
+
+// BulkString encodes a bulk string reply
+func BulkString(s string) string {
+	return fmt.Sprintf("$%d\r\n%s\r\n", len(s), s)
+}
@@ -0,0 +1,116 @@
+package redistest_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mediocregopher/radix/v3"
+	"github.com/mullvad/message-queue/test/redistest"
+)
+
+func TestServer(t *testing.T) {
+	t.Run("auth", func(t *testing.T) {
+		s := redistest.NewServer(redistest.Primary)
+		defer s.Close()
+		s.RequireAuth("", "password")
+
+		unauthenticated, err := radix.Dial("tcp", s.Addr())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer unauthenticated.Close()
+
+		if err := unauthenticated.Do(radix.Cmd(nil, "PING")); err == nil {
+			t.Fatal("no authentication required")
+		}
+
+		conn, err := radix.Dial("tcp", s.Addr(), radix.DialAuthPass("password"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		var role []interface{}
+		if err := conn.Do(radix.Cmd(&role, "ROLE")); err != nil {
+			t.Fatal(err)
+		}
+		if len(role) == 0 || string(role[0].([]byte)) != redistest.Primary {
+			t.Fatalf("wrong role: %v", role)
+		}
+	})
+
+	t.Run("pubsub", func(t *testing.T) {
+		s := redistest.NewServer(redistest.Primary)
+		defer s.Close()
+
+		conn, err := radix.Dial("tcp", s.Addr())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ps := radix.PubSub(conn)
+		defer ps.Close()
+
+		ch := make(chan radix.PubSubMessage, 1)
+		if err := ps.PSubscribe(ch, "test-*"); err != nil {
+			t.Fatal(err)
+		}
+
+		if s.Subscriptions() != 1 {
+			t.Fatal("not subscribed")
+		}
+		if receivers := s.Publish("test-1", "payload"); receivers != 1 {
+			t.Fatalf("wrong number of receivers: %d", receivers)
+		}
+
+		select {
+		case m := <-ch:
+			if m.Channel != "test-1" || m.Pattern != "test-*" || string(m.Message) != "payload" {
+				t.Fatalf("wrong message: %+v", m)
+			}
+		case <-time.After(time.Second * 5):
+			t.Fatal("message not received")
+		}
+
+		// Disconnected clients are no longer subscribed
+		s.Disconnect()
+		for i := 0; s.Subscriptions() != 0; i++ {
+			if i == 100 {
+				t.Fatal("still subscribed")
+			}
+			time.Sleep(time.Millisecond * 10)
+		}
+	})
+
+	t.Run("sentinel", func(t *testing.T) {
+		primary, replica := redistest.NewServer(redistest.Primary), redistest.NewServer(redistest.Replica)
+		defer primary.Close()
+		defer replica.Close()
+
+		sentinel := redistest.NewServer(redistest.Sentinel)
+		defer sentinel.Close()
+		sentinel.SetTopology(primary, replica)
+
+		s, err := radix.NewSentinel("group", []string{sentinel.Addr()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+
+		if current, replicas := s.Addrs(); current != primary.Addr() || len(replicas) != 1 || replicas[0] != replica.Addr() {
+			t.Fatalf("wrong addresses: %s %v", current, replicas)
+		}
+
+		sentinel.Failover("group", replica)
+
+		for i := 0; ; i++ {
+			if current, _ := s.Addrs(); current == replica.Addr() {
+				break
+			}
+			if i == 100 {
+				t.Fatal("failover not announced")
+			}
+			time.Sleep(time.Millisecond * 10)
+		}
+	})
+}
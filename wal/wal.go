@@ -0,0 +1,557 @@
+package wal
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mullvad/message-queue/message"
+)
+
+// Log is an append-only log of the messages of a channel, stored on disk as a directory of segment files
+//
+// Every record is the length and CRC-32 checksum of the message, followed by the length of the message encoded as JSON
+// without its payload, the encoded message, and the payload as it was received.
+// Segments are named after the sequence number of their first message. When opening a log, any records after the
+// first one that is truncated or fails its checksum are removed, which recovers the log after a crash.
+//
+// Appended messages are synced to disk before Append returns, unless a sync interval is set, in which case they're
+// synced in the background at that interval, and the messages appended since the last sync may be lost if the machine
+// crashes. Either way, they survive the process crashing.
+type Log struct {
+	mutex    sync.Mutex
+	dir      string
+	options  Options
+	segments []*segment // Oldest first, the last one is being appended to
+	file     *os.File   // The last segment, opened for appending
+	dirty    bool       // Whether the last segment has been appended to since it was synced
+	closed   bool
+	stop     chan struct{} // Closed to stop syncing in the background, if there's a sync interval
+}
+
+// Options configures the size of the segments, how long messages are retained, and how often they're synced to disk
+type Options struct {
+	SegmentSize  int64         // Segments are rolled over once they exceed this size
+	MaxBytes     int64         // The oldest segments are removed once the log exceeds this size, if set
+	MaxAge       time.Duration // Segments are removed once their newest message is older than this, if set
+	SyncInterval time.Duration // Syncs appended messages at this interval if set, rather than on every append
+}
+
+// DefaultOptions are the options used if the segment size isn't set
+var DefaultOptions = Options{
+	SegmentSize: 64 * 1024 * 1024,
+}
+
+type segment struct {
+	path   string
+	first  uint64 // The sequence number of the first message, from the file name
+	last   uint64 // The sequence number of the last message, or zero if empty
+	size   int64
+	newest time.Time // The time of the newest message
+}
+
+const (
+	segmentSuffix = ".log"
+	headerSize    = 8
+	maxRecordSize = 64 * 1024 * 1024
+)
+
+var (
+	errCorrupt = errors.New("corrupt record")
+	errClosed  = errors.New("log closed")
+)
+
+// Open opens the log in the directory, creating it if it doesn't exist, and recovers it after any crash
+func Open(dir string, options Options) (*Log, error) {
+	if options.SegmentSize <= 0 {
+		options.SegmentSize = DefaultOptions.SegmentSize
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	l := &Log{
+		dir:     dir,
+		options: options,
+	}
+
+	if err := l.recover(); err != nil {
+		return nil, err
+	}
+
+	if options.SyncInterval > 0 {
+		l.stop = make(chan struct{})
+		go l.syncPeriodically(options.SyncInterval)
+	}
+
+	return l, nil
+}
+
+// syncPeriodically syncs the last segment at the interval if it's been appended to, until the log is closed
+func (l *Log) syncPeriodically(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := l.Sync(); err != nil && err != errClosed {
+				log.Printf("%s: error syncing: %s", l.dir, err)
+			}
+		case <-l.stop:
+			return
+		}
+	}
+}
+
+// recover reads all segments, truncating them at the first invalid record
+func (l *Log) recover() error {
+	files, err := ioutil.ReadDir(l.dir)
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		name := file.Name()
+		if file.IsDir() || !strings.HasSuffix(name, segmentSuffix) {
+			continue
+		}
+
+		first, err := strconv.ParseUint(strings.TrimSuffix(name, segmentSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+
+		s := &segment{
+			path:  filepath.Join(l.dir, name),
+			first: first,
+		}
+
+		if err := s.scan(); err != nil {
+			return err
+		}
+
+		// Segments may be left empty by a crash just after being created
+		if s.last == 0 {
+			if err := os.Remove(s.path); err != nil {
+				return err
+			}
+			continue
+		}
+
+		l.segments = append(l.segments, s)
+	}
+
+	sort.Slice(l.segments, func(i, j int) bool {
+		return l.segments[i].first < l.segments[j].first
+	})
+
+	l.enforceRetention(time.Now())
+
+	if len(l.segments) > 0 {
+		active := l.segments[len(l.segments)-1]
+		l.file, err = os.OpenFile(active.path, os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// scan reads the segment to find its last message and valid size, and truncates anything after that
+func (s *segment) scan() error {
+	f, err := os.Open(s.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	r := bufio.NewReader(f)
+	for {
+		m, n, err := readRecord(r)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Printf("%s: truncating at offset %d: %s", s.path, s.size, err)
+			break
+		}
+
+		s.last = m.Sequence
+		s.newest = m.Time
+		s.size += n
+	}
+
+	if s.size < info.Size() {
+		return os.Truncate(s.path, s.size)
+	}
+
+	return nil
+}
+
+func readRecord(r io.Reader) (*message.Message, int64, error) {
+	var header [headerSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, 0, errCorrupt
+		}
+		return nil, 0, err
+	}
+
+	length := binary.BigEndian.Uint32(header[0:4])
+	checksum := binary.BigEndian.Uint32(header[4:8])
+	if length > maxRecordSize {
+		return nil, 0, errCorrupt
+	}
+
+	data := make([]byte, length)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, 0, errCorrupt
+	}
+
+	if crc32.ChecksumIEEE(data) != checksum {
+		return nil, 0, errCorrupt
+	}
+
+	m, err := decodeRecord(data)
+	if err != nil {
+		return nil, 0, errCorrupt
+	}
+
+	return m, int64(headerSize + length), nil
+}
+
+// encodeRecord encodes the message, storing the payload verbatim rather than as JSON, which would reformat it
+func encodeRecord(m *message.Message) ([]byte, error) {
+	withoutPayload := *m
+	withoutPayload.Payload = nil
+
+	encoded, err := json.Marshal(&withoutPayload)
+	if err != nil {
+		return nil, err
+	}
+
+	data := make([]byte, 4+len(encoded)+len(m.Payload))
+	binary.BigEndian.PutUint32(data[0:4], uint32(len(encoded)))
+	copy(data[4:], encoded)
+	copy(data[4+len(encoded):], m.Payload)
+	return data, nil
+}
+
+func decodeRecord(data []byte) (*message.Message, error) {
+	if len(data) < 4 {
+		return nil, errCorrupt
+	}
+
+	length := binary.BigEndian.Uint32(data[0:4])
+	if uint64(length) > uint64(len(data)-4) {
+		return nil, errCorrupt
+	}
+
+	var m message.Message
+	if err := json.Unmarshal(data[4:4+length], &m); err != nil {
+		return nil, err
+	}
+
+	if payload := data[4+length:]; len(payload) > 0 {
+		m.Payload = payload
+	}
+	return &m, nil
+}
+
+// Append adds a message to the log
+// Messages must be appended in order of their sequence numbers
+func (l *Log) Append(m *message.Message) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.closed {
+		return errClosed
+	}
+
+	if m.Sequence <= l.lastSequence() {
+		return fmt.Errorf("sequence number %d not after %d", m.Sequence, l.lastSequence())
+	}
+
+	data, err := encodeRecord(m)
+	if err != nil {
+		return err
+	}
+
+	if len(data) > maxRecordSize {
+		return fmt.Errorf("message of %d bytes too large to store", len(data))
+	}
+
+	record := make([]byte, headerSize+len(data))
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(data)))
+	binary.BigEndian.PutUint32(record[4:8], crc32.ChecksumIEEE(data))
+	copy(record[headerSize:], data)
+
+	if l.file == nil || l.segments[len(l.segments)-1].size >= l.options.SegmentSize {
+		if err := l.roll(m.Sequence); err != nil {
+			return err
+		}
+	}
+
+	active := l.segments[len(l.segments)-1]
+	if _, err := l.file.Write(record); err != nil {
+		// Don't leave a partial record behind
+		l.file.Truncate(active.size)
+		return err
+	}
+	l.dirty = true
+
+	if l.options.SyncInterval <= 0 {
+		if err := l.sync(); err != nil {
+			l.file.Truncate(active.size)
+			return err
+		}
+	}
+
+	active.last = m.Sequence
+	active.newest = m.Time
+	active.size += int64(len(record))
+
+	l.enforceRetention(time.Now())
+
+	return nil
+}
+
+// Sync writes the messages appended since the last sync to disk
+func (l *Log) Sync() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.closed {
+		return errClosed
+	}
+
+	return l.sync()
+}
+
+// NOTE mutex must be held
+func (l *Log) sync() error {
+	if l.file == nil || !l.dirty {
+		return nil
+	}
+
+	if err := l.file.Sync(); err != nil {
+		return err
+	}
+
+	l.dirty = false
+	return nil
+}
+
+// roll starts a new segment, beginning with the given sequence number
+func (l *Log) roll(first uint64) error {
+	if l.file != nil {
+		if err := l.sync(); err != nil {
+			return err
+		}
+
+		if err := l.file.Close(); err != nil {
+			return err
+		}
+		l.file = nil
+	}
+
+	path := filepath.Join(l.dir, fmt.Sprintf("%020d%s", first, segmentSuffix))
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	// The new segment must be in the directory for the messages synced to it to be found after a crash
+	if err := syncDir(l.dir); err != nil {
+		f.Close()
+		return err
+	}
+
+	l.file = f
+	l.segments = append(l.segments, &segment{
+		path:  path,
+		first: first,
+	})
+
+	return nil
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	return d.Sync()
+}
+
+// enforceRetention removes the oldest segments exceeding the size or age limits, but never the active segment
+func (l *Log) enforceRetention(now time.Time) {
+	var total int64
+	for _, s := range l.segments {
+		total += s.size
+	}
+
+	for len(l.segments) > 1 {
+		oldest := l.segments[0]
+
+		tooLarge := l.options.MaxBytes > 0 && total > l.options.MaxBytes
+		tooOld := l.options.MaxAge > 0 && now.Sub(oldest.newest) > l.options.MaxAge
+		if !tooLarge && !tooOld {
+			return
+		}
+
+		if err := os.Remove(oldest.path); err != nil {
+			log.Printf("%s: error removing segment: %s", oldest.path, err)
+			return
+		}
+
+		total -= oldest.size
+		l.segments = l.segments[1:]
+	}
+}
+
+// Since returns up to limit messages with a sequence number after the given one, oldest first
+func (l *Log) Since(sequence uint64, limit int) ([]*message.Message, error) {
+	return l.collect(limit, func(s *segment) bool {
+		return s.last > sequence
+	}, func(m *message.Message) bool {
+		return m.Sequence > sequence
+	})
+}
+
+// SinceTime returns up to limit messages from the given time or later, oldest first
+func (l *Log) SinceTime(t time.Time, limit int) ([]*message.Message, error) {
+	return l.collect(limit, func(s *segment) bool {
+		return !s.newest.Before(t)
+	}, func(m *message.Message) bool {
+		return !m.Time.Before(t)
+	})
+}
+
+// collect returns up to limit messages matching the predicate, only reading the segments that may contain them
+func (l *Log) collect(limit int, contains func(s *segment) bool, predicate func(m *message.Message) bool) ([]*message.Message, error) {
+	// Copy the segments to read, to read them without blocking appends, as appending updates the last one
+	l.mutex.Lock()
+	var segments []segment
+	for _, s := range l.segments {
+		if contains(s) {
+			segments = append(segments, *s)
+		}
+	}
+	l.mutex.Unlock()
+
+	var messages []*message.Message
+	for _, s := range segments {
+		err := s.read(func(m *message.Message) bool {
+			if predicate(m) {
+				messages = append(messages, m)
+			}
+			return len(messages) < limit
+		})
+		// The oldest segments may have been removed since, along with any before them which were already read
+		if os.IsNotExist(err) {
+			messages = nil
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if len(messages) >= limit {
+			break
+		}
+	}
+
+	return messages, nil
+}
+
+// read calls the function for every message in the segment, until it returns false
+func (s *segment) read(f func(m *message.Message) bool) error {
+	file, err := os.Open(s.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	// Only read the records known to be complete
+	r := bufio.NewReader(io.LimitReader(file, s.size))
+	for {
+		m, _, err := readRecord(r)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %s", s.path, err)
+		}
+
+		if !f(m) {
+			return nil
+		}
+	}
+}
+
+// LastSequence returns the sequence number of the last message, or zero if the log is empty
+func (l *Log) LastSequence() uint64 {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	return l.lastSequence()
+}
+
+func (l *Log) lastSequence() uint64 {
+	for i := len(l.segments) - 1; i >= 0; i-- {
+		if l.segments[i].last != 0 {
+			return l.segments[i].last
+		}
+	}
+	return 0
+}
+
+// Close closes the log
+func (l *Log) Close() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.closed {
+		return nil
+	}
+	l.closed = true
+
+	if l.stop != nil {
+		close(l.stop)
+	}
+
+	if l.file == nil {
+		return nil
+	}
+
+	err := l.sync()
+	if closeErr := l.file.Close(); err == nil {
+		err = closeErr
+	}
+	l.file = nil
+	return err
+}
@@ -0,0 +1,340 @@
+package wal_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mullvad/message-queue/message"
+	"github.com/mullvad/message-queue/wal"
+)
+
+func TestLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	l, err := wal.Open(dir, wal.Options{SegmentSize: 200})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	appendMessages(t, l, 1, 10)
+
+	t.Run("read messages", func(t *testing.T) {
+		assertMessages(t, l, 4, 3, 5, 7)
+		assertMessages(t, l, 8, 100, 9, 10)
+		assertMessages(t, l, 10, 100, 11, 10)
+	})
+
+	t.Run("read messages by time", func(t *testing.T) {
+		messages, err := l.SinceTime(time.Now().Add(-time.Minute), 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(messages) != 3 || messages[0].Sequence != 1 {
+			t.Fatalf("wrong messages: %d", len(messages))
+		}
+
+		messages, err = l.SinceTime(time.Now().Add(time.Minute), 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(messages) != 0 {
+			t.Fatalf("got %d messages", len(messages))
+		}
+	})
+
+	t.Run("reject out of order messages", func(t *testing.T) {
+		m := message.New("test", []byte("test"))
+		m.Sequence = 10
+		if err := l.Append(m); err == nil {
+			t.Fatal("no error")
+		}
+	})
+
+	t.Run("reopen", func(t *testing.T) {
+		if err := l.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		l, err = wal.Open(dir, wal.Options{SegmentSize: 200})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if l.LastSequence() != 10 {
+			t.Fatalf("wrong last sequence %d", l.LastSequence())
+		}
+
+		appendMessages(t, l, 11, 12)
+		assertMessages(t, l, 0, 100, 1, 12)
+	})
+
+	t.Run("sync at an interval", func(t *testing.T) {
+		if err := l.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		l, err = wal.Open(dir, wal.Options{SegmentSize: 200, SyncInterval: time.Millisecond})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		appendMessages(t, l, 13, 20)
+		time.Sleep(time.Millisecond * 10)
+		if err := l.Sync(); err != nil {
+			t.Fatal(err)
+		}
+		appendMessages(t, l, 21, 22)
+
+		// Closing syncs the rest
+		if err := l.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if err := l.Sync(); err == nil {
+			t.Fatal("synced a closed log")
+		}
+
+		l, err = wal.Open(dir, wal.Options{SegmentSize: 200})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+
+		assertMessages(t, l, 0, 100, 1, 22)
+	})
+}
+
+func TestRecovery(t *testing.T) {
+	tests := []struct {
+		Name    string
+		Corrupt func(data []byte) []byte
+	}{
+		{"torn write", func(data []byte) []byte { return data[:len(data)-3] }},
+		{"checksum mismatch", func(data []byte) []byte { data[len(data)-2] ^= 0xff; return data }},
+		{"garbage", func(data []byte) []byte { return append(data, 0, 0, 0, 1, 2, 3) }},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "wal")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			l, err := wal.Open(dir, wal.Options{})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			appendMessages(t, l, 1, 3)
+			l.Close()
+
+			path := filepath.Join(dir, fmt.Sprintf("%020d.log", 1))
+			data, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err := ioutil.WriteFile(path, test.Corrupt(data), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			l, err = wal.Open(dir, wal.Options{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer l.Close()
+
+			// Everything up until the corrupt record should remain, and appending should work again
+			expected := uint64(2)
+			if test.Name == "garbage" {
+				expected = 3
+			}
+
+			if l.LastSequence() != expected {
+				t.Fatalf("wrong last sequence %d", l.LastSequence())
+			}
+
+			appendMessages(t, l, expected+1, expected+1)
+			assertMessages(t, l, 0, 100, 1, expected+1)
+		})
+	}
+}
+
+func TestPayload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	l, err := wal.Open(dir, wal.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	// Payloads are stored as they were received, rather than reformatted as JSON
+	payloads := []string{"{ \"html\": \"<b>&amp;</b>\" }\n", "text", "\x00\xff", ""}
+	for i, payload := range payloads {
+		m := message.New("test", []byte(payload))
+		m.Sequence = uint64(i + 1)
+		m.Headers = map[string]string{"key": "<a>"}
+		if err := l.Append(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	messages, err := l.Since(0, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(messages) != len(payloads) {
+		t.Fatalf("wrong number of messages: %d", len(messages))
+	}
+
+	for i, m := range messages {
+		if string(m.Payload) != payloads[i] || m.Sequence != uint64(i+1) || m.Channel != "test" {
+			t.Errorf("wrong message %d: %q", m.Sequence, m.Payload)
+		}
+
+		if m.Headers["key"] != "<a>" {
+			t.Errorf("wrong headers of message %d: %v", m.Sequence, m.Headers)
+		}
+	}
+}
+
+func TestRetention(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	t.Run("max bytes", func(t *testing.T) {
+		l, err := wal.Open(filepath.Join(dir, "bytes"), wal.Options{SegmentSize: 100, MaxBytes: 300})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+
+		appendMessages(t, l, 1, 20)
+
+		messages, err := l.Since(0, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(messages) == 0 || len(messages) >= 20 || messages[len(messages)-1].Sequence != 20 {
+			t.Fatalf("wrong number of messages retained: %d", len(messages))
+		}
+	})
+
+	t.Run("max age", func(t *testing.T) {
+		l, err := wal.Open(filepath.Join(dir, "age"), wal.Options{SegmentSize: 1, MaxAge: time.Minute})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+
+		old := message.New("test", []byte("old"))
+		old.Sequence = 1
+		old.Time = time.Now().Add(-time.Hour)
+		if err := l.Append(old); err != nil {
+			t.Fatal(err)
+		}
+
+		appendMessages(t, l, 2, 3)
+		assertMessages(t, l, 0, 100, 2, 3)
+	})
+
+	t.Run("read while appending", func(t *testing.T) {
+		l, err := wal.Open(filepath.Join(dir, "concurrent"), wal.Options{SegmentSize: 100, MaxBytes: 300})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for i := uint64(1); i <= 200; i++ {
+				m := message.New("test", []byte(fmt.Sprintf(`{"n":%d}`, i)))
+				m.Sequence = i
+				if err := l.Append(m); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+
+		for reading := true; reading; {
+			select {
+			case <-done:
+				reading = false
+			default:
+			}
+
+			messages, err := l.Since(0, 100)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// The segments removed while reading must not leave gaps
+			for i := 1; i < len(messages); i++ {
+				if messages[i].Sequence != messages[i-1].Sequence+1 {
+					t.Fatalf("message %d after %d", messages[i].Sequence, messages[i-1].Sequence)
+				}
+			}
+		}
+	})
+}
+
+func appendMessages(t *testing.T, l *wal.Log, first, last uint64) {
+	t.Helper()
+
+	for i := first; i <= last; i++ {
+		m := message.New("test", []byte(fmt.Sprintf(`{"n":%d}`, i)))
+		m.Sequence = i
+		if err := l.Append(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func assertMessages(t *testing.T, l *wal.Log, since uint64, limit int, first, last uint64) {
+	t.Helper()
+
+	messages, err := l.Since(since, limit)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if first > last {
+		if len(messages) != 0 {
+			t.Fatalf("got %d messages", len(messages))
+		}
+		return
+	}
+
+	if uint64(len(messages)) != last-first+1 {
+		t.Fatalf("wrong number of messages: %d", len(messages))
+	}
+
+	for i, m := range messages {
+		if m.Sequence != first+uint64(i) || string(m.Payload) != fmt.Sprintf(`{"n":%d}`, m.Sequence) {
+			t.Fatalf("wrong message %d: %s", m.Sequence, m.Payload)
+		}
+	}
+}